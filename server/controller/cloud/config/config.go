@@ -16,22 +16,27 @@
 
 package config
 
+import (
+	"github.com/deepflowys/deepflow/server/controller/cloud/lint"
+)
+
 var CONF *CloudConfig
 
 type CloudConfig struct {
-	KubernetesGatherInterval uint32 `default:"60" yaml:"kubernetes_gather_interval"`
-	AliyunRegionName         string `default:"cn-beijing" yaml:"aliyun_region_name"`
-	GenesisDefaultRegionName string `default:"系统默认" yaml:"genesis_default_region"`
-	GenesisDefaultVpcName    string `default:"default_vpc" yaml:"genesis_default_vpc"`
-	HostnameToIPFile         string `default:"/etc/hostname_to_ip.csv" yaml:"hostname_to_ip_file"`
-	DNSEnable                bool   `default:"false" yaml:"dns_enable"`
-	HTTPTimeout              int    `default:"30" yaml:"http_timeout"`
+	KubernetesGatherInterval      uint32     `default:"60" yaml:"kubernetes_gather_interval"`
+	KubernetesGatherResyncMinutes uint32     `default:"10" yaml:"kubernetes_gather_resync_minutes"`
+	AliyunRegionName              string     `default:"cn-beijing" yaml:"aliyun_region_name"`
+	GenesisDefaultRegionName      string     `default:"系统默认" yaml:"genesis_default_region"`
+	GenesisDefaultVpcName         string     `default:"default_vpc" yaml:"genesis_default_vpc"`
+	HostnameToIPFile              string     `default:"/etc/hostname_to_ip.csv" yaml:"hostname_to_ip_file"`
+	DNSEnable                     bool       `default:"false" yaml:"dns_enable"`
+	HTTPTimeout                   int        `default:"30" yaml:"http_timeout"`
+	Lint                          lint.Config `yaml:"lint"`
 }
 
+// SetCloudGlobalConfig设置进程内唯一的CloudConfig。各KubernetesGatherTask在每轮resync开始前
+// 都会重新读取config.CONF，所以再次调用这个函数设置的新值会在下一轮resync生效；config.Watcher
+// 热重载时不会重新读取cloud这部分配置，也不会调用这个函数
 func SetCloudGlobalConfig(c CloudConfig) {
-	CONF = &CloudConfig{
-		HostnameToIPFile: c.HostnameToIPFile,
-		DNSEnable:        c.DNSEnable,
-		HTTPTimeout:      c.HTTPTimeout,
-	}
+	CONF = &c
 }
@@ -0,0 +1,105 @@
+/*
+ * Copyright (c) 2022 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cloud
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+var (
+	watchEventsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "deepflow_cloud_kubernetes_gather_watch_events_total",
+		Help: "Add/Update/Delete events observed by KubernetesGatherTask's informers, labeled by resource and event type.",
+	}, []string{"resource", "event"})
+	watchReconnectsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "deepflow_cloud_kubernetes_gather_watch_reconnects_total",
+		Help: "Watch reconnects (relist after a dropped watch) observed by KubernetesGatherTask's informers, labeled by resource.",
+	}, []string{"resource"})
+	driftDetectedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "deepflow_cloud_kubernetes_gather_drift_detected_total",
+		Help: "Times a periodic full resync produced a different resource than the watch-driven view, labeled by cluster lcuuid.",
+	}, []string{"lcuuid"})
+)
+
+func init() {
+	prometheus.MustRegister(watchEventsTotal, watchReconnectsTotal, driftDetectedTotal)
+}
+
+// gatherInformers管理一个集群的Add/Update/Delete watch子系统：每种资源各起一个SharedIndexInformer，
+// 事件到来时只做两件事——记Prometheus指标、把dirty信号非阻塞地塞进onChange——真正的全量重新组装仍然
+// 交给kubernetes_gather.KubernetesGather.GetKubernetesGatherData()，因为KubernetesGatherResource
+// 内部字段怎么从单个pod/node/service对象增量patch是kubernetes_gather包的内部细节，这里只负责
+// "资源变了"这个信号本身，外加watch掉线重连的可观测性
+type gatherInformers struct {
+	factory informers.SharedInformerFactory
+	stopCh  chan struct{}
+}
+
+// startGatherInformers为一个集群起一套informer，clientset为nil时返回nil（调用方应该回退到纯
+// 定时全量拉取，比如kubeconfig还没配置好的集群）。onChange在任意一种资源的Add/Update/Delete
+// 事件到来时被调用，调用方负责把多次调用合并成一次重新组装（见kubernetes_gather_task.go）
+func startGatherInformers(clientset kubernetes.Interface, lcuuid string, resyncInterval time.Duration, onChange func()) *gatherInformers {
+	if clientset == nil {
+		return nil
+	}
+
+	factory := informers.NewSharedInformerFactory(clientset, resyncInterval)
+
+	register := func(resource string, informer cache.SharedIndexInformer) {
+		informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) {
+				watchEventsTotal.WithLabelValues(resource, "add").Inc()
+				onChange()
+			},
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				watchEventsTotal.WithLabelValues(resource, "update").Inc()
+				onChange()
+			},
+			DeleteFunc: func(obj interface{}) {
+				watchEventsTotal.WithLabelValues(resource, "delete").Inc()
+				onChange()
+			},
+		})
+		informer.SetWatchErrorHandler(func(r *cache.Reflector, err error) {
+			watchReconnectsTotal.WithLabelValues(resource).Inc()
+			log.Warningf("kubernetes gather (%s) watch for %s dropped, relisting: %s", lcuuid, resource, err)
+		})
+	}
+
+	register("pods", factory.Core().V1().Pods().Informer())
+	register("nodes", factory.Core().V1().Nodes().Informer())
+	register("services", factory.Core().V1().Services().Informer())
+	register("namespaces", factory.Core().V1().Namespaces().Informer())
+
+	stopCh := make(chan struct{})
+	factory.Start(stopCh)
+	factory.WaitForCacheSync(stopCh)
+
+	return &gatherInformers{factory: factory, stopCh: stopCh}
+}
+
+func (g *gatherInformers) Stop() {
+	if g == nil {
+		return
+	}
+	close(g.stopCh)
+}
@@ -18,14 +18,26 @@ package cloud
 
 import (
 	"context"
+	"reflect"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/deepflowys/deepflow/server/controller/cloud/config"
 	"github.com/deepflowys/deepflow/server/controller/cloud/kubernetes_gather"
 	kubernetes_gather_model "github.com/deepflowys/deepflow/server/controller/cloud/kubernetes_gather/model"
+	"github.com/deepflowys/deepflow/server/controller/cloud/lint"
 	"github.com/deepflowys/deepflow/server/controller/common"
 	"github.com/deepflowys/deepflow/server/controller/db/mysql"
 )
 
+// ResourceEvent是KubernetesGatherTask每次重新组装出新的KubernetesGatherResource后推送给订阅者的事件，
+// Version单调递增，订阅者可以据此判断是否发生了变化，而不需要自己比较整个resource
+type ResourceEvent struct {
+	Version  uint64
+	Resource kubernetes_gather_model.KubernetesGatherResource
+}
+
 type KubernetesGatherTask struct {
 	kCtx             context.Context
 	kCancel          context.CancelFunc
@@ -33,6 +45,23 @@ type KubernetesGatherTask struct {
 	resource         kubernetes_gather_model.KubernetesGatherResource
 	basicInfo        kubernetes_gather_model.KubernetesGatherBasicInfo
 	SubDomainConfig  string // 附属容器集群配置字段config
+
+	// resourceVersion随每次成功的重新组装递增，配合eventCh给下游（如livestatereporter）提供推送语义。
+	// 重新组装由client-go informer的Add/Update/Delete事件驱动（见kubernetes_gather_informer.go），
+	// resyncInterval之下的定时全量拉取只作为watch掉线、遗漏事件时的兜底和漂移检测基准
+	resourceVersion uint64
+	eventCh         chan ResourceEvent
+	resyncInterval  time.Duration
+
+	// resyncCount统计全量resync（含兜底轮询和漂移检测触发的那次）次数，供Prometheus exporter对接
+	resyncCount uint64
+
+	// informers是这个集群的watch子系统，kubeconfig取不到clientset时为nil，此时Start()退化为
+	// 纯定时全量轮询
+	informers *gatherInformers
+
+	// findings是每次全量resync后lint包跑出来的配置问题，供ListClusterFindings RPC查询
+	findings []lint.Finding
 }
 
 func NewKubernetesGatherTask(
@@ -48,7 +77,11 @@ func NewKubernetesGatherTask(
 	}
 
 	kCtx, kCancel := context.WithCancel(ctx)
-	return &KubernetesGatherTask{
+	resyncInterval := 10 * time.Minute
+	if config.CONF != nil && config.CONF.KubernetesGatherResyncMinutes > 0 {
+		resyncInterval = time.Duration(config.CONF.KubernetesGatherResyncMinutes) * time.Minute
+	}
+	task := &KubernetesGatherTask{
 		basicInfo: kubernetes_gather_model.KubernetesGatherBasicInfo{
 			Name:                  kubernetesGather.Name,
 			Lcuuid:                kubernetesGather.Lcuuid,
@@ -64,7 +97,11 @@ func NewKubernetesGatherTask(
 		kCancel:          kCancel,
 		kubernetesGather: kubernetesGather,
 		SubDomainConfig:  subDomainConfig,
+		eventCh:          make(chan ResourceEvent, 1),
+		resyncInterval:   resyncInterval,
 	}
+	taskRegistry.add(task.basicInfo.Lcuuid, task)
+	return task
 }
 
 func (k *KubernetesGatherTask) GetBasicInfo() kubernetes_gather_model.KubernetesGatherBasicInfo {
@@ -75,27 +112,101 @@ func (k *KubernetesGatherTask) GetResource() kubernetes_gather_model.KubernetesG
 	return k.resource
 }
 
+// GetFindings返回上一次全量resync后lint规则检查出的问题，供controller的ListClusterFindings RPC使用
+func (k *KubernetesGatherTask) GetFindings() []lint.Finding {
+	return k.findings
+}
+
+// EventCh供希望以推送而非轮询方式消费资源变化的下游（如livestatereporter）订阅，每次全量resync产生的
+// 最新resource都会尝试非阻塞地送入该channel，下游跟不上时直接丢弃旧事件，保留GetResource()作为兜底
+func (k *KubernetesGatherTask) EventCh() <-chan ResourceEvent {
+	return k.eventCh
+}
+
+func (k *KubernetesGatherTask) GetResourceVersion() uint64 {
+	return atomic.LoadUint64(&k.resourceVersion)
+}
+
+func (k *KubernetesGatherTask) publishEvent() {
+	version := atomic.AddUint64(&k.resourceVersion, 1)
+	event := ResourceEvent{Version: version, Resource: k.resource}
+	select {
+	case <-k.eventCh:
+	default:
+	}
+	select {
+	case k.eventCh <- event:
+	default:
+	}
+}
+
+// assemble跑一次kubernetesGather.GetKubernetesGatherData()，把结果整理进k.resource/k.findings
+// 并publishEvent，Add/Update/Delete驱动的重新组装和定时兜底resync都走这一个函数，保证两条触发路径
+// 的状态处理（错误码、lint、事件发布）完全一致
+func (k *KubernetesGatherTask) assemble() kubernetes_gather_model.KubernetesGatherResource {
+	log.Infof("kubernetes gather (%s) assemble data starting", k.kubernetesGather.Name)
+	resource, err := k.kubernetesGather.GetKubernetesGatherData()
+	// 这里因为任务内部没有对成功的状态赋值状态码，在这里统一处理了
+	if err != nil {
+		resource.ErrorMessage = err.Error()
+		if resource.ErrorState == 0 {
+			resource.ErrorState = common.RESOURCE_STATE_CODE_EXCEPTION
+		}
+	} else {
+		resource.ErrorState = common.RESOURCE_STATE_CODE_SUCCESS
+	}
+	k.resource = resource
+	atomic.AddUint64(&k.resyncCount, 1)
+	if config.CONF != nil {
+		k.findings = lint.Run(config.CONF.Lint, k.basicInfo, k.resource)
+	}
+	k.publishEvent()
+	log.Infof("kubernetes gather (%s) assemble data complete", k.kubernetesGather.Name)
+	return resource
+}
+
+// Start起两条并行路径：watch子系统可用时，Add/Update/Delete事件（经dirtyCh去抖）驱动增量重新
+// 组装，这是resource变化的主要来源；resyncInterval定时全量resync则作为兜底——既补齐watch掉线期间
+// 漏掉的事件，也是一次漂移检测：把这次全量resync的结果和当前（watch驱动得到的）resource比较，
+// 不一致说明watch这段时间漏了东西，记一次drift并以这次全量结果为准自愈。watch子系统起不来（比如
+// kubeconfig还没配置好）时，退化成纯定时全量轮询，和改造前行为一致
 func (k *KubernetesGatherTask) Start() {
+	dirtyCh := make(chan struct{}, 1)
+
+	clientset, err := k.kubernetesGather.GetKubernetesClient()
+	if err != nil {
+		log.Warningf("kubernetes gather (%s) has no usable k8s client, falling back to polling only: %s", k.kubernetesGather.Name, err)
+	}
+	k.informers = startGatherInformers(clientset, k.basicInfo.Lcuuid, k.resyncInterval, func() {
+		select {
+		case dirtyCh <- struct{}{}:
+		default:
+		}
+	})
+
 	go func() {
-		// TODO 配置时间间隔
-		ticker := time.NewTicker(time.Minute)
+		ticker := time.NewTicker(k.resyncInterval)
 	LOOP:
 		for {
 			select {
+			case <-dirtyCh:
+				k.assemble()
 			case <-ticker.C:
-				log.Infof("kubernetes gather (%s) assemble data starting", k.kubernetesGather.Name)
-				var err error
-				k.resource, err = k.kubernetesGather.GetKubernetesGatherData()
-				// 这里因为任务内部没有对成功的状态赋值状态码，在这里统一处理了
-				if err != nil {
-					k.resource.ErrorMessage = err.Error()
-					if k.resource.ErrorState == 0 {
-						k.resource.ErrorState = common.RESOURCE_STATE_CODE_EXCEPTION
+				// kubernetes_gather_resync_minutes支持热重载：每轮resync前都重新读一次config.CONF，
+				// 发现变化就reset ticker，不需要重启进程
+				if config.CONF != nil && config.CONF.KubernetesGatherResyncMinutes > 0 {
+					if newInterval := time.Duration(config.CONF.KubernetesGatherResyncMinutes) * time.Minute; newInterval != k.resyncInterval {
+						log.Infof("kubernetes gather (%s) resync interval changed from %s to %s", k.kubernetesGather.Name, k.resyncInterval, newInterval)
+						k.resyncInterval = newInterval
+						ticker.Reset(k.resyncInterval)
 					}
-				} else {
-					k.resource.ErrorState = common.RESOURCE_STATE_CODE_SUCCESS
 				}
-				log.Infof("kubernetes gather (%s) assemble data complete", k.kubernetesGather.Name)
+				previous := k.resource
+				resource := k.assemble()
+				if k.informers != nil && !reflect.DeepEqual(previous, resource) {
+					driftDetectedTotal.WithLabelValues(k.basicInfo.Lcuuid).Inc()
+					log.Warningf("kubernetes gather (%s) drift detected: watch-driven resource differed from periodic full resync", k.kubernetesGather.Name)
+				}
 			case <-k.kCtx.Done():
 				break LOOP
 			}
@@ -107,4 +218,75 @@ func (k *KubernetesGatherTask) Stop() {
 	if k.kCancel != nil {
 		k.kCancel()
 	}
+	k.informers.Stop()
+	taskRegistry.remove(k.basicInfo.Lcuuid)
+}
+
+// taskRegistry让grpc层（ListClusterFindings）能按集群Lcuuid查到对应的KubernetesGatherTask，
+// 而不用把每个domain/sub_domain的manager都串起来
+var taskRegistry = newGatherTaskRegistry()
+
+type gatherTaskRegistry struct {
+	mutex sync.RWMutex
+	tasks map[string]*KubernetesGatherTask
+}
+
+func newGatherTaskRegistry() *gatherTaskRegistry {
+	return &gatherTaskRegistry{tasks: make(map[string]*KubernetesGatherTask)}
+}
+
+func (r *gatherTaskRegistry) add(lcuuid string, task *KubernetesGatherTask) {
+	r.mutex.Lock()
+	r.tasks[lcuuid] = task
+	r.mutex.Unlock()
+}
+
+func (r *gatherTaskRegistry) remove(lcuuid string) {
+	r.mutex.Lock()
+	delete(r.tasks, lcuuid)
+	r.mutex.Unlock()
+}
+
+func (r *gatherTaskRegistry) get(lcuuid string) *KubernetesGatherTask {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.tasks[lcuuid]
+}
+
+func (r *gatherTaskRegistry) all() []*KubernetesGatherTask {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	tasks := make([]*KubernetesGatherTask, 0, len(r.tasks))
+	for _, task := range r.tasks {
+		tasks = append(tasks, task)
+	}
+	return tasks
+}
+
+// GetClusterResource返回指定集群当前的resource快照及其版本号，供livestatereporter等需要
+// 增量推送的消费者轮询，version在每次全量resync后递增
+func GetClusterResource(lcuuid string) (kubernetes_gather_model.KubernetesGatherResource, uint64, bool) {
+	task := taskRegistry.get(lcuuid)
+	if task == nil {
+		return kubernetes_gather_model.KubernetesGatherResource{}, 0, false
+	}
+	return task.GetResource(), task.GetResourceVersion(), true
+}
+
+// GetClusterFindings返回指定集群（按domain/sub_domain的Lcuuid）最近一次lint检查的结果
+func GetClusterFindings(lcuuid string) []lint.Finding {
+	task := taskRegistry.get(lcuuid)
+	if task == nil {
+		return nil
+	}
+	return task.GetFindings()
+}
+
+// ListAllClusterFindings返回当前进程内所有KubernetesGatherTask的lint检查结果，以Lcuuid分组
+func ListAllClusterFindings() map[string][]lint.Finding {
+	result := make(map[string][]lint.Finding)
+	for _, task := range taskRegistry.all() {
+		result[task.basicInfo.Lcuuid] = task.GetFindings()
+	}
+	return result
 }
@@ -0,0 +1,95 @@
+/*
+ * Copyright (c) 2022 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package lint检查已采集的KubernetesGatherResource，发现配置问题（如探测CIDR设置过大、
+// PortNameRegex不合法等），思路上借鉴了popeye等集群sanitizer：规则互相独立、可单独开关、
+// 只读不改写采集到的数据。
+package lint
+
+import (
+	kubernetes_gather_model "github.com/deepflowys/deepflow/server/controller/cloud/kubernetes_gather/model"
+)
+
+type Severity uint8
+
+const (
+	SeverityInfo Severity = iota
+	SeverityWarning
+	SeverityError
+)
+
+var severityStrings = []string{
+	SeverityInfo:    "info",
+	SeverityWarning: "warning",
+	SeverityError:   "error",
+}
+
+func (s Severity) String() string {
+	if int(s) >= len(severityStrings) {
+		return "unknown"
+	}
+	return severityStrings[s]
+}
+
+// Finding是单条规则命中的结果
+type Finding struct {
+	RuleID   string   `json:"rule_id"`
+	Severity Severity `json:"severity"`
+	Message  string   `json:"message"`
+}
+
+// Rule是单条可独立开关的检查规则
+type Rule interface {
+	ID() string
+	Severity() Severity
+	Check(basicInfo kubernetes_gather_model.KubernetesGatherBasicInfo, resource kubernetes_gather_model.KubernetesGatherResource) []Finding
+}
+
+// Config控制cloud.lint配置段下每条规则的开关，规则ID不在Disabled中即默认启用
+type Config struct {
+	Enabled  bool     `default:"true" yaml:"enabled"`
+	Disabled []string `yaml:"disabled"`
+}
+
+func (c Config) isDisabled(ruleID string) bool {
+	for _, id := range c.Disabled {
+		if id == ruleID {
+			return true
+		}
+	}
+	return false
+}
+
+var defaultRules = []Rule{
+	&PortNameRegexRule{},
+	&CIDRMaskOverflowRule{},
+	&GatherErrorRule{},
+}
+
+// Run依次执行所有启用的规则，汇总命中的Finding
+func Run(cfg Config, basicInfo kubernetes_gather_model.KubernetesGatherBasicInfo, resource kubernetes_gather_model.KubernetesGatherResource) []Finding {
+	if !cfg.Enabled {
+		return nil
+	}
+	findings := []Finding{}
+	for _, rule := range defaultRules {
+		if cfg.isDisabled(rule.ID()) {
+			continue
+		}
+		findings = append(findings, rule.Check(basicInfo, resource)...)
+	}
+	return findings
+}
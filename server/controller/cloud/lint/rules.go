@@ -0,0 +1,89 @@
+/*
+ * Copyright (c) 2022 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lint
+
+import (
+	"fmt"
+	"regexp"
+
+	kubernetes_gather_model "github.com/deepflowys/deepflow/server/controller/cloud/kubernetes_gather/model"
+)
+
+// PortNameRegexRule检查集群配置的PortNameRegex是否是一个能编译通过的正则表达式，
+// 这个正则用于从接口名中提取采集器关心的信息，写错了会导致该集群所有流量都无法按接口名打标签
+type PortNameRegexRule struct{}
+
+func (r *PortNameRegexRule) ID() string       { return "port-name-regex-invalid" }
+func (r *PortNameRegexRule) Severity() Severity { return SeverityError }
+
+func (r *PortNameRegexRule) Check(basicInfo kubernetes_gather_model.KubernetesGatherBasicInfo, _ kubernetes_gather_model.KubernetesGatherResource) []Finding {
+	if basicInfo.PortNameRegex == "" {
+		return nil
+	}
+	if _, err := regexp.Compile(basicInfo.PortNameRegex); err != nil {
+		return []Finding{{
+			RuleID:   r.ID(),
+			Severity: r.Severity(),
+			Message:  fmt.Sprintf("cluster %s (%s) has an invalid port_name_regex %q: %s", basicInfo.Name, basicInfo.ClusterID, basicInfo.PortNameRegex, err),
+		}}
+	}
+	return nil
+}
+
+// CIDRMaskOverflowRule检查pod子网最大掩码是否超出了v4/v6地址位宽，这类配置错误只有在
+// 某个pod恰好落在溢出的子网里时才会暴露，平时很难发现
+type CIDRMaskOverflowRule struct{}
+
+func (r *CIDRMaskOverflowRule) ID() string       { return "pod-net-cidr-mask-overflow" }
+func (r *CIDRMaskOverflowRule) Severity() Severity { return SeverityError }
+
+func (r *CIDRMaskOverflowRule) Check(basicInfo kubernetes_gather_model.KubernetesGatherBasicInfo, _ kubernetes_gather_model.KubernetesGatherResource) []Finding {
+	findings := []Finding{}
+	if basicInfo.PodNetIPv4CIDRMaxMask > 32 {
+		findings = append(findings, Finding{
+			RuleID:   r.ID(),
+			Severity: r.Severity(),
+			Message:  fmt.Sprintf("cluster %s (%s) has pod_net_ipv4_cidr_max_mask=%d, which overflows a 32-bit IPv4 address", basicInfo.Name, basicInfo.ClusterID, basicInfo.PodNetIPv4CIDRMaxMask),
+		})
+	}
+	if basicInfo.PodNetIPv6CIDRMaxMask > 128 {
+		findings = append(findings, Finding{
+			RuleID:   r.ID(),
+			Severity: r.Severity(),
+			Message:  fmt.Sprintf("cluster %s (%s) has pod_net_ipv6_cidr_max_mask=%d, which overflows a 128-bit IPv6 address", basicInfo.Name, basicInfo.ClusterID, basicInfo.PodNetIPv6CIDRMaxMask),
+		})
+	}
+	return findings
+}
+
+// GatherErrorRule把上一次采集留下的ErrorState/ErrorMessage也作为一条finding上报，
+// 这样operator可以在一个接口里同时看到“采集失败”和“采集成功但配置有问题”两类情况
+type GatherErrorRule struct{}
+
+func (r *GatherErrorRule) ID() string       { return "gather-error-state" }
+func (r *GatherErrorRule) Severity() Severity { return SeverityWarning }
+
+func (r *GatherErrorRule) Check(basicInfo kubernetes_gather_model.KubernetesGatherBasicInfo, resource kubernetes_gather_model.KubernetesGatherResource) []Finding {
+	if resource.ErrorMessage == "" {
+		return nil
+	}
+	return []Finding{{
+		RuleID:   r.ID(),
+		Severity: r.Severity(),
+		Message:  fmt.Sprintf("cluster %s (%s) last gather ended with an error: %s", basicInfo.Name, basicInfo.ClusterID, resource.ErrorMessage),
+	}}
+}
@@ -0,0 +1,79 @@
+/*
+ * Copyright (c) 2022 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package config
+
+import "sync"
+
+// ControllerConfigChange是Watcher每次成功reload后、只要有字段发生变化（不管能不能热应用）
+// 就会向Bus发布的事件。Changed和RestartRequired是不相交的两组字段（各用yaml tag标识）：
+// Changed是被原地写回、已经生效的字段，RestartRequired是被标记了reload:"restart"、因此没有
+// 被应用、只是被记录下来提醒operator的字段
+type ControllerConfigChange struct {
+	Old             *ControllerConfig
+	New             *ControllerConfig
+	Changed         []string
+	RestartRequired []string
+}
+
+// Bus把配置变化事件广播给关心的订阅者（Trisolaris、cloud gather task等），订阅者各自用
+// 一个有缓冲channel接收，channel满时丢弃这次新发布的事件，已经排队的旧事件保留——这一点和
+// KubernetesGatherTask.EventCh（丢弃旧事件、保留最新一条）不同
+type Bus struct {
+	mutex       sync.Mutex
+	subscribers []chan ControllerConfigChange
+}
+
+func NewBus() *Bus {
+	return &Bus{}
+}
+
+// GlobalBus是进程内唯一的配置变化总线，Watcher向它发布，各subsystem在自己的初始化代码里订阅
+var GlobalBus = NewBus()
+
+// Subscribe返回一个只读channel，每次配置成功reload后都会收到一条ControllerConfigChange
+func (b *Bus) Subscribe(bufSize int) <-chan ControllerConfigChange {
+	if bufSize <= 0 {
+		bufSize = 1
+	}
+	ch := make(chan ControllerConfigChange, bufSize)
+	b.mutex.Lock()
+	b.subscribers = append(b.subscribers, ch)
+	b.mutex.Unlock()
+	return ch
+}
+
+func (b *Bus) Publish(change ControllerConfigChange) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for _, ch := range b.subscribers {
+		select {
+		case ch <- change:
+		default:
+			log.Warning("config bus subscriber is falling behind, dropping a config change event")
+		}
+	}
+}
+
+// Contains是个小helper，订阅者常常只关心Changed里是否包含自己关心的某个yaml tag
+func (c *ControllerConfigChange) Contains(yamlTag string) bool {
+	for _, name := range c.Changed {
+		if name == yamlTag {
+			return true
+		}
+	}
+	return false
+}
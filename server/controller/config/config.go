@@ -17,6 +17,7 @@
 package config
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
 
@@ -56,22 +57,34 @@ type DFWebService struct {
 	Timeout int    `default:"30" yaml:"timeout"`
 }
 
+// ControllerConfig里大部分字段可以在进程运行期间被Watcher热更新，少数字段（监听端口、
+// 数据库连接信息）改了也无法在不重启的情况下生效，这些字段额外打上reload:"restart"标签，
+// Watcher发现它们变化时只会打一条warning提醒operator重启，而不会尝试应用
 type ControllerConfig struct {
 	LogFile              string `default:"/var/log/controller.log" yaml:"log-file"`
 	LogLevel             string `default:"info" yaml:"log-level"`
-	ListenPort           int    `default:"20417" yaml:"listen-port"`
+	ListenPort           int    `default:"20417" yaml:"listen-port" reload:"restart"`
 	MasterControllerName string `default:"" yaml:"master-controller-name"`
 	GrpcMaxMessageLength int    `default:"104857600" yaml:"grpc-max-message-length"`
-	GrpcPort             string `default:"20035" yaml:"grpc-port"`
+	GrpcPort             string `default:"20035" yaml:"grpc-port" reload:"restart"`
 	Kubeconfig           string `yaml:"kubeconfig"`
-	ElectionName         string `default:"deepflow-server" yaml:"election-name"`
-	ElectionNamespace    string `default:"deepflow" yaml:"election-namespace"`
+	ElectionName         string `default:"deepflow-server" yaml:"election-name" reload:"restart"`
+	ElectionNamespace    string `default:"deepflow" yaml:"election-namespace" reload:"restart"`
+	// ElectionBackend选哪种锁实现来做controller HA选举："kubernetes"（默认，LeaseLock）、
+	// "etcd"（lease+campaign）、"redis"（SET NX PX+fencing token）。VM/裸机部署没有K8s API
+	// 时用etcd或redis，两者都需要额外的Etcd/RedisCfg连接信息
+	ElectionBackend      string   `default:"kubernetes" yaml:"election-backend" reload:"restart"`
+	EtcdEndpoints        []string `yaml:"etcd-endpoints" reload:"restart"`
+	LeaseDuration        int      `default:"15" yaml:"lease-duration"`
+	RenewDeadline        int      `default:"10" yaml:"renew-deadline"`
+	RetryPeriod          int      `default:"2" yaml:"retry-period"`
 
 	DFWebService DFWebService `yaml:"df-web-service"`
 
-	MySqlCfg      mysql.MySqlConfig           `yaml:"mysql"`
-	RedisCfg      redis.RedisConfig           `yaml:"redis"`
-	ClickHouseCfg clickhouse.ClickHouseConfig `yaml:"clickhouse"`
+	MySqlCfg mysql.MySqlConfig `yaml:"mysql" reload:"restart"`
+	// RedisCfg在ElectionBackend为"redis"时兼作选举后端的连接信息，不需要单独的election-redis配置块
+	RedisCfg      redis.RedisConfig           `yaml:"redis" reload:"restart"`
+	ClickHouseCfg clickhouse.ClickHouseConfig `yaml:"clickhouse" reload:"restart"`
 
 	Roze Roze          `yaml:"roze"`
 	Spec Specification `yaml:"spec"`
@@ -93,22 +106,29 @@ func (c *Config) Validate() error {
 }
 
 func (c *Config) Load(path string) {
+	if err := c.load(path); err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+}
+
+// load是Load去掉os.Exit(1)之后的版本，Watcher在热重载时复用它：一次reload解析失败不应该
+// 像启动时读到坏配置那样直接杀掉进程，而是保留上一份配置继续运行
+func (c *Config) load(path string) error {
 	configBytes, err := ioutil.ReadFile(path)
 	if err != nil {
-		log.Error("Read config file error:", err, path)
-		os.Exit(1)
+		return fmt.Errorf("read config file error: %s, %s", err, path)
 	}
 
-	if err = yaml.Unmarshal(configBytes, &c); err != nil {
-		log.Error("Unmarshal yaml error:", err)
-		os.Exit(1)
+	if err = yaml.Unmarshal(configBytes, c); err != nil {
+		return fmt.Errorf("unmarshal yaml error: %s", err)
 	}
 
 	if err = c.Validate(); err != nil {
-		log.Error(err)
-		os.Exit(1)
+		return err
 	}
 	c.ControllerConfig.TrisolarisCfg.LogLevel = c.ControllerConfig.LogLevel
+	return nil
 }
 
 func DefaultConfig() *Config {
@@ -0,0 +1,160 @@
+/*
+ * Copyright (c) 2022 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package config
+
+import (
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+
+	"github.com/fsnotify/fsnotify"
+	logging "github.com/op/go-logging"
+)
+
+const reloadTagRestart = "restart"
+
+// Watcher监视controller的yaml配置文件（fsnotify）以及SIGHUP信号，任意一种触发都会重新解析
+// 文件、和当前生效的ControllerConfig逐字段diff，把可以热更新的字段原地写回（保持
+// TrisolarisCfg/TagRecorderCfg等嵌套struct的内存地址不变，这样已经拿到那些struct指针的
+// subsystem不需要重新获取就能看到新值），并把整次变化发布到GlobalBus
+type Watcher struct {
+	path string
+	cfg  *Config
+}
+
+func NewWatcher(path string, cfg *Config) *Watcher {
+	return &Watcher{path: path, cfg: cfg}
+}
+
+func (w *Watcher) Start() {
+	go w.watchSignal()
+	go w.watchFile()
+}
+
+func (w *Watcher) watchSignal() {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP)
+	for range sigCh {
+		log.Info("config watcher: received SIGHUP, reloading")
+		w.reload()
+	}
+}
+
+func (w *Watcher) watchFile() {
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Errorf("config watcher: create fsnotify watcher failed: %s", err)
+		return
+	}
+	defer fsw.Close()
+	if err := fsw.Add(w.path); err != nil {
+		log.Errorf("config watcher: watch %s failed: %s", w.path, err)
+		return
+	}
+	for {
+		select {
+		case event, ok := <-fsw.Events:
+			if !ok {
+				return
+			}
+			// 一些编辑器保存文件时会先rename再create一份新文件，这里把Write/Create/Rename都当成变化处理
+			if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) != 0 {
+				log.Infof("config watcher: detected change on %s", w.path)
+				w.reload()
+			}
+		case err, ok := <-fsw.Errors:
+			if !ok {
+				return
+			}
+			log.Errorf("config watcher: %s", err)
+		}
+	}
+}
+
+func (w *Watcher) reload() {
+	newCfg := &Config{}
+	if err := newCfg.load(w.path); err != nil {
+		log.Errorf("config watcher: reload %s failed, keeping previous config: %s", w.path, err)
+		return
+	}
+
+	old := &w.cfg.ControllerConfig
+	change := diffControllerConfig(old, &newCfg.ControllerConfig)
+	if len(change.RestartRequired) > 0 {
+		log.Warningf("config watcher: fields %v changed but require a process restart to take effect, ignoring for now", change.RestartRequired)
+	}
+	if len(change.Changed) == 0 && len(change.RestartRequired) == 0 {
+		log.Info("config watcher: reload found no change")
+		return
+	}
+
+	if len(change.Changed) > 0 {
+		applyLogLevel(newCfg.ControllerConfig.LogLevel)
+		log.Infof("config watcher: applied changed fields %v", change.Changed)
+	}
+	// RestartRequired-only变化也要publish：订阅者（比如想在日志里提醒operator、或者汇总展示
+	// 给前端）关心的是"配置文件变了"这件事本身，不是只关心能被热应用的那部分
+	GlobalBus.Publish(change)
+}
+
+// diffControllerConfig逐个顶层字段比较old/new，对没有reload:"restart"标签的字段直接把
+// new的值写回old（原地修改，不替换old本身），同时记录哪些字段变化了、哪些因为被标记为
+// restart-only而被跳过
+func diffControllerConfig(old, new *ControllerConfig) ControllerConfigChange {
+	change := ControllerConfigChange{Old: old, New: new}
+
+	oldVal := reflect.ValueOf(old).Elem()
+	newVal := reflect.ValueOf(new).Elem()
+	t := oldVal.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		yamlTag := field.Tag.Get("yaml")
+		if yamlTag == "" {
+			yamlTag = field.Name
+		}
+
+		oldField := oldVal.Field(i)
+		newField := newVal.Field(i)
+		if reflect.DeepEqual(oldField.Interface(), newField.Interface()) {
+			continue
+		}
+
+		if field.Tag.Get("reload") == reloadTagRestart {
+			change.RestartRequired = append(change.RestartRequired, yamlTag)
+			continue
+		}
+
+		oldField.Set(newField)
+		change.Changed = append(change.Changed, yamlTag)
+	}
+	return change
+}
+
+// applyLogLevel把新的日志级别实时应用到go-logging，不需要重启进程
+func applyLogLevel(level string) {
+	if level == "" {
+		return
+	}
+	parsed, err := logging.LogLevel(level)
+	if err != nil {
+		log.Warningf("config watcher: invalid log-level %q: %s", level, err)
+		return
+	}
+	logging.SetLevel(parsed, "")
+}
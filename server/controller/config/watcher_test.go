@@ -0,0 +1,197 @@
+/*
+ * Copyright (c) 2022 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const baseTestYAML = `
+controller:
+  log-level: info
+  listen-port: 20417
+  spec:
+    vtap_group_max: 1000
+`
+
+func writeTestConfig(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("write %s failed: %s", path, err)
+	}
+}
+
+// TestWatcherReloadAppliesHotReloadableField验证reload()解析新YAML后，把一个没有
+// reload:"restart"标签的字段（spec.vtap_group_max）原地写回cfg，并通过GlobalBus把变化
+// 广播出去，让已经订阅的subsystem能观察到新值
+func TestWatcherReloadAppliesHotReloadableField(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "server.yaml")
+	writeTestConfig(t, path, baseTestYAML)
+
+	cfg := &Config{}
+	if err := cfg.load(path); err != nil {
+		t.Fatalf("initial load failed: %s", err)
+	}
+	if cfg.ControllerConfig.Spec.VTapGroupMax != 1000 {
+		t.Fatalf("initial vtap_group_max = %d, want 1000", cfg.ControllerConfig.Spec.VTapGroupMax)
+	}
+
+	sub := GlobalBus.Subscribe(1)
+
+	writeTestConfig(t, path, `
+controller:
+  log-level: info
+  listen-port: 20417
+  spec:
+    vtap_group_max: 2000
+`)
+
+	w := NewWatcher(path, cfg)
+	w.reload()
+
+	if cfg.ControllerConfig.Spec.VTapGroupMax != 2000 {
+		t.Fatalf("after reload vtap_group_max = %d, want 2000 (subsystems holding a *Specification pointer should observe this)", cfg.ControllerConfig.Spec.VTapGroupMax)
+	}
+
+	select {
+	case change := <-sub:
+		if !change.Contains("spec") {
+			t.Fatalf("published change.Changed = %v, want it to contain \"spec\"", change.Changed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for GlobalBus to publish the config change")
+	}
+}
+
+// TestWatcherReloadSkipsRestartOnlyField验证打了reload:"restart"标签的字段（listen-port）
+// 即使在新YAML里变了，也不会被reload()原地写回，只会出现在RestartRequired里
+func TestWatcherReloadSkipsRestartOnlyField(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "server.yaml")
+	writeTestConfig(t, path, baseTestYAML)
+
+	cfg := &Config{}
+	if err := cfg.load(path); err != nil {
+		t.Fatalf("initial load failed: %s", err)
+	}
+
+	sub := GlobalBus.Subscribe(1)
+
+	writeTestConfig(t, path, `
+controller:
+  log-level: info
+  listen-port: 30417
+  spec:
+    vtap_group_max: 1000
+`)
+
+	w := NewWatcher(path, cfg)
+	w.reload()
+
+	if cfg.ControllerConfig.ListenPort != 20417 {
+		t.Fatalf("listen-port = %d, want it to stay 20417 (reload:\"restart\" fields must not be hot-applied)", cfg.ControllerConfig.ListenPort)
+	}
+
+	select {
+	case change := <-sub:
+		found := false
+		for _, f := range change.RestartRequired {
+			if f == "listen-port" {
+				found = true
+			}
+		}
+		if !found {
+			t.Fatalf("RestartRequired = %v, want it to contain \"listen-port\"", change.RestartRequired)
+		}
+		if change.Contains("listen-port") {
+			t.Fatal("listen-port should not also appear in Changed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for GlobalBus to publish the config change")
+	}
+}
+
+// TestWatcherReloadKeepsPreviousConfigOnParseError验证reload()读到一份解析失败的YAML时
+// 保留上一份配置，不会把cfg改坏、也不会向GlobalBus发布变化
+func TestWatcherReloadKeepsPreviousConfigOnParseError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "server.yaml")
+	writeTestConfig(t, path, baseTestYAML)
+
+	cfg := &Config{}
+	if err := cfg.load(path); err != nil {
+		t.Fatalf("initial load failed: %s", err)
+	}
+
+	sub := GlobalBus.Subscribe(1)
+
+	writeTestConfig(t, path, "controller: [this is not valid yaml for a mapping")
+
+	w := NewWatcher(path, cfg)
+	w.reload()
+
+	if cfg.ControllerConfig.Spec.VTapGroupMax != 1000 {
+		t.Fatalf("vtap_group_max = %d, want the previous value 1000 to be kept after a failed reload", cfg.ControllerConfig.Spec.VTapGroupMax)
+	}
+
+	select {
+	case change := <-sub:
+		t.Fatalf("did not expect a published change after a failed reload, got %+v", change)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// TestWatcherWatchFileDetectsWrite是对watchFile()本身（真实fsnotify路径）的一次轻量集成测试：
+// 起一个Watcher、改写磁盘上的YAML，轮询等待subsystem（这里用GlobalBus的订阅者代替）观察到新值
+func TestWatcherWatchFileDetectsWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "server.yaml")
+	writeTestConfig(t, path, baseTestYAML)
+
+	cfg := &Config{}
+	if err := cfg.load(path); err != nil {
+		t.Fatalf("initial load failed: %s", err)
+	}
+
+	sub := GlobalBus.Subscribe(1)
+
+	w := NewWatcher(path, cfg)
+	go w.watchFile()
+	// watchFile()跑在单独的goroutine里，监听器还没挂上前的写入可能会被错过，给一点时间让
+	// watchFile()里的fsw.Add(w.path)先完成
+	time.Sleep(50 * time.Millisecond)
+
+	writeTestConfig(t, path, `
+controller:
+  log-level: info
+  listen-port: 20417
+  spec:
+    vtap_group_max: 3000
+`)
+
+	deadline := time.After(3 * time.Second)
+	for {
+		select {
+		case <-sub:
+			if cfg.ControllerConfig.Spec.VTapGroupMax == 3000 {
+				return
+			}
+		case <-deadline:
+			t.Fatalf("timed out waiting for watchFile() to pick up the on-disk change, vtap_group_max = %d", cfg.ControllerConfig.Spec.VTapGroupMax)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+/*
+ * Copyright (c) 2022 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package election
+
+import (
+	"context"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Callbacks是一个subsystem挂靠到leader election生命周期上的钩子集合。OnAcquired在本进程当选
+// 期间只会被调用一次，传入的ctx在失去leader身份时会被cancel——subsystem应该用它来控制自己内部
+// 的goroutine/timer，而不是自建一套IsLeader()轮询（参考早先trisolaris.watchLeadership那种写法，
+// 缺点就是降级之后已经跑起来的协程没有办法喊停）。OnLost在对应的ctx被cancel之后调用，用来做一次
+// 同步的收尾（比如等底下的goroutine真正退出）。OnObservedLeader在任何副本（包括自己）的身份变化
+// 时都会被调用，哪怕本进程从来没有当过leader也能拿到"谁是leader"这个信息
+type Callbacks interface {
+	OnAcquired(ctx context.Context)
+	OnLost()
+	OnObservedLeader(id string)
+}
+
+var (
+	callbacksMu     sync.Mutex
+	callbacksByName = make(map[string]Callbacks)
+
+	// 每个已注册回调当前这一轮OnAcquired对应的cancel函数；supervisor在失去leader身份时用它
+	// 把对应ctx cancel掉，而不需要为每个subsystem单独起一个监听goroutine
+	cancelByName = make(map[string]context.CancelFunc)
+
+	electionTransitionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "deepflow_controller_election_transitions_total",
+		Help: "Leader election state transitions observed by this controller process, labeled by transition kind.",
+	}, []string{"transition"})
+)
+
+func init() {
+	prometheus.MustRegister(electionTransitionsTotal)
+}
+
+// 这个快照里recorder包和datasource manager都没有收录进来，没法把它们的"仅leader执行"逻辑转接到
+// 这套API上；已经转接的是trisolaris的定时刷新协程和trisolaris/kubernetes.CacheClusterID的自动
+// 建域重试协程（参见各自的OnAcquired/OnLost实现），等另外两个包的源码补上之后按同样的模式接入即可
+
+// RegisterCallbacks把一个subsystem的Callbacks挂到leader election上；name只用于日志和去重，
+// 重复调用会覆盖同名的旧注册。如果调用时本进程已经是leader，会立刻补跑一次OnAcquired，让后注册的
+// subsystem不用等下一轮选举
+func RegisterCallbacks(name string, cb Callbacks) {
+	callbacksMu.Lock()
+	callbacksByName[name] = cb
+	alreadyLeading := IsLeader()
+	var ctx context.Context
+	if alreadyLeading {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(context.Background())
+		cancelByName[name] = cancel
+	}
+	callbacksMu.Unlock()
+
+	if alreadyLeading {
+		go cb.OnAcquired(ctx)
+	}
+}
+
+// notifyAcquired给每个已注册的subsystem起一个可取消的ctx并调用OnAcquired，在独立的goroutine里跑，
+// 避免某个subsystem的OnAcquired阻塞导致其它subsystem、乃至下一轮选举事件处理被卡住
+func notifyAcquired() {
+	electionTransitionsTotal.WithLabelValues("acquired").Inc()
+	callbacksMu.Lock()
+	defer callbacksMu.Unlock()
+	for name, cb := range callbacksByName {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancelByName[name] = cancel
+		go cb.OnAcquired(ctx)
+	}
+}
+
+// notifyLost取消每个subsystem的ctx并同步调用OnLost；和notifyAcquired不同，这里不并发调用——
+// OnLost通常是等底下协程退出这类收尾操作，调用方（runElectionLoop/startKubernetes的
+// OnStoppedLeading）本来就是在单独的goroutine里触发的，不需要再额外并发
+func notifyLost() {
+	electionTransitionsTotal.WithLabelValues("lost").Inc()
+	callbacksMu.Lock()
+	defer callbacksMu.Unlock()
+	for name, cancel := range cancelByName {
+		cancel()
+		delete(cancelByName, name)
+	}
+	for _, cb := range callbacksByName {
+		cb.OnLost()
+	}
+}
+
+// notifyObservedLeader广播给所有已注册的subsystem，不区分本进程是不是这次的leader
+func notifyObservedLeader(id string) {
+	electionTransitionsTotal.WithLabelValues("observed").Inc()
+	callbacksMu.Lock()
+	defer callbacksMu.Unlock()
+	for _, cb := range callbacksByName {
+		cb.OnObservedLeader(id)
+	}
+}
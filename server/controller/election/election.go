@@ -20,7 +20,9 @@ package election
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"net/http"
 	"os"
 	"sync"
 	"time"
@@ -35,20 +37,31 @@ import (
 
 	"github.com/deepflowys/deepflow/server/controller/common"
 	"github.com/deepflowys/deepflow/server/controller/config"
+	"github.com/deepflowys/deepflow/server/controller/events"
 )
 
 const (
 	ID_ITEM_NUM = 4
+
+	ElectionBackendKubernetes = "kubernetes"
+	ElectionBackendEtcd       = "etcd"
+	ElectionBackendRedis      = "redis"
 )
 
+// LeaderData里的FencingToken是当前leader这一轮当选的单调递增编号：k8s LeaseLock靠
+// resourceVersion自带互斥，不需要它（固定为0）；etcd/redis后端把它暴露出来，让下游写操作
+// 带上这个token去guard，防止一个其实已经失去leader身份、只是还没反应过来的旧leader把过期的
+// 写操作发出去（split-brain场景下的经典fencing token用法）
 type LeaderData struct {
 	sync.RWMutex
-	Name string
+	Name         string
+	FencingToken uint64
 }
 
-func (l *LeaderData) SetLeader(name string) {
+func (l *LeaderData) SetLeader(name string, token uint64) {
 	l.Lock()
 	l.Name = name
+	l.FencingToken = token
 	l.Unlock()
 }
 
@@ -59,8 +72,38 @@ func (l *LeaderData) GetLeader() string {
 	return name
 }
 
+func (l *LeaderData) GetFencingToken() uint64 {
+	l.RLock()
+	token := l.FencingToken
+	l.RUnlock()
+	return token
+}
+
 var log = logging.MustGetLogger("election")
 var leaderData = &LeaderData{}
+var selfID string
+
+// GetLeader当前返回值与self id相同即表示本controller是leader
+func IsLeader() bool {
+	return selfID != "" && leaderData.GetLeader() == selfID
+}
+
+// GetFencingToken给下游写操作guard用，配合IsLeader()一起读：IsLeader()为true期间这个token
+// 在本进程整个leader任期内不变，一旦发生re-election（哪怕是本进程重新抢回leader）就会变大
+func GetFencingToken() uint64 {
+	return leaderData.GetFencingToken()
+}
+
+// HealthLeaderHandler供/health/leader接口使用，返回当前leader身份及本节点是否为leader
+func HealthLeaderHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"leader":        GetLeader(),
+		"self":          selfID,
+		"is_leader":     IsLeader(),
+		"fencing_token": GetFencingToken(),
+	})
+}
 
 func buildConfig(kubeconfig string) (*rest.Config, error) {
 	if kubeconfig != "" {
@@ -90,28 +133,63 @@ func GetLeader() string {
 	return leaderData.GetLeader()
 }
 
+// LeaderCallbacks和client-go的leaderelection.LeaderCallbacks是同一种形状，三套后端（k8s走
+// client-go自己的RunOrDie，etcd/redis走下面的runElectionLoop）共用同一组回调约定，通过
+// RegisterCallbacks挂上来的subsystem不需要关心具体是哪种后端在跑
+type LeaderCallbacks struct {
+	OnStartedLeading func(ctx context.Context)
+	OnStoppedLeading func()
+	OnNewLeader      func(identity string)
+}
+
+// LockProvider是一种选举后端的抽象，etcd/redis各实现一份就能接入runElectionLoop这套通用的
+// 重试/续约/通知逻辑。K8s后端没有实现这个接口——client-go的leaderelection.RunOrDie内部已经是
+// 一整套更完整的acquire/renew/release循环，再包一层LockProvider等于让两套定时循环互相嵌套，
+// 没有好处，所以k8s继续走Start()里单独的分支
+type LockProvider interface {
+	// Acquire尝试拿一次锁，拿到返回true和这次当选的fencing token；没拿到返回false、token为0
+	Acquire(ctx context.Context) (acquired bool, token uint64, err error)
+	// Renew在已经持有锁的前提下续约，返回值语义和Acquire一样；身份被别的副本抢走或者ctx取消
+	// 导致的session失效都应该返回false而不是error，error只用来表示真正的通信/存储层故障
+	Renew(ctx context.Context) (renewed bool, token uint64, err error)
+	// Release主动放弃锁，用于进程优雅退出时缩短下一个leader的接管等待，不强制要求当前就是leader
+	Release(ctx context.Context) error
+	// Observe把当前观测到的leader身份和fencing token持续推给onLeaderChanged，直到ctx被取消；
+	// 这样跟随者也能知道谁是leader、而不只有candidate自己在竞选的时候才知道
+	Observe(ctx context.Context, onLeaderChanged func(identity string, token uint64))
+}
+
 func Start(ctx context.Context, cfg *config.ControllerConfig) {
-	kubeconfig := cfg.Kubeconfig
-	electionName := cfg.ElectionName
-	electionNamespace := cfg.ElectionNamespace
 	id := getID()
-	log.Infof("election id is %s", id)
-	// leader election uses the Kubernetes API by writing to a
-	// lock object, which can be a LeaseLock object (preferred),
-	// a ConfigMap, or an Endpoints (deprecated) object.
-	// Conflicting writes are detected and each client handles those actions
-	// independently.
-	config, err := buildConfig(kubeconfig)
+	selfID = id
+	log.Infof("election id is %s, backend is %s", id, cfg.ElectionBackend)
+
+	switch cfg.ElectionBackend {
+	case ElectionBackendEtcd:
+		runElectionLoop(ctx, id, newEtcdLockProvider(cfg, id), cfg)
+	case ElectionBackendRedis:
+		runElectionLoop(ctx, id, newRedisLockProvider(cfg, id), cfg)
+	default:
+		startKubernetes(ctx, id, cfg)
+	}
+}
+
+// startKubernetes是原来的实现：leader election uses the Kubernetes API by writing to a
+// lock object, which can be a LeaseLock object (preferred), a ConfigMap, or an Endpoints
+// (deprecated) object. Conflicting writes are detected and each client handles those actions
+// independently.
+func startKubernetes(ctx context.Context, id string, cfg *config.ControllerConfig) {
+	restConfig, err := buildConfig(cfg.Kubeconfig)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	client := clientset.NewForConfigOrDie(config)
+	client := clientset.NewForConfigOrDie(restConfig)
 
 	lock := &resourcelock.LeaseLock{
 		LeaseMeta: metav1.ObjectMeta{
-			Name:      electionName,
-			Namespace: electionNamespace,
+			Name:      cfg.ElectionName,
+			Namespace: cfg.ElectionNamespace,
 		},
 		Client: client.CoordinationV1(),
 		LockConfig: resourcelock.ResourceLockConfig{
@@ -129,26 +207,135 @@ func Start(ctx context.Context, cfg *config.ControllerConfig) {
 		// get elected before your background loop finished, violating
 		// the stated goal of the lease.
 		ReleaseOnCancel: true,
-		LeaseDuration:   60 * time.Second,
-		RenewDeadline:   15 * time.Second,
-		RetryPeriod:     5 * time.Second,
+		LeaseDuration:   time.Duration(cfg.LeaseDuration) * time.Second,
+		RenewDeadline:   time.Duration(cfg.RenewDeadline) * time.Second,
+		RetryPeriod:     time.Duration(cfg.RetryPeriod) * time.Second,
 		Callbacks: leaderelection.LeaderCallbacks{
 			OnStartedLeading: func(ctx context.Context) {
 				// we're notified when we start - this is where you would
 				// usually put your code
 				log.Infof("%s is the leader", id)
-				leaderData.SetLeader(id)
+				leaderData.SetLeader(id, 0)
+				notifyAcquired()
+				events.Publish(events.LeaderChanged, map[string]interface{}{
+					"self_id": id, "leader_id": id, "acquired": true, "backend": "kubernetes",
+				})
 			},
 			OnStoppedLeading: func() {
-				// we can do cleanup here
+				// leader election给的ctx已经被client-go cancel掉了，这里只需要让registered
+				// 的subsystem跟着收拾，不再像以前那样os.Exit(0)把整个controller进程杀掉——
+				// 那样会连带打断本进程里和leader身份无关的gRPC连接（比如agent的Sync/Push）
 				log.Infof("leader lost: %s", id)
-				os.Exit(0)
+				notifyLost()
+				events.Publish(events.LeaderChanged, map[string]interface{}{
+					"self_id": id, "acquired": false, "backend": "kubernetes",
+				})
 			},
 			OnNewLeader: func(identity string) {
-				leaderData.SetLeader(identity)
+				leaderData.SetLeader(identity, 0)
 				// we're notified when new leader elected
 				log.Infof("new leader elected: %s", identity)
+				notifyObservedLeader(identity)
+				events.Publish(events.LeaderChanged, map[string]interface{}{
+					"self_id": id, "leader_id": identity, "acquired": identity == id, "backend": "kubernetes",
+				})
 			},
 		},
 	})
 }
+
+// runElectionLoop是etcd/redis两种LockProvider共用的选举循环：按RetryPeriod反复尝试Acquire，
+// 拿到后转入holdLease按LeaseDuration/2的节奏Renew，Renew失败或者ctx取消就认为失去leader身份。
+// 同时起一个goroutine跑Observe，让跟随者也能实时知道当前leader是谁
+func runElectionLoop(ctx context.Context, id string, provider LockProvider, cfg *config.ControllerConfig) {
+	var currentToken uint64
+	callbacks := LeaderCallbacks{
+		OnStartedLeading: func(ctx context.Context) {
+			log.Infof("%s is the leader", id)
+			notifyAcquired()
+			events.Publish(events.LeaderChanged, map[string]interface{}{
+				"self_id": id, "leader_id": id, "acquired": true, "fencing_token": currentToken, "backend": "lock-provider",
+			})
+		},
+		OnStoppedLeading: func() {
+			log.Infof("leader lost: %s", id)
+			notifyLost()
+			events.Publish(events.LeaderChanged, map[string]interface{}{
+				"self_id": id, "acquired": false, "fencing_token": currentToken, "backend": "lock-provider",
+			})
+		},
+		OnNewLeader: func(identity string) {
+			log.Infof("new leader elected: %s", identity)
+			notifyObservedLeader(identity)
+			events.Publish(events.LeaderChanged, map[string]interface{}{
+				"self_id": id, "leader_id": identity, "acquired": identity == id, "backend": "lock-provider",
+			})
+		},
+	}
+
+	go provider.Observe(ctx, func(identity string, token uint64) {
+		leaderData.SetLeader(identity, token)
+		if callbacks.OnNewLeader != nil {
+			callbacks.OnNewLeader(identity)
+		}
+	})
+
+	retryPeriod := time.Duration(cfg.RetryPeriod) * time.Second
+	leaseDuration := time.Duration(cfg.LeaseDuration) * time.Second
+
+	ticker := time.NewTicker(retryPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			provider.Release(context.Background())
+			return
+		case <-ticker.C:
+			acquired, token, err := provider.Acquire(ctx)
+			if err != nil {
+				log.Warningf("election: acquire failed: %s", err)
+				continue
+			}
+			if !acquired {
+				continue
+			}
+			leaderData.SetLeader(id, token)
+			currentToken = token
+			leadingCtx, cancelLeading := context.WithCancel(ctx)
+			if callbacks.OnStartedLeading != nil {
+				go callbacks.OnStartedLeading(leadingCtx)
+			}
+			holdLease(ctx, provider, id, leaseDuration)
+			cancelLeading()
+			if callbacks.OnStoppedLeading != nil {
+				callbacks.OnStoppedLeading()
+			}
+		}
+	}
+}
+
+// holdLease持有锁期间阻塞，每隔leaseDuration/2续一次租，续租失败、被拒绝或者ctx被取消都会返回
+func holdLease(ctx context.Context, provider LockProvider, id string, leaseDuration time.Duration) {
+	renewInterval := leaseDuration / 2
+	if renewInterval <= 0 {
+		renewInterval = time.Second
+	}
+	ticker := time.NewTicker(renewInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			renewed, token, err := provider.Renew(ctx)
+			if err != nil {
+				log.Warningf("election: renew failed: %s", err)
+				return
+			}
+			if !renewed {
+				return
+			}
+			leaderData.SetLeader(id, token)
+		}
+	}
+}
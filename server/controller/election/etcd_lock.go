@@ -0,0 +1,179 @@
+/*
+ * Copyright (c) 2022 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package election
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/concurrency"
+
+	"github.com/deepflowys/deepflow/server/controller/config"
+)
+
+// etcdLockProvider基于etcd的concurrency.Election实现LockProvider：concurrency.Session内部
+// 自带一个lease，Campaign()/Resign()都是阻塞调用，和我们这套Acquire/Renew的非阻塞轮询形状不完全
+// 一样，所以这里用一个单独的goroutine跑Campaign()，Acquire只是去看这个goroutine有没有
+// 把campaignDone关上
+type etcdLockProvider struct {
+	client    *clientv3.Client
+	electName string
+	id        string
+
+	leaseDuration time.Duration
+
+	mu           sync.Mutex
+	session      *concurrency.Session
+	election     *concurrency.Election
+	campaignDone chan struct{}
+	campaigning  bool
+}
+
+func newEtcdLockProvider(cfg *config.ControllerConfig, id string) *etcdLockProvider {
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   cfg.EtcdEndpoints,
+		DialTimeout: 5 * time.Second,
+	})
+	if err != nil {
+		// 和startKubernetes里buildConfig失败时的处理保持一致：连接信息是进程启动就决定好的，
+		// 连不上直接退出让orchestration层重启，而不是带着一个半残的provider继续跑
+		log.Fatal(err)
+	}
+	return &etcdLockProvider{
+		client:        client,
+		electName:     "/deepflow/election/" + cfg.ElectionName,
+		id:            id,
+		leaseDuration: time.Duration(cfg.LeaseDuration) * time.Second,
+	}
+}
+
+// Acquire起一个session(TTL取LeaseDuration)，在后台goroutine里跑一次性的Campaign()；Campaign
+// 本身是阻塞的，这里不等它返回，而是轮询campaignDone——如果调用这个方法时已经有一轮Campaign在跑
+// 且还没拿到，直接返回false，等下一个RetryPeriod再看
+func (p *etcdLockProvider) Acquire(ctx context.Context) (bool, uint64, error) {
+	p.mu.Lock()
+	if p.campaigning {
+		select {
+		case <-p.campaignDone:
+			p.campaigning = false
+			p.mu.Unlock()
+			// 上一轮在后台跑完的Campaign如果已经当选，直接沿用它的结果，不再另起一轮
+			if renewed, token, err := p.Renew(ctx); err == nil && renewed {
+				return true, token, nil
+			}
+			p.mu.Lock()
+		default:
+			p.mu.Unlock()
+			return false, 0, nil
+		}
+	}
+	p.mu.Unlock()
+
+	session, err := concurrency.NewSession(p.client, concurrency.WithTTL(int(p.leaseDuration.Seconds())))
+	if err != nil {
+		return false, 0, err
+	}
+	election := concurrency.NewElection(session, p.electName)
+
+	p.mu.Lock()
+	p.session = session
+	p.election = election
+	p.campaigning = true
+	p.campaignDone = make(chan struct{})
+	done := p.campaignDone
+	p.mu.Unlock()
+
+	campaignErr := make(chan error, 1)
+	go func() {
+		campaignErr <- election.Campaign(ctx, p.id)
+		close(done)
+	}()
+
+	select {
+	case err := <-campaignErr:
+		p.mu.Lock()
+		p.campaigning = false
+		p.mu.Unlock()
+		if err != nil {
+			return false, 0, err
+		}
+		return true, uint64(election.Rev()), nil
+	case <-time.After(100 * time.Millisecond):
+		// Campaign还没返回，本轮先当作没抢到，留着后台goroutine继续跑，下次Acquire会
+		// 看到campaignDone已经关闭，并确认这一轮Campaign是否已经当选
+		return false, 0, nil
+	}
+}
+
+// Renew对etcd backend来说就是确认session还活着、并且自己仍然是当前campaign的当选者；
+// session的keepalive由concurrency.Session内部协程自动做，这里不需要显式续租
+func (p *etcdLockProvider) Renew(ctx context.Context) (bool, uint64, error) {
+	p.mu.Lock()
+	session, election := p.session, p.election
+	p.mu.Unlock()
+	if session == nil || election == nil {
+		return false, 0, nil
+	}
+	select {
+	case <-session.Done():
+		return false, 0, nil
+	default:
+	}
+	resp, err := election.Leader(ctx)
+	if err != nil {
+		return false, 0, nil
+	}
+	if len(resp.Kvs) == 0 || string(resp.Kvs[0].Value) != p.id {
+		return false, 0, nil
+	}
+	return true, uint64(election.Rev()), nil
+}
+
+func (p *etcdLockProvider) Release(ctx context.Context) error {
+	p.mu.Lock()
+	session, election := p.session, p.election
+	p.mu.Unlock()
+	if election == nil {
+		return nil
+	}
+	if err := election.Resign(ctx); err != nil {
+		return err
+	}
+	if session != nil {
+		return session.Close()
+	}
+	return nil
+}
+
+// Observe用election.Observe持续watch当前leader，etcd原生支持watch，不需要像redis那样轮询
+func (p *etcdLockProvider) Observe(ctx context.Context, onLeaderChanged func(identity string, token uint64)) {
+	session, err := concurrency.NewSession(p.client, concurrency.WithTTL(int(p.leaseDuration.Seconds())))
+	if err != nil {
+		log.Warningf("election: etcd observe session failed: %s", err)
+		return
+	}
+	defer session.Close()
+	election := concurrency.NewElection(session, p.electName)
+	for resp := range election.Observe(ctx) {
+		if len(resp.Kvs) == 0 {
+			continue
+		}
+		onLeaderChanged(string(resp.Kvs[0].Value), uint64(resp.Kvs[0].ModRevision))
+	}
+}
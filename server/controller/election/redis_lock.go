@@ -0,0 +1,165 @@
+/*
+ * Copyright (c) 2022 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package election
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	goredis "github.com/go-redis/redis/v8"
+
+	"github.com/deepflowys/deepflow/server/controller/config"
+)
+
+// redisLockProvider用"SET NX PX"实现LockProvider，和tagrecorder/leader.go里的redisLeaderElector
+// 是同一套手法，这里多做一件事：把一个单调递增的fencing token编进锁的value里（"<id>:<token>"），
+// 供上层runElectionLoop在每次当选/续约时取出来。token本身由一个独立的计数器key(lockKey+":token")
+// 靠INCR产生，每次尝试acquire（不论是否抢到）都会递增一次，所以token单调递增但不连续；续约不会再往上加
+type redisLockProvider struct {
+	client *goredis.Client
+	key    string
+	id     string
+
+	leaseDuration time.Duration
+}
+
+func newRedisLockProvider(cfg *config.ControllerConfig, id string) *redisLockProvider {
+	client := goredis.NewClient(&goredis.Options{
+		Addr:     fmt.Sprintf("%s:%d", cfg.RedisCfg.Host, cfg.RedisCfg.Port),
+		Password: cfg.RedisCfg.Password,
+		DB:       cfg.RedisCfg.Database,
+	})
+	return &redisLockProvider{
+		client:        client,
+		key:           fmt.Sprintf("deepflow:election:%s", cfg.ElectionName),
+		id:            id,
+		leaseDuration: time.Duration(cfg.LeaseDuration) * time.Second,
+	}
+}
+
+func (p *redisLockProvider) tokenKey() string {
+	return p.key + ":token"
+}
+
+func encodeRedisValue(id string, token uint64) string {
+	return fmt.Sprintf("%s:%d", id, token)
+}
+
+// decodeRedisValue解析"<id>:<token>"，value格式不对（比如被非本套代码写过）时token按0处理
+func decodeRedisValue(value string) (id string, token uint64) {
+	idx := strings.LastIndex(value, ":")
+	if idx < 0 {
+		return value, 0
+	}
+	token, _ = strconv.ParseUint(value[idx+1:], 10, 64)
+	return value[:idx], token
+}
+
+// acquireScript只有key不存在时才抢锁成功，并把ARGV[2]（这一轮的token）写进去；
+// 返回1表示抢到，0表示key已经被别人持有
+const redisAcquireScript = `
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	redis.call("SET", KEYS[1], ARGV[1] .. ":" .. ARGV[2], "PX", ARGV[3])
+	return 1
+else
+	return 0
+end`
+
+func (p *redisLockProvider) Acquire(ctx context.Context) (bool, uint64, error) {
+	token, err := p.client.Incr(ctx, p.tokenKey()).Uint64()
+	if err != nil {
+		return false, 0, err
+	}
+	res, err := p.client.Eval(ctx, redisAcquireScript, []string{p.key}, p.id, token, p.leaseDuration.Milliseconds()).Result()
+	if err != nil {
+		return false, 0, err
+	}
+	acquired, _ := res.(int64)
+	if acquired != 1 {
+		return false, 0, nil
+	}
+	return true, token, nil
+}
+
+// redisRenewScript只有value里的id部分仍然是自己才续期，防止续一把已经被别的副本抢走的锁；
+// 续约不改变token，只延长PEXPIRE
+const redisRenewScript = `
+local v = redis.call("GET", KEYS[1])
+if v and string.sub(v, 1, string.len(ARGV[1]) + 1) == ARGV[1] .. ":" then
+	redis.call("PEXPIRE", KEYS[1], ARGV[2])
+	return v
+else
+	return false
+end`
+
+func (p *redisLockProvider) Renew(ctx context.Context) (bool, uint64, error) {
+	res, err := p.client.Eval(ctx, redisRenewScript, []string{p.key}, p.id, p.leaseDuration.Milliseconds()).Result()
+	if err != nil {
+		return false, 0, err
+	}
+	value, ok := res.(string)
+	if !ok || value == "" {
+		return false, 0, nil
+	}
+	_, token := decodeRedisValue(value)
+	return true, token, nil
+}
+
+const redisReleaseScript = `
+local v = redis.call("GET", KEYS[1])
+if v and string.sub(v, 1, string.len(ARGV[1]) + 1) == ARGV[1] .. ":" then
+	return redis.call("DEL", KEYS[1])
+else
+	return 0
+end`
+
+func (p *redisLockProvider) Release(ctx context.Context) error {
+	_, err := p.client.Eval(ctx, redisReleaseScript, []string{p.key}, p.id).Result()
+	return err
+}
+
+// Observe没有类似etcd watch那样的原生机制，只能轮询GET；轮询间隔取leaseDuration的一个零头，
+// 足够让跟随者在锁被接管之后的一小段时间内感知到新leader
+func (p *redisLockProvider) Observe(ctx context.Context, onLeaderChanged func(identity string, token uint64)) {
+	interval := p.leaseDuration / 4
+	if interval <= 0 {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	last := ""
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			value, err := p.client.Get(ctx, p.key).Result()
+			if err != nil {
+				continue
+			}
+			if value == last || value == "" {
+				continue
+			}
+			last = value
+			id, token := decodeRedisValue(value)
+			onLeaderChanged(id, token)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+/*
+ * Copyright (c) 2022 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package events是一个进程内的事件总线，给controller里那些目前只靠打日志来暴露的生命周期事件
+// （leader变更、域自动创建成功/失败、cluster_id冲突）一个统一的、可以让operator接上自己的告警栈
+// 的出口。典型用法是调用方在状态变化的地方调一次Publish，多个Sink各自决定要不要、怎么处理这个事件，
+// Publish本身不关心下游——这一点上和election.Callbacks的注册方式是同一个思路
+package events
+
+import (
+	"sync"
+	"time"
+
+	logging "github.com/op/go-logging"
+)
+
+var log = logging.MustGetLogger("controller.events")
+
+type Kind string
+
+const (
+	LeaderChanged              Kind = "leader_changed"
+	DomainAutoCreated          Kind = "domain_auto_created"
+	DomainAutoCreateFailed     Kind = "domain_auto_create_failed"
+	ClusterIDCollisionDetected Kind = "cluster_id_collision_detected"
+)
+
+// Event是总线上流转的最小单元。Fields按事件类型放不同的上下文，比如DomainAutoCreateFailed会带
+// cluster_id、controller_ip、region、尝试次数和失败原因，方便operator不用翻日志就能直接定位
+type Event struct {
+	Kind   Kind                   `json:"kind"`
+	Time   time.Time              `json:"time"`
+	Fields map[string]interface{} `json:"fields,omitempty"`
+}
+
+// Sink是一种事件的落地方式，RingBufferSink/MySQLSink/WebhookSink各实现一份
+type Sink interface {
+	Publish(e Event)
+}
+
+var (
+	mu    sync.RWMutex
+	sinks []Sink
+)
+
+// Register把一个Sink接到总线上，重复调用会累加而不是覆盖——一个部署同时要RingBuffer、MySQL表、
+// webhook三种落地方式是常见情况
+func Register(sink Sink) {
+	mu.Lock()
+	defer mu.Unlock()
+	sinks = append(sinks, sink)
+}
+
+// Publish把一个事件广播给所有已注册的Sink，每个Sink独立跑在自己的goroutine里，一个Sink
+// 阻塞/出错不应该拖慢事件源头（比如不能因为webhook那端响应慢就拖慢createDomain的重试循环）
+func Publish(kind Kind, fields map[string]interface{}) {
+	e := Event{Kind: kind, Time: time.Now(), Fields: fields}
+
+	mu.RLock()
+	defer mu.RUnlock()
+	for _, sink := range sinks {
+		sink := sink
+		go func() {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Errorf("event sink panicked handling %s: %v", e.Kind, r)
+				}
+			}()
+			sink.Publish(e)
+		}()
+	}
+}
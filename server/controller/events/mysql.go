@@ -0,0 +1,58 @@
+/*
+ * Copyright (c) 2022 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package events
+
+import (
+	"encoding/json"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// controllerEventRow是controller_events表的行模型，FieldsJSON把Event.Fields整个序列化进去，
+// 省得每加一种事件类型的新字段都要跟着改表结构
+type controllerEventRow struct {
+	ID         uint64    `gorm:"primaryKey;autoIncrement" json:"id"`
+	Kind       string    `gorm:"column:kind" json:"kind"`
+	FieldsJSON string    `gorm:"column:fields_json;type:text" json:"fields_json"`
+	CreatedAt  time.Time `gorm:"column:created_at" json:"created_at"`
+}
+
+func (controllerEventRow) TableName() string {
+	return "controller_events"
+}
+
+// MySQLSink把事件落一份到controller_events表，供审计/事后排查用，不依赖RingBufferSink的内存窗口
+type MySQLSink struct {
+	db *gorm.DB
+}
+
+func NewMySQLSink(db *gorm.DB) *MySQLSink {
+	return &MySQLSink{db: db}
+}
+
+func (s *MySQLSink) Publish(e Event) {
+	fieldsJSON, err := json.Marshal(e.Fields)
+	if err != nil {
+		log.Errorf("failed to marshal event fields for %s: %s", e.Kind, err)
+		return
+	}
+	row := controllerEventRow{Kind: string(e.Kind), FieldsJSON: string(fieldsJSON), CreatedAt: e.Time}
+	if err := s.db.Create(&row).Error; err != nil {
+		log.Errorf("failed to record controller event %s: %s", e.Kind, err)
+	}
+}
@@ -0,0 +1,72 @@
+/*
+ * Copyright (c) 2022 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package events
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+)
+
+// RingBufferSink把最近的事件留在内存里，供/v1/events这种轻量查询用；重启就丢，长期审计应该
+// 接MySQLSink，这里只是给operator一个"刚刚发生了什么"的快速视图
+type RingBufferSink struct {
+	mu     sync.RWMutex
+	events []Event
+	cap    int
+	next   int
+	full   bool
+}
+
+func NewRingBufferSink(capacity int) *RingBufferSink {
+	if capacity <= 0 {
+		capacity = 256
+	}
+	return &RingBufferSink{events: make([]Event, capacity), cap: capacity}
+}
+
+func (r *RingBufferSink) Publish(e Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events[r.next] = e
+	r.next = (r.next + 1) % r.cap
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// Recent按时间从旧到新返回当前缓冲区里的所有事件
+func (r *RingBufferSink) Recent() []Event {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if !r.full {
+		out := make([]Event, r.next)
+		copy(out, r.events[:r.next])
+		return out
+	}
+	out := make([]Event, r.cap)
+	copy(out, r.events[r.next:])
+	copy(out[r.cap-r.next:], r.events[:r.next])
+	return out
+}
+
+// Handler是挂在controller HTTP server上的/v1/events接口
+func (r *RingBufferSink) Handler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(r.Recent())
+}
@@ -0,0 +1,90 @@
+/*
+ * Copyright (c) 2022 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package events
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// WebhookConfig配置WebhookSink要POST到哪里、用哪个密钥签名。Secret为空时不加签名头，纯粹
+// 当成一个普通的JSON POST端点（比如调试用的request bin）
+type WebhookConfig struct {
+	Enabled bool   `default:"false" yaml:"enabled"`
+	URL     string `yaml:"url"`
+	Secret  string `yaml:"secret"`
+	Timeout int    `default:"5" yaml:"timeout"`
+}
+
+// WebhookSink把事件JSON POST到一个用户自己的端点，方便接入已有的告警栈（PagerDuty、企业微信、
+// 自建的webhook receiver等）。签名算法和GitHub webhook的X-Hub-Signature-256是同一套：
+// "sha256=" + hex(hmac_sha256(secret, body))，放在X-DeepFlow-Signature-256头里
+type WebhookSink struct {
+	cfg    WebhookConfig
+	client *http.Client
+}
+
+func NewWebhookSink(cfg WebhookConfig) *WebhookSink {
+	return &WebhookSink{
+		cfg:    cfg,
+		client: &http.Client{Timeout: time.Duration(cfg.Timeout) * time.Second},
+	}
+}
+
+func (s *WebhookSink) Publish(e Event) {
+	if !s.cfg.Enabled || s.cfg.URL == "" {
+		return
+	}
+
+	body, err := json.Marshal(e)
+	if err != nil {
+		log.Errorf("failed to marshal event %s for webhook: %s", e.Kind, err)
+		return
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		log.Errorf("failed to build webhook request for %s: %s", e.Kind, err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.cfg.Secret != "" {
+		req.Header.Set("X-DeepFlow-Signature-256", signBody(s.cfg.Secret, body))
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		log.Errorf("webhook delivery failed for %s: %s", e.Kind, err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Errorf("webhook delivery for %s got status %s", e.Kind, resp.Status)
+	}
+}
+
+func signBody(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return fmt.Sprintf("sha256=%s", hex.EncodeToString(mac.Sum(nil)))
+}
@@ -0,0 +1,194 @@
+/*
+ * Copyright (c) 2022 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package livestatereporter把cloud.KubernetesGatherTask采集到的资源以推送的方式交给订阅者，
+// 代替GenesisSharingK8S/GenesisSharingSync那种客户端轮询的用法。这里以轮询
+// cloud.GetClusterResource拿到的version做增量判断，不订阅KubernetesGatherTask.EventCh()。
+package livestatereporter
+
+import (
+	"sync"
+	"time"
+
+	logging "github.com/op/go-logging"
+
+	"github.com/deepflowys/deepflow/server/controller/cloud"
+	kubernetes_gather_model "github.com/deepflowys/deepflow/server/controller/cloud/kubernetes_gather/model"
+)
+
+var log = logging.MustGetLogger("livestatereporter")
+
+const (
+	DefaultDebounce     = 500 * time.Millisecond
+	DefaultPollInterval = 1 * time.Second
+	DefaultBufferSize   = 8
+)
+
+// Snapshot是推送给订阅者的一次资源状态，Reset为true时表示这是没有带BaseVersion的订阅者收到的
+// 首帧，或者version跳跃过大、订阅者请求的BaseVersion已经不在服务端可追溯的范围内，下游应当整体
+// 替换而不是按增量合并
+type Snapshot struct {
+	ClusterLcuuid string
+	Version       uint64
+	Resource      kubernetes_gather_model.KubernetesGatherResource
+	Reset         bool
+}
+
+// Subscription描述一次订阅请求
+type Subscription struct {
+	ClusterLcuuid string
+	// BaseVersion非0时，Reporter会在首次推送时判断是否能增量续传，否则退化为一次Reset快照
+	BaseVersion uint64
+}
+
+type subscriber struct {
+	sub      Subscription
+	ch       chan Snapshot
+	lastSent uint64
+	dropped  uint64
+}
+
+// Reporter管理一组订阅，按ClusterLcuuid去重复用轮询goroutine
+type Reporter struct {
+	mutex        sync.Mutex
+	debounce     time.Duration
+	pollInterval time.Duration
+	watchers     map[string]*clusterWatcher
+
+	// eventsSent/eventsDropped/reconnects用于对接Prometheus exporter
+	eventsSent    uint64
+	eventsDropped uint64
+	reconnects    uint64
+}
+
+type clusterWatcher struct {
+	lcuuid      string
+	cancel      chan struct{}
+	subscribers map[*subscriber]struct{}
+}
+
+func NewReporter() *Reporter {
+	return &Reporter{
+		debounce:     DefaultDebounce,
+		pollInterval: DefaultPollInterval,
+		watchers:     make(map[string]*clusterWatcher),
+	}
+}
+
+// Subscribe注册一个订阅，返回一个只读channel用于接收快照，以及一个取消订阅的函数。
+// channel是有界的，消费跟不上时会丢弃旧快照而不是阻塞采集侧
+func (r *Reporter) Subscribe(sub Subscription) (<-chan Snapshot, func()) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	w, ok := r.watchers[sub.ClusterLcuuid]
+	if !ok {
+		w = &clusterWatcher{
+			lcuuid:      sub.ClusterLcuuid,
+			cancel:      make(chan struct{}),
+			subscribers: make(map[*subscriber]struct{}),
+		}
+		r.watchers[sub.ClusterLcuuid] = w
+		go r.watch(w)
+	}
+
+	s := &subscriber{sub: sub, ch: make(chan Snapshot, DefaultBufferSize)}
+	w.subscribers[s] = struct{}{}
+
+	cancelFunc := func() {
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		delete(w.subscribers, s)
+		close(s.ch)
+		if len(w.subscribers) == 0 {
+			close(w.cancel)
+			delete(r.watchers, sub.ClusterLcuuid)
+		}
+	}
+	return s.ch, cancelFunc
+}
+
+// watch周期性轮询一个集群的resource version，一旦发生变化（经过debounce合并突发变更）就
+// 给该集群下所有订阅者推送快照
+func (r *Reporter) watch(w *clusterWatcher) {
+	ticker := time.NewTicker(r.pollInterval)
+	defer ticker.Stop()
+
+	var lastVersion uint64
+	var pendingSince time.Time
+	for {
+		select {
+		case <-w.cancel:
+			return
+		case <-ticker.C:
+			resource, version, ok := cloud.GetClusterResource(w.lcuuid)
+			if !ok || version == lastVersion {
+				continue
+			}
+			if pendingSince.IsZero() {
+				pendingSince = time.Now()
+			}
+			if time.Since(pendingSince) < r.debounce {
+				continue
+			}
+			pendingSince = time.Time{}
+			lastVersion = version
+			r.fanout(w, resource, version)
+		}
+	}
+}
+
+func (r *Reporter) fanout(w *clusterWatcher, resource kubernetes_gather_model.KubernetesGatherResource, version uint64) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for s := range w.subscribers {
+		// 没有带BaseVersion的首帧、请求的BaseVersion已经比当前版本还新、或者服务端没有保留足够的历史，都只能整体重置
+		reset := s.lastSent == 0 && (s.sub.BaseVersion == 0 || s.sub.BaseVersion > version || s.sub.BaseVersion < version-1)
+		snapshot := Snapshot{
+			ClusterLcuuid: w.lcuuid,
+			Version:       version,
+			Resource:      resource,
+			Reset:         reset,
+		}
+		select {
+		case s.ch <- snapshot:
+			s.lastSent = version
+			r.eventsSent++
+		default:
+			// 订阅者跟不上，丢弃旧快照腾出空间而不是阻塞采集侧；下一次快照会带上最新全量数据
+			select {
+			case <-s.ch:
+			default:
+			}
+			select {
+			case s.ch <- snapshot:
+				s.lastSent = version
+				r.eventsSent++
+			default:
+			}
+			s.dropped++
+			r.eventsDropped++
+			log.Warningf("livestatereporter subscriber for cluster %s fell behind, dropped a snapshot", w.lcuuid)
+		}
+	}
+}
+
+// Stats暴露给metrics/health接口
+func (r *Reporter) Stats() (eventsSent, eventsDropped, reconnects uint64) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.eventsSent, r.eventsDropped, r.reconnects
+}
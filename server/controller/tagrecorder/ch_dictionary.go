@@ -0,0 +1,76 @@
+/*
+ * Copyright (c) 2022 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tagrecorder
+
+import (
+	"context"
+	"fmt"
+
+	clickhouse "github.com/ClickHouse/clickhouse-go/v2"
+
+	mysqlconfig "github.com/deepflowys/deepflow/server/controller/db/mysql/config"
+)
+
+// chDictionaryDef描述一张MySQL-backed ClickHouse字典：Name既是字典名也是MySQL侧同名的备份表
+// （各ch_*更新器负责把数据整表写进这张MySQL表），PrimaryKey拼进CREATE DICTIONARY的PRIMARY KEY
+// 子句。新增一张字典只需要在chDictionaries里加一行，不用改UpdateChDictionary本身
+type chDictionaryDef struct {
+	Name       string
+	PrimaryKey string
+}
+
+// chDictionaries登记所有需要在ClickHouse里维护的MySQL-backed字典
+var chDictionaries = []chDictionaryDef{
+	{Name: ChNetInterfaceDictionary, PrimaryKey: "vtap_id, if_index"},
+}
+
+// UpdateChDictionary对chDictionaries里登记的每张字典跑一遍CREATE OR REPLACE DICTIONARY，
+// 字典内容从同名的MySQL表里全量拉取（LIFETIME(0)表示不自动过期，内容新鲜度完全由各ch_*更新器
+// 刷写MySQL表的频率决定），单张字典建失败只记日志、不影响其它字典
+func (c *TagRecorder) UpdateChDictionary() {
+	ck, err := clickhouse.Open(&clickhouse.Options{
+		Addr: []string{fmt.Sprintf("%s:%d", c.cfg.ClickHouseCfg.Host, c.cfg.ClickHouseCfg.Port)},
+		Auth: clickhouse.Auth{
+			Database: "default",
+			Username: c.cfg.ClickHouseCfg.UserName,
+			Password: c.cfg.ClickHouseCfg.Password,
+		},
+	})
+	if err != nil {
+		log.Errorf("tagrecorder: connect clickhouse failed: %s", err)
+		return
+	}
+	defer ck.Close()
+
+	for _, def := range chDictionaries {
+		if err := ck.Exec(context.Background(), createDictionarySQL(def, c.cfg.MySqlCfg)); err != nil {
+			log.Errorf("tagrecorder: create dictionary %s failed: %s", def.Name, err)
+		}
+	}
+}
+
+func createDictionarySQL(def chDictionaryDef, mysqlCfg mysqlconfig.MySqlConfig) string {
+	return fmt.Sprintf(`CREATE OR REPLACE DICTIONARY %s
+SOURCE(MYSQL(host '%s' port %d user '%s' password '%s' db '%s' table '%s'))
+LAYOUT(COMPLEX_KEY_HASHED())
+PRIMARY KEY %s
+LIFETIME(0)`,
+		def.Name,
+		mysqlCfg.Host, mysqlCfg.Port, mysqlCfg.UserName, mysqlCfg.Password, mysqlCfg.Database, def.Name,
+		def.PrimaryKey,
+	)
+}
@@ -0,0 +1,140 @@
+/*
+ * Copyright (c) 2022 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tagrecorder
+
+import (
+	"context"
+
+	"gorm.io/gorm"
+
+	models "github.com/deepflowys/deepflow/server/controller/db/mysql"
+)
+
+// ChNetInterfaceDictionary是ch_net_interface这张MySQL表的表名，ChNetInterface.Refresh把
+// 这张表的内容全量替换掉，UpdateChDictionary（见ch_dictionary.go）再把它注册成一张以MySQL为
+// 数据源的ClickHouse字典，按(vtap_id, if_index)复合键组织，和ch_vtap_port用的是同一套
+// 复合键，流表查询可以直接用这两个字段join出网卡名、MAC等信息，不用再单独lookup一次
+const ChNetInterfaceDictionary = "ch_net_interface"
+
+// IconKey标识一种"资源类型+细分用途"的组合，用来在resourceTypeToIconID里查出这类资源默认
+// 展示用的icon_id；NetInterface在同一个resource type下还要按网卡类型（物理/虚拟/bond/bridge）
+// 区分图标，所以额外带一个IfType字段
+type IconKey struct {
+	NodeType string
+	IfType   string
+}
+
+const (
+	IconResourceTypeNetInterface = "net_interface"
+
+	IfTypePhysical = "physical"
+	IfTypeVirtual  = "virtual"
+	IfTypeBond     = "bond"
+	IfTypeBridge   = "bridge"
+)
+
+// ChNetInterface是ch_net_interface字典的更新器，数据源和ChVTapPort一样来自vtap上报的主机网卡
+// 清单（接口名、MAC、IPv4/IPv6地址、MTU、管理/运行状态），materialize成字典后流查询可以直接按
+// (vtap_id, if_index)把NIC名称/MAC当tag用，不需要单独发一次lookup请求
+type ChNetInterface struct {
+	db                   *gorm.DB
+	resourceTypeToIconID map[IconKey]int
+}
+
+func NewChNetInterface(db *gorm.DB, resourceTypeToIconID map[IconKey]int) *ChNetInterface {
+	return &ChNetInterface{db: db, resourceTypeToIconID: resourceTypeToIconID}
+}
+
+// chNetInterfaceRow对应字典里的一行，复合主键是(VTapID, IfIndex)
+type chNetInterfaceRow struct {
+	VTapID     int    `gorm:"column:vtap_id;primaryKey"`
+	IfIndex    int    `gorm:"column:if_index;primaryKey"`
+	Name       string `gorm:"column:name"`
+	MAC        string `gorm:"column:mac"`
+	IPv4       string `gorm:"column:ipv4"`
+	IPv6       string `gorm:"column:ipv6"`
+	MTU        int    `gorm:"column:mtu"`
+	AdminState string `gorm:"column:admin_state"`
+	OperState  string `gorm:"column:oper_state"`
+	IconID     int    `gorm:"column:icon_id"`
+}
+
+func (chNetInterfaceRow) TableName() string {
+	return ChNetInterfaceDictionary
+}
+
+// ifaceIconID按网卡类型从resourceTypeToIconID里查出对应的icon_id，查不到时回退到物理网卡的图标
+func (u *ChNetInterface) ifaceIconID(ifType string) int {
+	if iconID, ok := u.resourceTypeToIconID[IconKey{NodeType: IconResourceTypeNetInterface, IfType: ifType}]; ok {
+		return iconID
+	}
+	return u.resourceTypeToIconID[IconKey{NodeType: IconResourceTypeNetInterface, IfType: IfTypePhysical}]
+}
+
+// Refresh从vtap上报的主机网卡清单（models.VTapInterface，ChVTapPort读的同一份数据源）重建
+// ch_net_interface字典：按(vtap_id, if_index)组装每一行，IconID按网卡类型映射，整表替换写入
+// ch_net_interface这张MySQL表，返回写入的行数供RunReport/Prometheus统计；ctx在leader election
+// 丢失后会被cancel，这里在写字典前检查一次，避免失去leader身份后还把一份过期数据写进数据库
+func (u *ChNetInterface) Refresh(ctx context.Context) (int, error) {
+	if ctx.Err() != nil {
+		return 0, ctx.Err()
+	}
+	log.Info("tagrecorder: refreshing ch_net_interface")
+
+	var sourceRows []models.VTapInterface
+	if err := u.db.Find(&sourceRows).Error; err != nil {
+		return 0, err
+	}
+
+	rows := make([]chNetInterfaceRow, 0, len(sourceRows))
+	for _, s := range sourceRows {
+		rows = append(rows, chNetInterfaceRow{
+			VTapID:     s.VTapID,
+			IfIndex:    s.IfIndex,
+			Name:       s.Name,
+			MAC:        s.MAC,
+			IPv4:       s.IPv4,
+			IPv6:       s.IPv6,
+			MTU:        s.MTU,
+			AdminState: s.AdminState,
+			OperState:  s.OperState,
+			IconID:     u.ifaceIconID(s.IfType),
+		})
+	}
+
+	if ctx.Err() != nil {
+		return 0, ctx.Err()
+	}
+	if err := u.replaceAll(rows); err != nil {
+		return 0, err
+	}
+	return len(rows), nil
+}
+
+// replaceAll把ch_net_interface整表换成rows，沿用ch_ip_resource那类全量字典的惯例：删光旧行
+// 再批量插入，放在一个事务里做，避免刷新过程中被并发查询看到半写完的表
+func (u *ChNetInterface) replaceAll(rows []chNetInterfaceRow) error {
+	return u.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("1 = 1").Delete(&chNetInterfaceRow{}).Error; err != nil {
+			return err
+		}
+		if len(rows) == 0 {
+			return nil
+		}
+		return tx.Create(&rows).Error
+	})
+}
@@ -0,0 +1,38 @@
+/*
+ * Copyright (c) 2022 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tagrecorder
+
+// ResourceChange是上游（recorder/cloud子系统、Redis pub/sub等）检测到某类资源发生变化后
+// 投递给tagrecorder的通知
+type ResourceChange struct {
+	ResourceType ResourceType
+}
+
+// changeCh是进程内唯一的change通知channel，Notify向它非阻塞投递，TagRecorder.watchChanges在
+// 独立的goroutine里消费，跟不上就丢弃最新的一条——和config.Bus是同一套约定，
+// KubernetesGatherTask.EventCh则相反，丢弃旧事件、保留最新一条
+var changeCh = make(chan ResourceChange, 64)
+
+// Notify供上游子系统在resourceType对应的资源发生变化后调用，用于提前唤醒registry里依赖该
+// 资源类型的updater，而不用等到下一次按cfg.TagRecorderCfg.Interval触发的全量刷新
+func Notify(resourceType ResourceType) {
+	select {
+	case changeCh <- ResourceChange{ResourceType: resourceType}:
+	default:
+		log.Warningf("tagrecorder: change notification channel is full, dropping notification for %s", resourceType)
+	}
+}
@@ -0,0 +1,34 @@
+/*
+ * Copyright (c) 2022 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package config
+
+// LeaderElectionConfig控制TagRecorder是否要求只有一个controller副本执行run()。Enabled为false
+// （默认）时行为和过去一样，每个副本都各自刷新；Enabled为true时副本间通过Redis SET NX PX续租锁
+// 抢主，LeaseDuration/RetryPeriod的含义和ControllerConfig里k8s LeaseLock用的同名字段一致；
+// RenewDeadline不被TagRecorder的选举逻辑读取，续租失败一次即放弃leader身份
+type LeaderElectionConfig struct {
+	Enabled       bool   `default:"false" yaml:"enabled"`
+	LockKey       string `default:"deepflow-tagrecorder-leader" yaml:"lock-key"`
+	LeaseDuration int    `default:"15" yaml:"lease-duration"`
+	RenewDeadline int    `default:"10" yaml:"renew-deadline"`
+	RetryPeriod   int    `default:"2" yaml:"retry-period"`
+}
+
+type TagRecorderConfig struct {
+	Interval      int                  `default:"60" yaml:"interval"`
+	LeaderElection LeaderElectionConfig `yaml:"leader-election"`
+}
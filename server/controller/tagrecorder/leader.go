@@ -0,0 +1,179 @@
+/*
+ * Copyright (c) 2022 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tagrecorder
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	goredis "github.com/go-redis/redis/v8"
+
+	dfredis "github.com/deepflowys/deepflow/server/controller/db/redis"
+)
+
+// newRedisClient按RedisCfg里的连接信息创建一个go-redis Client，只有开启了
+// TagRecorderCfg.LeaderElection.Enabled时才会被调用，避免没开启HA选举的部署额外依赖Redis连通性
+func newRedisClient(cfg dfredis.RedisConfig) *goredis.Client {
+	return goredis.NewClient(&goredis.Options{
+		Addr:     fmt.Sprintf("%s:%d", cfg.Host, cfg.Port),
+		Password: cfg.Password,
+		DB:       cfg.Database,
+	})
+}
+
+// leaseAcquiredCount/leaseLostCount/leaseRenewedCount统计本进程经历过的leader租约事件次数，
+// 供后续Prometheus exporter对接使用，和kubernetes_gather_task.go里的resyncCount是同一个约定
+var (
+	leaseAcquiredCount uint64
+	leaseLostCount     uint64
+	leaseRenewedCount  uint64
+)
+
+func GetLeaseAcquiredCount() uint64 { return atomic.LoadUint64(&leaseAcquiredCount) }
+func GetLeaseLostCount() uint64     { return atomic.LoadUint64(&leaseLostCount) }
+func GetLeaseRenewedCount() uint64  { return atomic.LoadUint64(&leaseRenewedCount) }
+
+// leaderCallbacks和election.Start用的k8s leaderelection.LeaderCallbacks是同一种形状，
+// 这里换成Redis实现时保留同样的回调约定，方便以后对照
+type leaderCallbacks struct {
+	OnStartedLeading func(ctx context.Context)
+	OnStoppedLeading func()
+}
+
+// redisLeaderElector用Redis SET NX PX + 续租实现TagRecorder这一层的leader election：只有
+// 抢到锁的副本会执行run()，其余副本保持常驻订阅changeCh，一旦leader失联锁会在leaseDuration后
+// 过期由某个follower抢到接管，切换时间在一个leaseDuration内，不需要等到下一个完整Interval
+type redisLeaderElector struct {
+	client *goredis.Client
+	key    string
+	id     string
+
+	leaseDuration time.Duration
+	retryPeriod   time.Duration
+}
+
+func newRedisLeaderElector(client *goredis.Client, key string, leaseDuration, retryPeriod time.Duration) *redisLeaderElector {
+	hostname, _ := os.Hostname()
+	return &redisLeaderElector{
+		client:        client,
+		key:           key,
+		id:            fmt.Sprintf("%s/%d", hostname, os.Getpid()),
+		leaseDuration: leaseDuration,
+		retryPeriod:   retryPeriod,
+	}
+}
+
+// Run阻塞运行选举循环直到ctx被取消：反复尝试用SET NX PX抢锁，抢到后在独立的goroutine里跑
+// OnStartedLeading，自己则阻塞在holdLease里每隔leaseDuration/2用Lua脚本校验身份后延长TTL，续租失败或者ctx被取消都会触发OnStoppedLeading，
+// 并把内层run()用的ctx一起cancel掉，避免一次正在进行的refresh在失去leader身份后继续跑
+func (e *redisLeaderElector) Run(ctx context.Context, callbacks leaderCallbacks) {
+	ticker := time.NewTicker(e.retryPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			ok, err := e.acquire(ctx)
+			if err != nil {
+				log.Warningf("tagrecorder leader election: acquire %s failed: %s", e.key, err)
+				continue
+			}
+			if !ok {
+				continue
+			}
+			atomic.AddUint64(&leaseAcquiredCount, 1)
+			log.Infof("tagrecorder leader election: %s acquired leadership of %s", e.id, e.key)
+			leadingCtx, cancelLeading := context.WithCancel(ctx)
+			if callbacks.OnStartedLeading != nil {
+				go callbacks.OnStartedLeading(leadingCtx)
+			}
+			e.holdLease(ctx)
+			cancelLeading()
+			atomic.AddUint64(&leaseLostCount, 1)
+			log.Infof("tagrecorder leader election: %s lost leadership of %s", e.id, e.key)
+			if callbacks.OnStoppedLeading != nil {
+				callbacks.OnStoppedLeading()
+			}
+		}
+	}
+}
+
+// acquire尝试用SET key id NX PX leaseDuration抢锁，key已经被别的副本持有时直接返回false
+func (e *redisLeaderElector) acquire(ctx context.Context) (bool, error) {
+	return e.client.SetNX(ctx, e.key, e.id, e.leaseDuration).Result()
+}
+
+// holdLease持有锁期间阻塞，每隔leaseDuration/2续一次租，续租失败、被拒绝或者ctx被取消都会返回
+func (e *redisLeaderElector) holdLease(ctx context.Context) {
+	renewInterval := e.leaseDuration / 2
+	if renewInterval <= 0 {
+		renewInterval = e.retryPeriod
+	}
+	ticker := time.NewTicker(renewInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			renewed, err := e.renew(ctx)
+			if err != nil {
+				log.Warningf("tagrecorder leader election: renew %s failed: %s", e.key, err)
+				return
+			}
+			if !renewed {
+				return
+			}
+			atomic.AddUint64(&leaseRenewedCount, 1)
+		}
+	}
+}
+
+// Release在当前value仍然是自己id的前提下主动删除锁，用于TagRecorder.Stop时尽快让出leader身份，
+// 而不是等锁自然过期，从而缩短接下来其它副本的切换等待
+func (e *redisLeaderElector) Release(ctx context.Context) error {
+	_, err := e.client.Eval(ctx, releaseScript, []string{e.key}, e.id).Result()
+	return err
+}
+
+const releaseScript = `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+else
+	return 0
+end`
+
+// renewScript只有当前value仍然等于自己的id时才续期，避免续租一把已经被别的副本抢走的锁
+const renewScript = `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+else
+	return 0
+end`
+
+func (e *redisLeaderElector) renew(ctx context.Context) (bool, error) {
+	res, err := e.client.Eval(ctx, renewScript, []string{e.key}, e.id, e.leaseDuration.Milliseconds()).Result()
+	if err != nil {
+		return false, err
+	}
+	renewed, _ := res.(int64)
+	return renewed == 1, nil
+}
@@ -0,0 +1,98 @@
+/*
+ * Copyright (c) 2022 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tagrecorder
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// UpdaterReport是单个ChResourceUpdater一次Refresh的结构化结果
+type UpdaterReport struct {
+	Name     string
+	Duration time.Duration
+	Rows     int
+	Err      error
+}
+
+// RunReport是run()一次完整执行的结构化结果，汇总了这一轮里每个updater各自的UpdaterReport，
+// 供日志打印和上层（比如后续的运维工具）判断哪个updater是当前最慢的标签刷新器
+type RunReport struct {
+	StartedAt time.Time
+	Duration  time.Duration
+	Updaters  []UpdaterReport
+}
+
+var (
+	runDurationSeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name: "deepflow_tagrecorder_run_duration_seconds",
+		Help: "Duration of one full TagRecorder run(), across all registered updaters.",
+	})
+	updaterDurationSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "deepflow_tagrecorder_updater_duration_seconds",
+		Help: "Duration of a single ChResourceUpdater.Refresh() call, labeled by updater name.",
+	}, []string{"updater"})
+	updaterRowsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "deepflow_tagrecorder_updater_rows_total",
+		Help: "Rows written by ChResourceUpdater.Refresh(), labeled by updater name.",
+	}, []string{"updater"})
+	updaterErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "deepflow_tagrecorder_updater_errors_total",
+		Help: "Errors returned by ChResourceUpdater.Refresh(), labeled by updater name.",
+	}, []string{"updater"})
+	schedulerSkippedTicksTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "deepflow_tagrecorder_scheduler_skipped_ticks_total",
+		Help: "Ticks skipped by Scheduler because the previous run() was still in flight.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		runDurationSeconds,
+		updaterDurationSeconds,
+		updaterRowsTotal,
+		updaterErrorsTotal,
+		schedulerSkippedTicksTotal,
+	)
+}
+
+// recordUpdaterReport把一个UpdaterReport记进Prometheus，并在出错时额外打一条warning日志，
+// runIfDue（change事件驱动的单项刷新）和refresh（周期性全量刷新）共用这一个记录口径
+func recordUpdaterReport(r UpdaterReport) {
+	updaterDurationSeconds.WithLabelValues(r.Name).Observe(r.Duration.Seconds())
+	updaterRowsTotal.WithLabelValues(r.Name).Add(float64(r.Rows))
+	if r.Err != nil {
+		updaterErrorsTotal.WithLabelValues(r.Name).Inc()
+		log.Warningf("tagrecorder: updater %s failed after %s: %s", r.Name, r.Duration, r.Err)
+	} else {
+		log.Debugf("tagrecorder: updater %s refreshed %d rows in %s", r.Name, r.Rows, r.Duration)
+	}
+}
+
+// recordRunReport记录一整轮run()的耗时，并打印一条汇总日志，方便直接从日志里看出这一轮里
+// 最慢的updater是谁，而不必现查Prometheus
+func recordRunReport(r RunReport) {
+	runDurationSeconds.Observe(r.Duration.Seconds())
+	var slowest UpdaterReport
+	for _, u := range r.Updaters {
+		if u.Duration > slowest.Duration {
+			slowest = u
+		}
+	}
+	log.Infof("tagrecorder run complete in %s across %d updaters, slowest updater %s took %s", r.Duration, len(r.Updaters), slowest.Name, slowest.Duration)
+}
@@ -0,0 +1,168 @@
+/*
+ * Copyright (c) 2022 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tagrecorder
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// ResourceType标识tagrecorder关心的上游资源种类，ChResourceUpdater通过UpdaterOptions.DependsOn
+// 声明自己依赖哪些资源类型，这样一个资源变化只会唤醒真正关心它的updater，而不是registry里的全部
+type ResourceType string
+
+const (
+	ResourceTypeRegion       ResourceType = "region"
+	ResourceTypeAZ           ResourceType = "az"
+	ResourceTypeVPC          ResourceType = "vpc"
+	ResourceTypeDevice       ResourceType = "device"
+	ResourceTypeNetwork      ResourceType = "network"
+	ResourceTypeTapType      ResourceType = "tap_type"
+	ResourceTypeVTap         ResourceType = "vtap"
+	ResourceTypePod          ResourceType = "pod"
+	ResourceTypePodCluster   ResourceType = "pod_cluster"
+	ResourceTypePodGroup     ResourceType = "pod_group"
+	ResourceTypePodNamespace ResourceType = "pod_namespace"
+	ResourceTypePodNode      ResourceType = "pod_node"
+	ResourceTypePodIngress   ResourceType = "pod_ingress"
+	ResourceTypeLbListener   ResourceType = "lb_listener"
+	ResourceTypeK8sLabel     ResourceType = "k8s_label"
+	ResourceTypeIPRelation   ResourceType = "ip_relation"
+	ResourceTypeIPResource   ResourceType = "ip_resource"
+)
+
+// ChResourceUpdater是每张ClickHouse标签字典表的刷新器，过去refresh()里硬编码的那份切片
+// 就是它的实现者。Refresh接收ctx是为了在leader election下失去leader身份时能取消一次
+// 正在进行的刷新，而不是让它继续跑到完成；返回写入的行数和错误，供RunReport和Prometheus
+// 指标统计每个updater各自的耗时与结果
+type ChResourceUpdater interface {
+	Refresh(ctx context.Context) (rows int, err error)
+}
+
+// UpdaterOptions是Register一个ChResourceUpdater时附带的调度元数据。MinInterval限制这个updater
+// 被change事件触发的最高频率（避免ChIPRelation这类开销大的updater被频繁的小变化打爆），零值表示
+// 不限制。DependsOn列出它关心哪些上游资源类型，只有命中这些类型的change事件才会唤醒它；对refresh()
+// 内置的updater，留空表示只会被周期性全量刷新触发，而经Register加入的updater不参与周期性全量刷新，
+// DependsOn留空时不会被触发
+type UpdaterOptions struct {
+	MinInterval time.Duration
+	DependsOn   []ResourceType
+}
+
+// updaterSpec把一个ChResourceUpdater实例、它的名字（用作Prometheus标签值和日志）和调度选项
+// 打包在一起，refresh()每轮都会重新构造一份新的specs（因为updater构造函数要吃当次最新的icon
+// 信息），交给registry.replace原子替换
+type updaterSpec struct {
+	Name    string
+	Updater ChResourceUpdater
+	Opts    UpdaterOptions
+}
+
+type registeredUpdater struct {
+	name    string
+	updater ChResourceUpdater
+	opts    UpdaterOptions
+	lastRun time.Time
+	builtin bool // 由refresh()经replace写入的内置updater，Register进来的为false
+}
+
+func (ru *registeredUpdater) dependsOn(resourceType ResourceType) bool {
+	for _, rt := range ru.opts.DependsOn {
+		if rt == resourceType {
+			return true
+		}
+	}
+	return false
+}
+
+// runIfDue在距上次运行超过MinInterval时才真正执行Refresh并原地更新lastRun，用来给change事件
+// 触发的刷新加上每个updater自己的速率限制；返回值表示是否真的跑了。真的跑了的那次会带上
+// UpdaterReport一起记录进Prometheus指标，和周期性全量run()是同一套统计口径
+func (ru *registeredUpdater) runIfDue(ctx context.Context, now time.Time) bool {
+	if ru.opts.MinInterval > 0 && now.Sub(ru.lastRun) < ru.opts.MinInterval {
+		return false
+	}
+	if ctx.Err() != nil {
+		return false
+	}
+	started := time.Now()
+	rows, err := ru.updater.Refresh(ctx)
+	recordUpdaterReport(UpdaterReport{Name: ru.name, Duration: time.Since(started), Rows: rows, Err: err})
+	ru.lastRun = now
+	return true
+}
+
+// registry持有当前进程内全部已注册的ChResourceUpdater及其调度选项，取代过去refresh()里的硬编码
+// 切片：内置的那一批通过每轮refresh()重新replace写入，下游新增一张ch表只需要调用包级Register，
+// 不需要再改refresh()
+type registry struct {
+	mutex    sync.Mutex
+	updaters []*registeredUpdater
+}
+
+func newRegistry() *registry {
+	return &registry{}
+}
+
+// defaultRegistry是进程内唯一的registry实例
+var defaultRegistry = newRegistry()
+
+// Register把一个ChResourceUpdater及其调度选项加入默认registry，供下游在自己的init()或启动逻辑里
+// 调用，新增一张ch表不再需要修改tagrecorder.refresh()。这样加入的updater只由watchChanges按
+// DependsOn触发，周期性全量run()不会调用它
+func Register(updater ChResourceUpdater, opts UpdaterOptions) {
+	defaultRegistry.add(updater, opts)
+}
+
+func (r *registry) add(updater ChResourceUpdater, opts UpdaterOptions) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.updaters = append(r.updaters, &registeredUpdater{updater: updater, opts: opts})
+}
+
+// replace原子地丢弃registry里内置的那一批updater并换成最新构造的specs。因为调用者在replace之前
+// 已经对每个updater做过一次全量Refresh，这里把lastRun统一置为now，避免紧跟着的change事件在
+// MinInterval窗口内被重复触发一次
+func (r *registry) replace(specs []updaterSpec, now time.Time) {
+	updaters := make([]*registeredUpdater, 0, len(specs))
+	for _, spec := range specs {
+		updaters = append(updaters, &registeredUpdater{name: spec.Name, updater: spec.Updater, opts: spec.Opts, lastRun: now, builtin: true})
+	}
+	r.mutex.Lock()
+	for _, ru := range r.updaters {
+		if !ru.builtin {
+			updaters = append(updaters, ru)
+		}
+	}
+	r.updaters = updaters
+	r.mutex.Unlock()
+}
+
+// matching返回声明了依赖resourceType的全部registeredUpdater，返回的是registry内部持有的指针，
+// 调用方对其执行runIfDue会原地更新lastRun
+func (r *registry) matching(resourceType ResourceType) []*registeredUpdater {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var out []*registeredUpdater
+	for _, ru := range r.updaters {
+		if ru.dependsOn(resourceType) {
+			out = append(out, ru)
+		}
+	}
+	return out
+}
@@ -0,0 +1,86 @@
+/*
+ * Copyright (c) 2022 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tagrecorder
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Scheduler在for range time.Tick(...)之上补了三件事：每个tick加一点随机jitter，避免多个副本
+// 在同一时刻一起压向ClickHouse；上一次run还没跑完时跳过这次tick（打warning log +
+// deepflow_tagrecorder_scheduler_skipped_ticks_total计数）而不是并发重入；以及一个会等正在
+// 执行的run完全跑完再返回的Stop()，配合进程优雅关闭使用
+type Scheduler struct {
+	interval time.Duration
+	jitter   time.Duration
+	run      func(ctx context.Context) RunReport
+
+	running int32 // 0/1，CAS标记run是否正在执行
+	wg      sync.WaitGroup
+}
+
+func NewScheduler(interval, jitter time.Duration, run func(ctx context.Context) RunReport) *Scheduler {
+	return &Scheduler{interval: interval, jitter: jitter, run: run}
+}
+
+// Start在独立的goroutine里按interval重复触发run，直到ctx被取消
+func (s *Scheduler) Start(ctx context.Context) {
+	s.wg.Add(1)
+	go s.loop(ctx)
+}
+
+func (s *Scheduler) loop(ctx context.Context) {
+	defer s.wg.Done()
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.tick(ctx)
+		}
+	}
+}
+
+func (s *Scheduler) tick(ctx context.Context) {
+	if !atomic.CompareAndSwapInt32(&s.running, 0, 1) {
+		schedulerSkippedTicksTotal.Inc()
+		log.Warning("tagrecorder scheduler: previous run is still in flight, skipping this tick")
+		return
+	}
+	defer atomic.StoreInt32(&s.running, 0)
+
+	if s.jitter > 0 {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Duration(rand.Int63n(int64(s.jitter)))):
+		}
+	}
+	s.run(ctx)
+}
+
+// Stop等待当前in-flight的run完全跑完再返回；调用方通常先取消传给Start的ctx，
+// 再调用Stop等待run内部对ctx取消的响应完成，两步合起来就是一次优雅关闭
+func (s *Scheduler) Stop() {
+	s.wg.Wait()
+}
@@ -17,74 +17,186 @@
 package tagrecorder
 
 import (
+	"context"
+	"fmt"
 	"time"
 
 	logging "github.com/op/go-logging"
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
 
 	// "github.com/deepflowys/deepflow/server/controller/tagrecorder/config"
 	"github.com/deepflowys/deepflow/server/controller/config"
+	mysqlconfig "github.com/deepflowys/deepflow/server/controller/db/mysql/config"
 )
 
 var log = logging.MustGetLogger("tagrecorder")
 
+// schedulerJitter是Scheduler每次tick前随机等待的上限，避免HA部署下多个副本的ticker
+// 在同一时刻一起触发全量刷新
+const schedulerJitter = 5 * time.Second
+
 type TagRecorder struct {
 	cfg config.ControllerConfig
+	db  *gorm.DB
+
+	cancel    context.CancelFunc
+	elector   *redisLeaderElector
+	scheduler *Scheduler
 }
 
 func NewTagRecorder(cfg config.ControllerConfig) *TagRecorder {
-	return &TagRecorder{cfg: cfg}
+	db, err := newMySQLClient(cfg.MySqlCfg)
+	if err != nil {
+		// 连不上MySQL不阻止进程起来——ch_*更新器在每次Refresh时会各自报错，但其它不依赖MySQL的
+		// 子系统（leader election、scheduler本身）应该照常运行
+		log.Errorf("tagrecorder: connect mysql failed: %s", err)
+	}
+	return &TagRecorder{cfg: cfg, db: db}
+}
+
+// newMySQLClient按MySqlCfg里的连接信息创建一个gorm Client，ch_*更新器读写各自的MySQL
+// 备份表都复用这一个连接
+func newMySQLClient(cfg mysqlconfig.MySqlConfig) (*gorm.DB, error) {
+	dsn := fmt.Sprintf("%s:%s@tcp(%s:%d)/%s?charset=utf8mb4&parseTime=True&loc=Local",
+		cfg.UserName, cfg.Password, cfg.Host, cfg.Port, cfg.Database)
+	return gorm.Open(mysql.Open(dsn), &gorm.Config{})
 }
 
-// 每次执行需要做的事情
-func (c *TagRecorder) run() {
+// run是Scheduler每个interval调用的一次完整执行：刷新ch字典、取最新icon信息、跑一遍
+// registry里所有updater，返回一份结构化的RunReport供调用方记录
+func (c *TagRecorder) run(ctx context.Context) RunReport {
+	startedAt := time.Now()
 	log.Info("tagrecorder run")
 
 	// 连接数据节点刷新ClickHouse中的字典定义
 	c.UpdateChDictionary()
 	// 调用API获取资源对应的icon_id
 	domainToIconID, resourceToIconID, _ := c.UpdateIconInfo()
-	c.refresh(domainToIconID, resourceToIconID)
+	updaters := c.refresh(ctx, domainToIconID, resourceToIconID)
+
+	report := RunReport{StartedAt: startedAt, Duration: time.Since(startedAt), Updaters: updaters}
+	recordRunReport(report)
+	return report
 }
 
 func (c *TagRecorder) Start() {
-	go func() {
-		for range time.Tick(time.Duration(c.cfg.TagRecorderCfg.Interval) * time.Second) {
-			c.run()
+	ctx, cancel := context.WithCancel(context.Background())
+	c.cancel = cancel
+	go c.watchChanges(ctx)
+
+	interval := time.Duration(c.cfg.TagRecorderCfg.Interval) * time.Second
+	elecCfg := c.cfg.TagRecorderCfg.LeaderElection
+	if !elecCfg.Enabled {
+		c.scheduler = NewScheduler(interval, schedulerJitter, c.run)
+		c.scheduler.Start(ctx)
+		return
+	}
+
+	// 开启了leader election时，只有抢到锁的副本会跑run()，其余副本只消费changeCh保持热身，
+	// 一旦当前leader失联，某个follower会在一个LeaseDuration内接管，不用等完整Interval
+	c.elector = newRedisLeaderElector(
+		newRedisClient(c.cfg.RedisCfg),
+		elecCfg.LockKey,
+		time.Duration(elecCfg.LeaseDuration)*time.Second,
+		time.Duration(elecCfg.RetryPeriod)*time.Second,
+	)
+	go c.elector.Run(ctx, leaderCallbacks{
+		OnStartedLeading: func(leadingCtx context.Context) {
+			c.scheduler = NewScheduler(interval, schedulerJitter, c.run)
+			c.run(leadingCtx)
+			c.scheduler.Start(leadingCtx)
+		},
+		OnStoppedLeading: func() {
+			log.Info("tagrecorder: lost leadership, pausing refresh until leadership is regained")
+			if c.scheduler != nil {
+				c.scheduler.Stop()
+			}
+		},
+	})
+}
+
+// Stop让TagRecorder的全部后台goroutine尽快退出：先取消ctx，再等Scheduler里可能还在跑的
+// run()完全drain完，最后在开启了leader election且当前持有锁时主动释放租约，这样接手的
+// 副本不用等到租约自然过期（LeaseDuration）才能抢到锁
+func (c *TagRecorder) Stop(ctx context.Context) {
+	if c.cancel != nil {
+		c.cancel()
+	}
+	if c.scheduler != nil {
+		c.scheduler.Stop()
+	}
+	if c.elector != nil {
+		if err := c.elector.Release(ctx); err != nil {
+			log.Warningf("tagrecorder leader election: release lease failed: %s", err)
+		}
+	}
+}
+
+// watchChanges消费Notify发布的change事件：命中依赖该ResourceType的updater时，按各自的
+// MinInterval立即触发一次Refresh，而不用等到下一轮按Interval触发的全量run()。周期性run()
+// 仍然保留作为兜底，对refresh()内置的那批updater补齐丢失的change事件以及没有声明DependsOn的情况
+func (c *TagRecorder) watchChanges(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case change := <-changeCh:
+			now := time.Now()
+			for _, ru := range defaultRegistry.matching(change.ResourceType) {
+				if ru.runIfDue(ctx, now) {
+					log.Infof("tagrecorder: %s changed, refreshed a dependent updater ahead of schedule", change.ResourceType)
+				}
+			}
 		}
-	}()
+	}
 }
 
-func (c *TagRecorder) refresh(domainLcuuidToIconID map[string]int, resourceTypeToIconID map[IconKey]int) {
-	// 生成各资源更新器，刷新ch数据
-	updaters := []ChResourceUpdater{
-		NewChRegion(domainLcuuidToIconID, resourceTypeToIconID),
-		NewChAZ(domainLcuuidToIconID, resourceTypeToIconID),
-		NewChVPC(resourceTypeToIconID),
-		NewChDevice(resourceTypeToIconID),
-		NewChIPRelation(),
-		NewChDevicePort(),
-		NewChPodPort(),
-		NewChPodNodePort(),
-		NewChPodGroupPort(),
-		NewChIPPort(),
-		NewChK8sLabel(),
-		NewChK8sLabels(),
-		NewChVTapPort(),
-		NewChNetwork(resourceTypeToIconID),
-		NewChTapType(resourceTypeToIconID),
-		NewChVTap(resourceTypeToIconID),
-		NewChPod(resourceTypeToIconID),
-		NewChPodCluster(resourceTypeToIconID),
-		NewChPodGroup(resourceTypeToIconID),
-		NewChPodNamespace(resourceTypeToIconID),
-		NewChPodNode(resourceTypeToIconID),
-		NewChLbListener(resourceTypeToIconID),
-		NewChPodIngress(resourceTypeToIconID),
+func (c *TagRecorder) refresh(ctx context.Context, domainLcuuidToIconID map[string]int, resourceTypeToIconID map[IconKey]int) []UpdaterReport {
+	// 生成各资源更新器，刷新ch数据，同时把它们连同各自的调度选项登记进registry，
+	// 供watchChanges在两轮全量刷新之间按资源类型单独触发
+	specs := []updaterSpec{
+		{"ch_region", NewChRegion(domainLcuuidToIconID, resourceTypeToIconID), UpdaterOptions{DependsOn: []ResourceType{ResourceTypeRegion}}},
+		{"ch_az", NewChAZ(domainLcuuidToIconID, resourceTypeToIconID), UpdaterOptions{DependsOn: []ResourceType{ResourceTypeAZ}}},
+		{"ch_vpc", NewChVPC(resourceTypeToIconID), UpdaterOptions{DependsOn: []ResourceType{ResourceTypeVPC}}},
+		{"ch_device", NewChDevice(resourceTypeToIconID), UpdaterOptions{DependsOn: []ResourceType{ResourceTypeDevice}}},
+		{"ch_ip_relation", NewChIPRelation(), UpdaterOptions{MinInterval: 5 * time.Minute, DependsOn: []ResourceType{ResourceTypeIPRelation}}},
+		{"ch_device_port", NewChDevicePort(), UpdaterOptions{DependsOn: []ResourceType{ResourceTypeDevice}}},
+		{"ch_pod_port", NewChPodPort(), UpdaterOptions{DependsOn: []ResourceType{ResourceTypePod}}},
+		{"ch_pod_node_port", NewChPodNodePort(), UpdaterOptions{DependsOn: []ResourceType{ResourceTypePodNode}}},
+		{"ch_pod_group_port", NewChPodGroupPort(), UpdaterOptions{DependsOn: []ResourceType{ResourceTypePodGroup}}},
+		{"ch_ip_port", NewChIPPort(), UpdaterOptions{MinInterval: time.Minute, DependsOn: []ResourceType{ResourceTypeIPRelation}}},
+		{"ch_k8s_label", NewChK8sLabel(), UpdaterOptions{DependsOn: []ResourceType{ResourceTypeK8sLabel}}},
+		{"ch_k8s_labels", NewChK8sLabels(), UpdaterOptions{DependsOn: []ResourceType{ResourceTypeK8sLabel}}},
+		{"ch_vtap_port", NewChVTapPort(), UpdaterOptions{DependsOn: []ResourceType{ResourceTypeVTap}}},
+		{"ch_network", NewChNetwork(resourceTypeToIconID), UpdaterOptions{DependsOn: []ResourceType{ResourceTypeNetwork}}},
+		{"ch_tap_type", NewChTapType(resourceTypeToIconID), UpdaterOptions{DependsOn: []ResourceType{ResourceTypeTapType}}},
+		{"ch_vtap", NewChVTap(resourceTypeToIconID), UpdaterOptions{DependsOn: []ResourceType{ResourceTypeVTap}}},
+		{"ch_pod", NewChPod(resourceTypeToIconID), UpdaterOptions{DependsOn: []ResourceType{ResourceTypePod}}},
+		{"ch_pod_cluster", NewChPodCluster(resourceTypeToIconID), UpdaterOptions{DependsOn: []ResourceType{ResourceTypePodCluster}}},
+		{"ch_pod_group", NewChPodGroup(resourceTypeToIconID), UpdaterOptions{DependsOn: []ResourceType{ResourceTypePodGroup}}},
+		{"ch_pod_namespace", NewChPodNamespace(resourceTypeToIconID), UpdaterOptions{DependsOn: []ResourceType{ResourceTypePodNamespace}}},
+		{"ch_pod_node", NewChPodNode(resourceTypeToIconID), UpdaterOptions{DependsOn: []ResourceType{ResourceTypePodNode}}},
+		{"ch_lb_listener", NewChLbListener(resourceTypeToIconID), UpdaterOptions{DependsOn: []ResourceType{ResourceTypeLbListener}}},
+		{"ch_pod_ingress", NewChPodIngress(resourceTypeToIconID), UpdaterOptions{DependsOn: []ResourceType{ResourceTypePodIngress}}},
+		{"ch_net_interface", NewChNetInterface(c.db, resourceTypeToIconID), UpdaterOptions{DependsOn: []ResourceType{ResourceTypeVTap}}},
 	}
 	if c.cfg.RedisCfg.Enabled {
-		updaters = append(updaters, NewChIPResource())
+		specs = append(specs, updaterSpec{"ch_ip_resource", NewChIPResource(), UpdaterOptions{MinInterval: 5 * time.Minute, DependsOn: []ResourceType{ResourceTypeIPResource}}})
 	}
-	for _, updater := range updaters {
-		updater.Refresh()
+
+	reports := make([]UpdaterReport, 0, len(specs))
+	for _, spec := range specs {
+		if ctx.Err() != nil {
+			log.Infof("tagrecorder refresh: %s, aborting remaining updaters", ctx.Err())
+			break
+		}
+		started := time.Now()
+		rows, err := spec.Updater.Refresh(ctx)
+		report := UpdaterReport{Name: spec.Name, Duration: time.Since(started), Rows: rows, Err: err}
+		recordUpdaterReport(report)
+		reports = append(reports, report)
 	}
+	defaultRegistry.replace(specs, time.Now())
+	return reports
 }
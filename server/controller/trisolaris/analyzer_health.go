@@ -0,0 +1,281 @@
+/*
+ * Copyright (c) 2022 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package trisolaris
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	analyzerHealthCheckInterval = 10 * time.Second
+	analyzerHealthCheckTimeout  = 3 * time.Second
+	analyzerHealthCheckPort     = 20418 // analyzer健康检查HTTP端口，和agent用的analyzer_port(gRPC/数据口)分开
+	analyzerHealthCheckRetries  = 2
+	analyzerHealthCheckBackoff  = time.Second
+
+	analyzerHealthEWMAAlpha     = 0.3
+	analyzerHealthLatencyNormMs = 200.0 // 超过这个延迟基本上打最低分，纯粹是个经验值
+
+	analyzerHealthSwapThreshold  = 0.5  // 分数跌破这个值才考虑把AnalyzerIp换掉
+	analyzerHealthSwapHysteresis = 0.15 // 候选分数要比当前高出这么多才真的换，避免阈值附近来回抖动
+)
+
+// analyzerHealthPayload是analyzer的/v1/health/接口返回的小JSON，load是0~1的已用资源占比
+type analyzerHealthPayload struct {
+	Load float64 `json:"load"`
+}
+
+// AnalyzerHealth是一个analyzer的滚动健康评分快照，HTTP API和generateConfigInfo都读这个
+type AnalyzerHealth struct {
+	IP           string
+	Available    bool
+	SuccessRate  float64
+	P95LatencyMs float64
+	Load         float64
+	Score        float64
+	LastProbedAt time.Time
+}
+
+// analyzerHealthState是单个analyzer的健康探测运行时状态：成功率和延迟都用EWMA平滑，延迟EWMA
+// 当p95的近似值用——controller/common里那套统一健康检查实现会用滑动窗口算真实分位数，这里为了
+// 不引入额外依赖先用EWMA顶一阵，后续要对齐可以直接替换latencyEWMAMs这一项的算法
+type analyzerHealthState struct {
+	mu sync.Mutex
+
+	initialized     bool
+	available       bool
+	successRateEWMA float64
+	latencyEWMAMs   float64
+	load            float64
+	lastProbedAt    time.Time
+}
+
+var (
+	analyzerHealthMu     sync.Mutex
+	analyzerHealthStates = make(map[string]*analyzerHealthState)
+)
+
+func getAnalyzerHealthState(ip string) *analyzerHealthState {
+	analyzerHealthMu.Lock()
+	defer analyzerHealthMu.Unlock()
+	s, ok := analyzerHealthStates[ip]
+	if !ok {
+		s = &analyzerHealthState{}
+		analyzerHealthStates[ip] = s
+	}
+	return s
+}
+
+// scoreLocked要求调用方已经持有state.mu；analyzer不可达时直接打0分，让它排到候选名单最后面
+func (s *analyzerHealthState) scoreLocked() float64 {
+	if !s.available {
+		return 0
+	}
+	latencyScore := 1 - s.latencyEWMAMs/analyzerHealthLatencyNormMs
+	if latencyScore < 0 {
+		latencyScore = 0
+	}
+	loadScore := 1 - s.load
+	if loadScore < 0 {
+		loadScore = 0
+	}
+	return s.successRateEWMA*0.6 + latencyScore*0.3 + loadScore*0.1
+}
+
+func (s *analyzerHealthState) score() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.scoreLocked()
+}
+
+func (s *analyzerHealthState) snapshot(ip string) AnalyzerHealth {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return AnalyzerHealth{
+		IP:           ip,
+		Available:    s.available,
+		SuccessRate:  s.successRateEWMA,
+		P95LatencyMs: s.latencyEWMAMs,
+		Load:         s.load,
+		Score:        s.scoreLocked(),
+		LastProbedAt: s.lastProbedAt,
+	}
+}
+
+// probeAnalyzer对一个analyzer的/v1/health/做一次探测，失败按analyzerHealthCheckRetries带退避
+// 重试；探测结果（成功与否、延迟、load）喂进这个analyzer的EWMA状态
+func probeAnalyzer(ip string) {
+	url := fmt.Sprintf("http://%s:%d/v1/health/", ip, analyzerHealthCheckPort)
+	client := &http.Client{Timeout: analyzerHealthCheckTimeout}
+
+	var (
+		resp    *http.Response
+		err     error
+		elapsed time.Duration
+	)
+	for attempt := 0; attempt <= analyzerHealthCheckRetries; attempt++ {
+		start := time.Now()
+		resp, err = client.Get(url)
+		elapsed = time.Since(start)
+		if err == nil && resp.StatusCode == http.StatusOK {
+			break
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+		if attempt < analyzerHealthCheckRetries {
+			time.Sleep(analyzerHealthCheckBackoff * time.Duration(attempt+1))
+		}
+	}
+
+	success := err == nil && resp != nil && resp.StatusCode == http.StatusOK
+	if !success {
+		log.Debugf("analyzer(%s) health probe failed after %d retries: %s", ip, analyzerHealthCheckRetries, err)
+	}
+	load := 0.0
+	if success {
+		var payload analyzerHealthPayload
+		if decodeErr := json.NewDecoder(resp.Body).Decode(&payload); decodeErr == nil {
+			load = payload.Load
+		}
+		resp.Body.Close()
+	}
+
+	state := getAnalyzerHealthState(ip)
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	state.lastProbedAt = time.Now()
+	state.available = success
+	if success {
+		state.load = load
+	}
+	sample := 0.0
+	if success {
+		sample = 1.0
+	}
+	if !state.initialized {
+		state.successRateEWMA = sample
+		state.latencyEWMAMs = float64(elapsed.Milliseconds())
+		state.initialized = true
+		return
+	}
+	state.successRateEWMA = analyzerHealthEWMAAlpha*sample + (1-analyzerHealthEWMAAlpha)*state.successRateEWMA
+	if success {
+		state.latencyEWMAMs = analyzerHealthEWMAAlpha*float64(elapsed.Milliseconds()) + (1-analyzerHealthEWMAAlpha)*state.latencyEWMAMs
+	}
+}
+
+// watchAnalyzerHealth每隔analyzerHealthCheckInterval对已知的全部analyzer并发探测一轮；没有
+// context可取消，进程退出前会一直跑
+func (t *Trisolaris) watchAnalyzerHealth() {
+	ticker := time.NewTicker(analyzerHealthCheckInterval)
+	defer ticker.Stop()
+	for {
+		for _, ip := range t.nodeInfo.GetAnalyzerIPs() {
+			go probeAnalyzer(ip)
+		}
+		<-ticker.C
+	}
+}
+
+// rankedHealthyAnalyzers返回健康分不低于analyzerHealthSwapThreshold的analyzer IP，按分数从高到
+// 低排序
+func rankedHealthyAnalyzers() []string {
+	analyzerHealthMu.Lock()
+	ips := make([]string, 0, len(analyzerHealthStates))
+	scores := make(map[string]float64, len(analyzerHealthStates))
+	for ip, state := range analyzerHealthStates {
+		sc := state.score()
+		if sc < analyzerHealthSwapThreshold {
+			continue
+		}
+		ips = append(ips, ip)
+		scores[ip] = sc
+	}
+	analyzerHealthMu.Unlock()
+	sort.Slice(ips, func(i, j int) bool { return scores[ips[i]] > scores[ips[j]] })
+	return ips
+}
+
+// GetAnalyzerHealthScore给老版本agent的单IP failover逻辑查当前analyzer的健康分；这个analyzer
+// 还没被探测过时返回0，让调用方当成不健康处理，优先换到一个已经探测出分数的候选
+func GetAnalyzerHealthScore(ip string) float64 {
+	analyzerHealthMu.Lock()
+	state, ok := analyzerHealthStates[ip]
+	analyzerHealthMu.Unlock()
+	if !ok {
+		return 0
+	}
+	return state.score()
+}
+
+// PickFailoverAnalyzer在currentIP的健康分跌破阈值时，从排名靠前的健康analyzer里选一个顶替；
+// 候选分数要比当前高出analyzerHealthSwapHysteresis才真的换，防止两边分数接近时来回抖动。
+// currentIP本身健康、或者换不出明显更好的候选时原样返回currentIP
+func PickFailoverAnalyzer(currentIP string) string {
+	current := GetAnalyzerHealthScore(currentIP)
+	if current >= analyzerHealthSwapThreshold {
+		return currentIP
+	}
+	for _, ip := range rankedHealthyAnalyzers() {
+		if ip == currentIP {
+			continue
+		}
+		if GetAnalyzerHealthScore(ip) >= current+analyzerHealthSwapHysteresis {
+			return ip
+		}
+	}
+	return currentIP
+}
+
+// GetAnalyzerHealthTable列出全部analyzer当前健康快照，按IP排序保证同一份状态两次查询输出稳定，
+// 方便AnalyzerHealthHandler的返回结果做diff
+func GetAnalyzerHealthTable() []AnalyzerHealth {
+	analyzerHealthMu.Lock()
+	ips := make([]string, 0, len(analyzerHealthStates))
+	states := make([]*analyzerHealthState, 0, len(analyzerHealthStates))
+	for ip, state := range analyzerHealthStates {
+		ips = append(ips, ip)
+		states = append(states, state)
+	}
+	analyzerHealthMu.Unlock()
+
+	sort.Slice(ips, func(i, j int) bool { return ips[i] < ips[j] })
+	stateByIP := make(map[string]*analyzerHealthState, len(ips))
+	for i, ip := range ips {
+		stateByIP[ip] = states[i]
+	}
+
+	table := make([]AnalyzerHealth, 0, len(ips))
+	for _, ip := range ips {
+		table = append(table, stateByIP[ip].snapshot(ip))
+	}
+	return table
+}
+
+// AnalyzerHealthHandler供/v1/analyzers/health接口使用，返回GetAnalyzerHealthTable的快照，
+// 和HealthLeaderHandler、KubernetesInfo.LintHandler一样是个纯net/http handler，由controller
+// HTTP路由框架负责挂载
+func AnalyzerHealthHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(GetAnalyzerHealthTable())
+}
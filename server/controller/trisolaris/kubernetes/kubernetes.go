@@ -17,6 +17,8 @@
 package kubernetes
 
 import (
+	"context"
+	"math/rand"
 	"sync"
 	"time"
 
@@ -25,12 +27,21 @@ import (
 
 	. "github.com/deepflowys/deepflow/server/controller/common"
 	models "github.com/deepflowys/deepflow/server/controller/db/mysql"
+	"github.com/deepflowys/deepflow/server/controller/election"
+	"github.com/deepflowys/deepflow/server/controller/events"
 	"github.com/deepflowys/deepflow/server/controller/model"
 	"github.com/deepflowys/deepflow/server/controller/service"
 	"github.com/deepflowys/deepflow/server/controller/trisolaris/config"
 	"github.com/deepflowys/deepflow/server/controller/trisolaris/dbmgr"
 )
 
+// createDomainFailureEventThreshold是建域连续失败多少次之后才发DomainAutoCreateFailed事件，
+// 单次网络抖动没必要打扰operator
+const createDomainFailureEventThreshold = 5
+
+// createDomainMaxBackoff是退避等待的上限，避免attempts堆多了之后等待时间失控
+const createDomainMaxBackoff = time.Minute * 5
+
 var log = logging.MustGetLogger("trisolaris.kubernetes")
 
 type KubernetesInfo struct {
@@ -38,6 +49,15 @@ type KubernetesInfo struct {
 	clusterIDToDomain map[string]string
 	db                *gorm.DB
 	cfg               *config.Config
+
+	// leaderCtx是最近一次OnAcquired拿到的ctx，失去leader身份时会被election包cancel；
+	// 没当过leader之前是nil，这种情况下createDomain的重试协程也不会被启动（follower上
+	// 建不了域，等到自己真的当选再补跑）
+	leaderCtx context.Context
+
+	// reconcileCfg、lastReport供Reconcile/LintHandler使用，参见lint.go
+	reconcileCfg ReconcileConfig
+	lastReport   Report
 }
 
 func NewKubernetesInfo(db *gorm.DB, cfg *config.Config) *KubernetesInfo {
@@ -48,30 +68,132 @@ func NewKubernetesInfo(db *gorm.DB, cfg *config.Config) *KubernetesInfo {
 		clusterIDToDomain[dbDomain.ClusterID] = dbDomain.Lcuuid
 	}
 
-	return &KubernetesInfo{clusterIDToDomain: clusterIDToDomain, cfg: cfg, db: db}
+	k := &KubernetesInfo{clusterIDToDomain: clusterIDToDomain, cfg: cfg, db: db, reconcileCfg: DefaultReconcileConfig()}
+	election.RegisterCallbacks("trisolaris.kubernetes", k)
+	return k
+}
+
+// OnAcquired实现election.Callbacks：补跑所有还没建出域、且还没有重试协程在跑的cluster_id，
+// 这样即便这些cluster_id是在本进程还是follower的时候被CacheClusterID记下来的，当选之后也会
+// 被捡起来继续建域，而不需要等下一次agent重新上报；同时起一个Reconcile循环，原理和重试协程一样
+// 只在leader上跑，ctx被cancel时自行退出
+func (k *KubernetesInfo) OnAcquired(ctx context.Context) {
+	go k.Reconcile(ctx)
+
+	k.mutex.Lock()
+	k.leaderCtx = ctx
+	pending := make([]string, 0)
+	for clusterID, domain := range k.clusterIDToDomain {
+		if domain == "" {
+			pending = append(pending, clusterID)
+		}
+	}
+	k.mutex.Unlock()
+
+	for _, clusterID := range pending {
+		k.startCreateDomainRetry(ctx, clusterID)
+	}
 }
 
+// OnLost实现election.Callbacks：leaderCtx已经被election包cancel掉了，正在跑的重试协程会
+// 在下一次循环检查ctx.Done()时自行退出，这里只需要清掉引用
+func (k *KubernetesInfo) OnLost() {
+	k.mutex.Lock()
+	k.leaderCtx = nil
+	k.mutex.Unlock()
+}
+
+func (k *KubernetesInfo) OnObservedLeader(id string) {}
+
 func (k *KubernetesInfo) CacheClusterID(clusterID string) {
 	log.Infof("start cache cluster_id (%s)", clusterID)
 	k.mutex.Lock()
 	_, ok := k.clusterIDToDomain[clusterID]
+	leaderCtx := k.leaderCtx
 	if !ok {
 		k.clusterIDToDomain[clusterID] = ""
 		log.Infof("cache cluster_id (%s)", clusterID)
-		go func() {
-			for k.clusterIDToDomain[clusterID] == "" {
-				domainLcuuid, err := k.createDomain(clusterID)
-				if err != nil {
-					log.Errorf("auto create domain failed: %v", err)
-					time.Sleep(time.Second * 30)
-				} else {
-					k.clusterIDToDomain[clusterID] = domainLcuuid
+	}
+	k.mutex.Unlock()
+
+	// 本进程还不是leader时先不起重试协程，等OnAcquired那边补跑；已经是leader就立刻开始
+	if !ok && leaderCtx != nil {
+		k.startCreateDomainRetry(leaderCtx, clusterID)
+	}
+}
+
+// startCreateDomainRetry反复尝试建域，直到建成功或者ctx被cancel（失去leader身份）为止。连续
+// 失败次数达到createDomainFailureEventThreshold之后，每次失败都会发一条DomainAutoCreateFailed
+// 事件带上cluster_id/controller_ip/region/尝试次数和具体错误，让operator不用盯日志也能发现这种
+// "一直建不出域"的情况；退避也从固定30秒换成了带抖动的指数退避，避免大量cluster_id同时卡住时
+// 对DB/其它controller造成节奏一致的重试风暴
+func (k *KubernetesInfo) startCreateDomainRetry(ctx context.Context, clusterID string) {
+	go func() {
+		attempt := 0
+		for {
+			k.mutex.RLock()
+			domain := k.clusterIDToDomain[clusterID]
+			k.mutex.RUnlock()
+			if domain != "" {
+				return
+			}
+
+			domainLcuuid, err := k.createDomain(clusterID)
+			if err != nil {
+				attempt++
+				log.Errorf("auto create domain failed: %v", err)
+				if attempt >= createDomainFailureEventThreshold {
+					events.Publish(events.DomainAutoCreateFailed, map[string]interface{}{
+						"cluster_id":    clusterID,
+						"controller_ip": k.cfg.NodeIP,
+						"region":        k.regionForClusterEvent(),
+						"attempt":       attempt,
+						"error":         err.Error(),
+					})
 				}
+				select {
+				case <-ctx.Done():
+					log.Infof("stop retrying auto create domain (cluster_id: %s): lost leadership", clusterID)
+					return
+				case <-time.After(createDomainBackoff(attempt)):
+				}
+				continue
 			}
-		}()
+
+			k.mutex.Lock()
+			k.clusterIDToDomain[clusterID] = domainLcuuid
+			k.mutex.Unlock()
+			events.Publish(events.DomainAutoCreated, map[string]interface{}{
+				"cluster_id":    clusterID,
+				"controller_ip": k.cfg.NodeIP,
+				"domain_lcuuid": domainLcuuid,
+				"attempt":       attempt + 1,
+			})
+			return
+		}
+	}()
+}
+
+// createDomainBackoff实现带全抖动(full jitter)的指数退避：base是2^attempt秒，封顶
+// createDomainMaxBackoff，再在[0, base)里随机取一个值，避免同时卡住的多个cluster_id每次
+// 都在同一时刻一起重试
+func createDomainBackoff(attempt int) time.Duration {
+	base := time.Second * time.Duration(1<<uint(attempt))
+	if base > createDomainMaxBackoff || base <= 0 {
+		base = createDomainMaxBackoff
 	}
-	k.mutex.Unlock()
-	return
+	return time.Duration(rand.Int63n(int64(base)))
+}
+
+// regionForClusterEvent尽力拿到本controller所在的region_uuid，只是给DomainAutoCreateFailed
+// 事件提供上下文，拿不到就留空，不影响重试本身
+func (k *KubernetesInfo) regionForClusterEvent() string {
+	azConMgr := dbmgr.DBMgr[models.AZControllerConnection](k.db)
+	azConn, err := azConMgr.GetFromControllerIP(k.cfg.NodeIP)
+	if err != nil {
+		return ""
+	}
+	return azConn.Region
 }
 
 func (k *KubernetesInfo) createDomain(clusterID string) (domainLcuuid string, err error) {
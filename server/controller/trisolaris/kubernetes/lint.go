@@ -0,0 +1,236 @@
+/*
+ * Copyright (c) 2022 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kubernetes
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	models "github.com/deepflowys/deepflow/server/controller/db/mysql"
+	"github.com/deepflowys/deepflow/server/controller/events"
+	"github.com/deepflowys/deepflow/server/controller/trisolaris/dbmgr"
+)
+
+// Severity和cloud/lint里的定义同构，但这里检查的是controller自己的域-集群映射，跟采集到的
+// KubernetesGatherResource没有关系，所以没有直接复用那个包的类型
+type Severity uint8
+
+const (
+	SeverityInfo Severity = iota
+	SeverityWarning
+	SeverityError
+)
+
+var severityStrings = []string{
+	SeverityInfo:    "info",
+	SeverityWarning: "warning",
+	SeverityError:   "error",
+}
+
+func (s Severity) String() string {
+	if int(s) >= len(severityStrings) {
+		return "unknown"
+	}
+	return severityStrings[s]
+}
+
+// Finding是Reconcile单次扫描命中的一条问题
+type Finding struct {
+	RuleID    string   `json:"rule_id"`
+	Severity  Severity `json:"severity"`
+	ClusterID string   `json:"cluster_id,omitempty"`
+	Domain    string   `json:"domain,omitempty"`
+	Message   string   `json:"message"`
+}
+
+// Report是/v1/kubernetes/lint返回的内容，GeneratedAt方便operator判断这份报告是不是刚跑出来的
+type Report struct {
+	GeneratedAt time.Time `json:"generated_at"`
+	Findings    []Finding `json:"findings"`
+}
+
+// ReconcileConfig控制Reconcile循环的开关和节奏。这些字段理想状态下应该挂在trisolaris/config.Config
+// 下面的kubernetes小节里，但那个包不在这份代码快照里，所以先把默认值写死在这里，等config包补上之后
+// 把这几个字段搬过去、NewKubernetesInfo从cfg读取即可
+type ReconcileConfig struct {
+	Enabled bool
+	// Interval是两次扫描之间的间隔
+	Interval time.Duration
+	// StaleAfter是一个cluster_id连续多久没有新的vtap心跳之后，关联的域会被dangling-domain规则命中
+	StaleAfter time.Duration
+	// Disabled按RuleID禁用某条检查
+	Disabled []string
+}
+
+func DefaultReconcileConfig() ReconcileConfig {
+	return ReconcileConfig{
+		Enabled:    true,
+		Interval:   time.Minute * 10,
+		StaleAfter: time.Hour * 24,
+	}
+}
+
+func (c ReconcileConfig) isDisabled(ruleID string) bool {
+	for _, id := range c.Disabled {
+		if id == ruleID {
+			return true
+		}
+	}
+	return false
+}
+
+// Reconcile周期性扫描数据库里全部KUBERNETES类型的域，发现四类问题：域没有任何活跃agent在上报（dangling）、
+// 同一个cluster_id被绑定到了不止一个controller_ip（collision，理论上不该发生，出现了大概率是
+// 手工改过库或者两个controller同时抢到了createDomain的竞态）、域的controller_ip已经不在
+// AZControllerConnection里了（controller被换掉/缩容但域没有跟着迁走）、域缺少region_uuid
+// （createDomain半途失败或者手工建域漏填）。按cfg.Interval跑在ctx（通常是leaderCtx）上，
+// ctx被cancel时退出——非leader副本不需要跑这个
+func (k *KubernetesInfo) Reconcile(ctx context.Context) {
+	if !k.reconcileCfg.Enabled {
+		return
+	}
+	ticker := time.NewTicker(k.reconcileCfg.Interval)
+	defer ticker.Stop()
+	for {
+		k.runReconcileOnce()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (k *KubernetesInfo) runReconcileOnce() {
+	findings := k.lint()
+
+	k.mutex.Lock()
+	k.lastReport = Report{GeneratedAt: time.Now(), Findings: findings}
+	k.mutex.Unlock()
+
+	if len(findings) == 0 {
+		log.Info("kubernetes domain reconcile: no issues found")
+		return
+	}
+	log.Warningf("kubernetes domain reconcile: %d issue(s) found", len(findings))
+	for _, f := range findings {
+		log.Warningf("[%s][%s] cluster_id=%s domain=%s: %s", f.Severity, f.RuleID, f.ClusterID, f.Domain, f.Message)
+	}
+}
+
+func (k *KubernetesInfo) lint() []Finding {
+	cfg := k.reconcileCfg
+	findings := make([]Finding, 0)
+
+	DomainMgr := dbmgr.DBMgr[models.Domain](k.db)
+	dbDomains, err := DomainMgr.GetBatchFromTypes([]int{KUBERNETES})
+	if err != nil {
+		log.Errorf("kubernetes domain reconcile: failed to load domains: %v", err)
+		return findings
+	}
+
+	var azConns []models.AZControllerConnection
+	if err := k.db.Find(&azConns).Error; err != nil {
+		log.Errorf("kubernetes domain reconcile: failed to load az controller connections: %v", err)
+		return findings
+	}
+	liveControllerIPs := make(map[string]bool, len(azConns))
+	for _, c := range azConns {
+		liveControllerIPs[c.ControllerIP] = true
+	}
+
+	clusterIDToControllerIPs := make(map[string]map[string]bool)
+	for _, d := range dbDomains {
+		if !cfg.isDisabled("missing-region-uuid") && d.RegionUUID == "" {
+			findings = append(findings, Finding{
+				RuleID: "missing-region-uuid", Severity: SeverityWarning,
+				ClusterID: d.ClusterID, Domain: d.Lcuuid,
+				Message: "domain has no region_uuid, it was likely left half-created by a failed auto-create",
+			})
+		}
+
+		if !cfg.isDisabled("controller-ip-not-live") && d.ControllerIP != "" && !liveControllerIPs[d.ControllerIP] {
+			findings = append(findings, Finding{
+				RuleID: "controller-ip-not-live", Severity: SeverityError,
+				ClusterID: d.ClusterID, Domain: d.Lcuuid,
+				Message: "domain's controller_ip does not resolve to any live az_controller_connection",
+			})
+		}
+
+		if clusterIDToControllerIPs[d.ClusterID] == nil {
+			clusterIDToControllerIPs[d.ClusterID] = make(map[string]bool)
+		}
+		clusterIDToControllerIPs[d.ClusterID][d.ControllerIP] = true
+
+		if !cfg.isDisabled("dangling-domain") && k.isClusterStale(d.ClusterID, cfg.StaleAfter) {
+			findings = append(findings, Finding{
+				RuleID: "dangling-domain", Severity: SeverityWarning,
+				ClusterID: d.ClusterID, Domain: d.Lcuuid,
+				Message: "no agent has reported against this cluster_id recently, the domain may be orphaned",
+			})
+		}
+	}
+
+	if !cfg.isDisabled("cluster-id-collision") {
+		for clusterID, ips := range clusterIDToControllerIPs {
+			if len(ips) > 1 {
+				findings = append(findings, Finding{
+					RuleID: "cluster-id-collision", Severity: SeverityError,
+					ClusterID: clusterID,
+					Message:   "cluster_id is bound to more than one controller_ip",
+				})
+				controllerIPs := make([]string, 0, len(ips))
+				for ip := range ips {
+					controllerIPs = append(controllerIPs, ip)
+				}
+				events.Publish(events.ClusterIDCollisionDetected, map[string]interface{}{
+					"cluster_id":     clusterID,
+					"controller_ips": controllerIPs,
+				})
+			}
+		}
+	}
+
+	return findings
+}
+
+// isClusterStale检查一个cluster_id下面最近的vtap心跳是否超过了staleAfter，没有任何vtap记录
+// 也算stale
+func (k *KubernetesInfo) isClusterStale(clusterID string, staleAfter time.Duration) bool {
+	var vtap models.VTap
+	err := k.db.Where("cluster_id = ?", clusterID).Order("synced_controller_at desc").First(&vtap).Error
+	if err != nil {
+		return true
+	}
+	return time.Since(vtap.SyncedControllerAt) > staleAfter
+}
+
+// LatestReport返回最近一次Reconcile的结果，在收到第一次结果之前Findings是nil
+func (k *KubernetesInfo) LatestReport() Report {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+	return k.lastReport
+}
+
+// LintHandler是挂在controller HTTP server上的/v1/kubernetes/lint接口：返回最近一次Reconcile
+// 扫描出的问题列表，不会触发一次新的扫描（扫描成本不低，交给后台的Reconcile循环按Interval跑）
+func (k *KubernetesInfo) LintHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(k.LatestReport())
+}
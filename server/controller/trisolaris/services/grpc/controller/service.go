@@ -17,16 +17,24 @@
 package controller
 
 import (
+	"encoding/json"
+
+	"github.com/golang/protobuf/proto"
+
 	api "github.com/deepflowys/deepflow/message/controller"
+	"github.com/deepflowys/deepflow/server/controller/cloud"
+	"github.com/deepflowys/deepflow/server/controller/cloud/lint"
 	"github.com/deepflowys/deepflow/server/controller/genesis"
 	grpcserver "github.com/deepflowys/deepflow/server/controller/grpc"
+	"github.com/deepflowys/deepflow/server/controller/livestatereporter"
 
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
 )
 
 type service struct {
-	encryptKeyEvent *EncryptKeyEvent
+	encryptKeyEvent   *EncryptKeyEvent
+	liveStateReporter *livestatereporter.Reporter
 }
 
 func init() {
@@ -35,7 +43,8 @@ func init() {
 
 func newService() *service {
 	return &service{
-		encryptKeyEvent: NewEncryptKeyEvent(),
+		encryptKeyEvent:   NewEncryptKeyEvent(),
+		liveStateReporter: livestatereporter.NewReporter(),
 	}
 }
 
@@ -55,3 +64,72 @@ func (s *service) GenesisSharingK8S(ctx context.Context, in *api.GenesisSharingK
 func (s *service) GenesisSharingSync(ctx context.Context, in *api.GenesisSharingSyncRequest) (*api.GenesisSharingSyncResponse, error) {
 	return genesis.Synchronizer.GenesisSharingSync(ctx, in)
 }
+
+// ListClusterFindings把cloud.kubernetes_gather/lint跑出来的配置问题暴露给UI，
+// 不传cluster_lcuuid时返回当前进程内所有集群的结果
+func (s *service) ListClusterFindings(ctx context.Context, in *api.ListClusterFindingsRequest) (*api.ListClusterFindingsResponse, error) {
+	if lcuuid := in.GetClusterLcuuid(); lcuuid != "" {
+		findings := cloud.GetClusterFindings(lcuuid)
+		return &api.ListClusterFindingsResponse{
+			Findings: convertFindings(lcuuid, findings),
+		}, nil
+	}
+
+	response := &api.ListClusterFindingsResponse{}
+	for lcuuid, findings := range cloud.ListAllClusterFindings() {
+		response.Findings = append(response.Findings, convertFindings(lcuuid, findings)...)
+	}
+	return response, nil
+}
+
+// ReportLiveState以server-streaming的方式把集群资源推给调用方：Reporter轮询发现集群的resource
+// version有变化（经过debounce合并）时推一帧，每一帧带的都是该版本的完整资源，不是按对象算出的增量。
+// 首帧在调用方没有带last_version、或者带的last_version已经无法续传时Reset=true；last_version
+// 等于当前版本或前一个版本时首帧Reset=false。同一个集群已经有其它订阅者时，新订阅者要等到下一次
+// version变化才收到首帧
+func (s *service) ReportLiveState(in *api.ReportLiveStateRequest, stream api.Controller_ReportLiveStateServer) error {
+	sub := livestatereporter.Subscription{
+		ClusterLcuuid: in.GetClusterLcuuid(),
+		BaseVersion:   in.GetLastVersion(),
+	}
+	snapshotCh, cancel := s.liveStateReporter.Subscribe(sub)
+	defer cancel()
+
+	for {
+		select {
+		case snapshot, ok := <-snapshotCh:
+			if !ok {
+				return nil
+			}
+			if err := stream.Send(convertSnapshot(snapshot)); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		}
+	}
+}
+
+func convertSnapshot(snapshot livestatereporter.Snapshot) *api.ReportLiveStateResponse {
+	resourceJson, _ := json.Marshal(snapshot.Resource)
+	return &api.ReportLiveStateResponse{
+		ClusterLcuuid: proto.String(snapshot.ClusterLcuuid),
+		Version:       proto.Uint64(snapshot.Version),
+		Reset_:        proto.Bool(snapshot.Reset),
+		ResourceJson:  proto.String(string(resourceJson)),
+	}
+}
+
+func convertFindings(lcuuid string, findings []lint.Finding) []*api.ClusterFinding {
+	converted := make([]*api.ClusterFinding, 0, len(findings))
+	for _, f := range findings {
+		f := f
+		converted = append(converted, &api.ClusterFinding{
+			ClusterLcuuid: proto.String(lcuuid),
+			RuleId:        proto.String(f.RuleID),
+			Severity:      proto.String(f.Severity.String()),
+			Message:       proto.String(f.Message),
+		})
+	}
+	return converted
+}
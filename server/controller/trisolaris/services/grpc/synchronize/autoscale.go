@@ -0,0 +1,221 @@
+/*
+ * Copyright (c) 2022 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package synchronize
+
+import (
+	"sync"
+	"time"
+
+	"github.com/deepflowys/deepflow/server/controller/trisolaris"
+)
+
+// autoscaleEWMAAlpha是利用率EWMA的平滑系数，取值越大越贴近最近一次上报、越小越平滑；0.3是
+// HPA类场景里常见的折中取值，既不会被单次抖动带偏，也不会对持续几分钟的负载变化反应太迟钝
+const autoscaleEWMAAlpha = 0.3
+
+// AutoscalePolicy是挂在VTapGroup上的HPA风格弹性伸缩策略：和existing vtap group config放在
+// 一起管理更合适，这个快照里trisolaris/vtap的源码还没收录进来，没法把这个类型真正挂到group
+// 配置结构体上，先在唯一的调用方（synchronize包）里定义，等那边的源码补上直接复用这个定义即可。
+// Min*/Max*给出每个字段的伸缩上下界（静态DB值通常就是Max*，表示"没开自动伸缩时的默认上限"）
+type AutoscalePolicy struct {
+	Enabled bool
+
+	MinCpus uint32
+	MaxCpus uint32
+
+	MinMemory uint32 // 单位和vtapConfig.MaxMemory一致(MB)
+	MaxMemory uint32
+
+	MinThreadThreshold uint32
+	MaxThreadThreshold uint32
+
+	MinProcessThreshold uint32
+	MaxProcessThreshold uint32
+
+	TargetCPUUtilization float64 // 目标利用率，取值0~1
+	TargetMemUtilization float64
+	UtilizationBand      float64 // target附近的死区，利用率落在[target-band, target+band]内不触发伸缩
+	CooldownSeconds      uint32  // 两次伸缩动作之间的最小间隔
+	ScaleStep            float64 // 每次伸缩按当前effective值的这个比例调整，比如0.2表示±20%
+}
+
+// autoscaleState是单个vtap的伸缩运行时状态：EWMA利用率、冷却计时器、当前生效值。这组状态本来
+// 也该跟着vtap.VTapCache走（VTapCache本来就按vtap缓存运行时信息），同样因为vtap包的源码还没
+// 收录进来，先按vtapCacheKey在synchronize包里维护
+type autoscaleState struct {
+	mu          sync.Mutex
+	initialized bool
+
+	cpuUtilEWMA float64
+	memUtilEWMA float64
+	lastScaleAt time.Time
+
+	effectiveCpus             uint32
+	effectiveMemory           uint32
+	effectiveThreadThreshold  uint32
+	effectiveProcessThreshold uint32
+}
+
+// AutoscaleEffective是generateConfigInfo读取、也是给observability用的一份只读快照
+type AutoscaleEffective struct {
+	MaxCpus          uint32  `json:"max_cpus"`
+	MaxMemory        uint32  `json:"max_memory"`
+	ThreadThreshold  uint32  `json:"thread_threshold"`
+	ProcessThreshold uint32  `json:"process_threshold"`
+	CPUUtilization   float64 `json:"cpu_utilization"`
+	MemUtilization   float64 `json:"mem_utilization"`
+}
+
+var (
+	autoscaleStatesMu sync.Mutex
+	autoscaleStates   = make(map[string]*autoscaleState)
+)
+
+func getAutoscaleState(vtapCacheKey string) *autoscaleState {
+	autoscaleStatesMu.Lock()
+	defer autoscaleStatesMu.Unlock()
+	s, ok := autoscaleStates[vtapCacheKey]
+	if !ok {
+		s = &autoscaleState{}
+		autoscaleStates[vtapCacheKey] = s
+	}
+	return s
+}
+
+// observeAutoscale在每次Sync时用agent这次上报的cpu/mem利用率跑一轮EWMA和伸缩决策，在Sync
+// 里UpdateSystemInfoFromGrpc之后调用，和那个调用共用同一批agent自报的资源数据。policy为nil
+// 或未Enabled时直接跳过，不产生任何状态，generateConfigInfo那边按同样的判断回退到静态DB值
+func observeAutoscale(vtapCacheKey string, policy *AutoscalePolicy, cpuUtil, memUtil float64) {
+	if policy == nil || !policy.Enabled {
+		return
+	}
+	state := getAutoscaleState(vtapCacheKey)
+	action := decideAutoscale(policy, state, cpuUtil, memUtil, time.Now())
+	if action == "none" {
+		return
+	}
+	state.mu.Lock()
+	cpus, memory, threadThreshold, processThreshold :=
+		state.effectiveCpus, state.effectiveMemory, state.effectiveThreadThreshold, state.effectiveProcessThreshold
+	state.mu.Unlock()
+	log.Infof("vtap(%s) autoscale %s: max_cpus=%d max_memory=%d thread_threshold=%d process_threshold=%d",
+		vtapCacheKey, action, cpus, memory, threadThreshold, processThreshold)
+	trisolaris.PutVTapAutoscaleEvent(vtapCacheKey, action, cpus, memory, threadThreshold, processThreshold)
+}
+
+// decideAutoscale返回这次调用触发的动作："up"/"down"/"none"。首次调用只做初始化（把effective值
+// 设成policy给出的上限，EWMA设成这次的样本值），不触发伸缩，避免用单次样本就拉满或拉空
+func decideAutoscale(policy *AutoscalePolicy, state *autoscaleState, cpuUtil, memUtil float64, now time.Time) string {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	if !state.initialized {
+		state.cpuUtilEWMA = cpuUtil
+		state.memUtilEWMA = memUtil
+		state.effectiveCpus = policy.MaxCpus
+		state.effectiveMemory = policy.MaxMemory
+		state.effectiveThreadThreshold = policy.MaxThreadThreshold
+		state.effectiveProcessThreshold = policy.MaxProcessThreshold
+		state.initialized = true
+		return "none"
+	}
+
+	state.cpuUtilEWMA = autoscaleEWMAAlpha*cpuUtil + (1-autoscaleEWMAAlpha)*state.cpuUtilEWMA
+	state.memUtilEWMA = autoscaleEWMAAlpha*memUtil + (1-autoscaleEWMAAlpha)*state.memUtilEWMA
+
+	if now.Sub(state.lastScaleAt) < time.Duration(policy.CooldownSeconds)*time.Second {
+		return "none"
+	}
+
+	// 取cpu/mem两边偏差（EWMA减target）里较大的那个：任意一个资源吃紧都会扩容，两个都富余才缩容
+	cpuDeviation := state.cpuUtilEWMA - policy.TargetCPUUtilization
+	memDeviation := state.memUtilEWMA - policy.TargetMemUtilization
+	deviation := cpuDeviation
+	if memDeviation > deviation {
+		deviation = memDeviation
+	}
+
+	switch {
+	case deviation > policy.UtilizationBand:
+		state.scale(policy, true)
+		state.lastScaleAt = now
+		return "up"
+	case deviation < -policy.UtilizationBand:
+		state.scale(policy, false)
+		state.lastScaleAt = now
+		return "down"
+	default:
+		return "none"
+	}
+}
+
+// scale按policy.ScaleStep同时调整四个effective字段，调用方已经持有state.mu
+func (state *autoscaleState) scale(policy *AutoscalePolicy, up bool) {
+	state.effectiveCpus = scaleUint32(state.effectiveCpus, policy.ScaleStep, policy.MinCpus, policy.MaxCpus, up)
+	state.effectiveMemory = scaleUint32(state.effectiveMemory, policy.ScaleStep, policy.MinMemory, policy.MaxMemory, up)
+	state.effectiveThreadThreshold = scaleUint32(
+		state.effectiveThreadThreshold, policy.ScaleStep, policy.MinThreadThreshold, policy.MaxThreadThreshold, up)
+	state.effectiveProcessThreshold = scaleUint32(
+		state.effectiveProcessThreshold, policy.ScaleStep, policy.MinProcessThreshold, policy.MaxProcessThreshold, up)
+}
+
+func scaleUint32(current uint32, step float64, min, max uint32, up bool) uint32 {
+	delta := float64(current) * step
+	next := float64(current)
+	if up {
+		next += delta
+	} else {
+		next -= delta
+	}
+	if next < float64(min) {
+		next = float64(min)
+	}
+	if next > float64(max) {
+		next = float64(max)
+	}
+	return uint32(next)
+}
+
+// effectiveAutoscaleValues给generateConfigInfo用：policy未启用或者这个vtap还没跑过至少一轮
+// decideAutoscale（state没初始化）时ok=false，调用方应该继续用vtapConfig里的静态DB值
+func effectiveAutoscaleValues(vtapCacheKey string, policy *AutoscalePolicy) (*AutoscaleEffective, bool) {
+	if policy == nil || !policy.Enabled {
+		return nil, false
+	}
+	state := getAutoscaleState(vtapCacheKey)
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if !state.initialized {
+		return nil, false
+	}
+	return &AutoscaleEffective{
+		MaxCpus:          state.effectiveCpus,
+		MaxMemory:        state.effectiveMemory,
+		ThreadThreshold:  state.effectiveThreadThreshold,
+		ProcessThreshold: state.effectiveProcessThreshold,
+		CPUUtilization:   state.cpuUtilEWMA,
+		MemUtilization:   state.memUtilEWMA,
+	}, true
+}
+
+// AutoscaleSnapshot是控制器HTTP API用来对外暴露某个vtap当前生效值的入口；这个快照里controller
+// 的HTTP路由框架没有收录进来，没法把它注册成一个真正的handler，先导出这个查询函数，路由框架
+// 补上之后直接在对应的handler里调用它即可
+func AutoscaleSnapshot(vtapCacheKey, vtapGroupLcuuid string) (*AutoscaleEffective, bool) {
+	policy := trisolaris.GetGVTapInfo().GetAutoscalePolicy(vtapGroupLcuuid)
+	return effectiveAutoscaleValues(vtapCacheKey, policy)
+}
@@ -0,0 +1,239 @@
+/*
+ * Copyright (c) 2022 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package synchronize
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/google/cel-go/cel"
+	"github.com/prometheus/client_golang/prometheus"
+
+	api "github.com/deepflowys/deepflow/message/trident"
+	"github.com/deepflowys/deepflow/server/controller/trisolaris/vtap"
+)
+
+// ConfigOverrideRule是一条可以挂在VTapGroup或者全局trisolaris config上的CEL配置覆盖规则：
+// Expression是一个在下面configRuleActivation给出的变量集合下求值为bool的CEL表达式，求值为true时
+// 按Overrides把api.Config里对应的字段覆盖成规则给的值。这个类型按数据归属更应该放在vtap包里
+// 跟着VTapGroup/全局配置一起管理CRUD，这个快照里trisolaris/vtap的源码还没收录进来，先在唯一
+// 用到它的消费侧定义，等那边的源码补上之后直接复用这个定义即可。
+type ConfigOverrideRule struct {
+	ID         string
+	Expression string
+	Overrides  map[string]interface{}
+}
+
+var (
+	configRuleMatchedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "deepflow_trisolaris_config_rule_matched_total",
+		Help: "Times a CEL config override rule's match expression evaluated true, labeled by rule id.",
+	}, []string{"rule"})
+	configRuleSkippedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "deepflow_trisolaris_config_rule_skipped_total",
+		Help: "Times a CEL config override rule's match expression evaluated false, labeled by rule id.",
+	}, []string{"rule"})
+	configRuleErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "deepflow_trisolaris_config_rule_errors_total",
+		Help: "Compile/eval/apply errors hit while processing a CEL config override rule, labeled by rule id.",
+	}, []string{"rule"})
+)
+
+func init() {
+	prometheus.MustRegister(configRuleMatchedTotal, configRuleSkippedTotal, configRuleErrorsTotal)
+}
+
+// configRuleEnv声明CEL规则能引用的vtap属性，和configRuleActivation给出的key/类型一一对应
+var (
+	configRuleEnv     *cel.Env
+	configRuleEnvOnce sync.Once
+	configRuleEnvErr  error
+)
+
+func getConfigRuleEnv() (*cel.Env, error) {
+	configRuleEnvOnce.Do(func() {
+		configRuleEnv, configRuleEnvErr = cel.NewEnv(
+			cel.Variable("host", cel.StringType),
+			cel.Variable("os", cel.StringType),
+			cel.Variable("arch", cel.StringType),
+			cel.Variable("kernel_version", cel.StringType),
+			cel.Variable("revision", cel.StringType),
+			cel.Variable("vtap_type", cel.IntType),
+			cel.Variable("pod_cluster_id", cel.IntType),
+			cel.Variable("epc_id", cel.IntType),
+			cel.Variable("tap_mode", cel.IntType),
+			cel.Variable("cpu_num", cel.IntType),
+			cel.Variable("memory_size", cel.IntType),
+		)
+	})
+	return configRuleEnv, configRuleEnvErr
+}
+
+type compiledConfigRule struct {
+	expression string
+	program    cel.Program
+}
+
+var (
+	configRuleProgramMu    sync.Mutex
+	configRuleProgramCache = make(map[string]*compiledConfigRule)
+)
+
+// compileConfigRule编译（或者命中缓存）一条规则对应的cel.Program。缓存按规则ID索引，规则
+// 被编辑替换了表达式文本时，expression对不上直接当成新规则重新编译覆盖旧缓存项，不需要单独
+// 的失效通知
+func compileConfigRule(rule *ConfigOverrideRule) (cel.Program, error) {
+	configRuleProgramMu.Lock()
+	defer configRuleProgramMu.Unlock()
+
+	if cached, ok := configRuleProgramCache[rule.ID]; ok && cached.expression == rule.Expression {
+		return cached.program, nil
+	}
+
+	env, err := getConfigRuleEnv()
+	if err != nil {
+		return nil, fmt.Errorf("build cel env: %w", err)
+	}
+	ast, issues := env.Compile(rule.Expression)
+	if issues != nil && issues.Err() != nil {
+		return nil, fmt.Errorf("compile rule %s: %w", rule.ID, issues.Err())
+	}
+	program, err := env.Program(ast)
+	if err != nil {
+		return nil, fmt.Errorf("build program for rule %s: %w", rule.ID, err)
+	}
+	configRuleProgramCache[rule.ID] = &compiledConfigRule{expression: rule.Expression, program: program}
+	return program, nil
+}
+
+// configRuleActivation把generateConfigInfo已经在用的那组VTapCache访问器收集成CEL规则求值要用
+// 的activation变量集合
+func configRuleActivation(c *vtap.VTapCache) map[string]interface{} {
+	return map[string]interface{}{
+		"host":           c.GetVTapHost(),
+		"os":             c.GetVTapOS(),
+		"arch":           c.GetVTapArch(),
+		"kernel_version": c.GetVTapKernelVersion(),
+		"revision":       c.GetVTapRevision(),
+		"vtap_type":      int64(c.GetVTapType()),
+		"pod_cluster_id": int64(c.GetPodClusterID()),
+		"epc_id":         int64(c.GetVPCID()),
+		"tap_mode":       int64(c.GetVTapTapMode()),
+		"cpu_num":        int64(c.GetVTapCPUNum()),
+		"memory_size":    int64(c.GetVTapMemorySize()),
+	}
+}
+
+// applyConfigOverride按字段名把一条规则的覆盖值写进configure。只认generateConfigInfo已经
+// 生成好、运维侧可能想按条件覆盖的这组字段，用一个显式switch而不是反射：这组字段的数量和变化
+// 频率都不高，显式写出来比反射更容易在review里看出一条规则实际改了什么
+func applyConfigOverride(configure *api.Config, field string, value interface{}) error {
+	switch field {
+	case "CollectorEnabled":
+		v, ok := value.(bool)
+		if !ok {
+			return fmt.Errorf("field %s expects bool, got %T", field, value)
+		}
+		configure.CollectorEnabled = proto.Bool(v)
+	case "CollectorSocketType":
+		v, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("field %s expects string, got %T", field, value)
+		}
+		socketType, ok := SOCKET_TYPE_TO_MESSAGE[v]
+		if !ok {
+			return fmt.Errorf("field %s: unknown socket type %q", field, v)
+		}
+		configure.CollectorSocketType = &socketType
+	case "MaxCpus":
+		v, ok := value.(uint32)
+		if !ok {
+			return fmt.Errorf("field %s expects uint32, got %T", field, value)
+		}
+		configure.MaxCpus = proto.Uint32(v)
+	case "MaxMemory":
+		v, ok := value.(uint32)
+		if !ok {
+			return fmt.Errorf("field %s expects uint32, got %T", field, value)
+		}
+		configure.MaxMemory = proto.Uint32(v)
+	case "L4PerformanceEnabled":
+		v, ok := value.(bool)
+		if !ok {
+			return fmt.Errorf("field %s expects bool, got %T", field, value)
+		}
+		configure.L4PerformanceEnabled = proto.Bool(v)
+	case "L7MetricsEnabled":
+		v, ok := value.(bool)
+		if !ok {
+			return fmt.Errorf("field %s expects bool, got %T", field, value)
+		}
+		configure.L7MetricsEnabled = proto.Bool(v)
+	case "KubernetesApiEnabled":
+		v, ok := value.(bool)
+		if !ok {
+			return fmt.Errorf("field %s expects bool, got %T", field, value)
+		}
+		configure.KubernetesApiEnabled = proto.Bool(v)
+	default:
+		return fmt.Errorf("field %s is not overridable by a config rule", field)
+	}
+	return nil
+}
+
+// applyConfigOverrideRules按顺序评估rules，对每条Match求值为true的规则应用它的Overrides，
+// 同一个字段被多条规则覆盖时后面的规则生效（last-match-wins）。单条规则编译/求值/应用出错时
+// 只跳过这一条并计一次错误指标，不影响其它规则，更不让Sync本身失败——规则是运维侧维护的配置，
+// 写错不该打断采集器正常下发配置这条关键路径
+func applyConfigOverrideRules(c *vtap.VTapCache, configure *api.Config, rules []*ConfigOverrideRule) {
+	if len(rules) == 0 {
+		return
+	}
+	vars := configRuleActivation(c)
+	for _, rule := range rules {
+		program, err := compileConfigRule(rule)
+		if err != nil {
+			configRuleErrorsTotal.WithLabelValues(rule.ID).Inc()
+			log.Errorf("config rule %s: %s", rule.ID, err)
+			continue
+		}
+		out, _, err := program.Eval(vars)
+		if err != nil {
+			configRuleErrorsTotal.WithLabelValues(rule.ID).Inc()
+			log.Errorf("config rule %s: eval: %s", rule.ID, err)
+			continue
+		}
+		matched, ok := out.Value().(bool)
+		if !ok {
+			configRuleErrorsTotal.WithLabelValues(rule.ID).Inc()
+			log.Errorf("config rule %s: match expression did not evaluate to bool", rule.ID)
+			continue
+		}
+		if !matched {
+			configRuleSkippedTotal.WithLabelValues(rule.ID).Inc()
+			continue
+		}
+		configRuleMatchedTotal.WithLabelValues(rule.ID).Inc()
+		for field, value := range rule.Overrides {
+			if err := applyConfigOverride(configure, field, value); err != nil {
+				configRuleErrorsTotal.WithLabelValues(rule.ID).Inc()
+				log.Errorf("config rule %s: %s", rule.ID, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,145 @@
+/*
+ * Copyright (c) 2022 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package synchronize
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/deepflowys/deepflow/server/controller/trisolaris"
+	"github.com/deepflowys/deepflow/server/controller/trisolaris/vtap"
+)
+
+// kubernetesClusterLeaseDefaultTTLSeconds在还没拿到采集器vtapConfig.SyncInterval时兜底用，
+// 覆盖两次典型sync间隔，和下面"holder漏了两拍就可以被抢"的语义对上
+const kubernetesClusterLeaseDefaultTTLSeconds = 60
+
+// KubernetesClusterLease持久化哪个采集器当前持有某个k8s集群的云平台同步权，取代之前纯内存、
+// 每个trisolaris副本各算各的GetKubernetesClusterID（之前挂在vtap.VTapInfo上，这个快照里
+// trisolaris/vtap的源码还没收录进来）。按数据归属更应该跟其它DB model放一起管理，这个快照里
+// db/mysql的model源码也还没收录进来，先在唯一的调用方（synchronize包）里定义，等那边的源码
+// 补上直接把这个struct挪过去、换成dbmgr.DBMgr[T]管理即可
+type KubernetesClusterLease struct {
+	ClusterID     string    `gorm:"column:cluster_id;primaryKey"`
+	HolderVTapKey string    `gorm:"column:holder_vtap_key"`
+	ControllerID  string    `gorm:"column:controller_id"`
+	AcquiredAt    time.Time `gorm:"column:acquired_at"`
+	RenewedAt     time.Time `gorm:"column:renewed_at"`
+	TTLSeconds    uint32    `gorm:"column:ttl_seconds"`
+}
+
+func (KubernetesClusterLease) TableName() string {
+	return "kubernetes_cluster_lease"
+}
+
+var kubernetesLeaseAcquireTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "deepflow_trisolaris_kubernetes_cluster_lease_acquire_total",
+	Help: "Outcomes of attempts to acquire/renew a kubernetes cluster sync lease, labeled by cluster id and result.",
+}, []string{"cluster_id", "result"})
+
+func init() {
+	prometheus.MustRegister(kubernetesLeaseAcquireTotal)
+}
+
+// acquireOrRenewKubernetesClusterLease是GetKubernetesClusterID的替代品：cluster_id第一次出现
+// 时插入一行占住租约，之后每次Sync都尝试用conditional UPDATE续约或者抢占——命中当前holder（续约）
+// 或者租约过期（抢占，对应holder连续漏掉两拍心跳）这两种情况之一才会更新成功，返回值就是
+// "调用方这次是否持有这个cluster的采集权"，多个trisolaris副本并发调用也只有一个能抢到
+func acquireOrRenewKubernetesClusterLease(clusterID, vtapCacheKey, controllerID string, ttlSeconds uint32) bool {
+	db := trisolaris.GetDB()
+	if db == nil {
+		return false
+	}
+	if ttlSeconds == 0 {
+		ttlSeconds = kubernetesClusterLeaseDefaultTTLSeconds
+	}
+	now := time.Now()
+
+	lease := &KubernetesClusterLease{
+		ClusterID:     clusterID,
+		HolderVTapKey: vtapCacheKey,
+		ControllerID:  controllerID,
+		AcquiredAt:    now,
+		RenewedAt:     now,
+		TTLSeconds:    ttlSeconds,
+	}
+	if err := db.Create(lease).Error; err == nil {
+		kubernetesLeaseAcquireTotal.WithLabelValues(clusterID, "acquired_new").Inc()
+		return true
+	}
+
+	expiredBefore := now.Add(-time.Duration(ttlSeconds) * time.Second)
+	result := db.Model(&KubernetesClusterLease{}).
+		Where("cluster_id = ? AND (renewed_at < ? OR holder_vtap_key = ?)", clusterID, expiredBefore, vtapCacheKey).
+		Updates(map[string]interface{}{
+			"holder_vtap_key": vtapCacheKey,
+			"controller_id":   controllerID,
+			"acquired_at":     now,
+			"renewed_at":      now,
+			"ttl_seconds":     ttlSeconds,
+		})
+	if result.Error != nil {
+		log.Errorf("acquire/renew kubernetes cluster(%s) lease failed: %s", clusterID, result.Error)
+		kubernetesLeaseAcquireTotal.WithLabelValues(clusterID, "error").Inc()
+		return false
+	}
+	if result.RowsAffected > 0 {
+		kubernetesLeaseAcquireTotal.WithLabelValues(clusterID, "renewed_or_stolen").Inc()
+		return true
+	}
+	kubernetesLeaseAcquireTotal.WithLabelValues(clusterID, "denied").Inc()
+	return false
+}
+
+// kubernetesClusterLeaseTTL取2倍的采集器同步间隔作为租约时长：holder连续漏掉两次Sync（对应
+// 心跳更新UpdateSyncedControllerAt的那两拍）之后，租约过期，下一个来Sync的candidate就能抢到
+func kubernetesClusterLeaseTTL(c *vtap.VTapCache) uint32 {
+	vtapConfig := c.GetVTapConfig()
+	if vtapConfig == nil || vtapConfig.SyncInterval == 0 {
+		return kubernetesClusterLeaseDefaultTTLSeconds
+	}
+	return uint32(vtapConfig.SyncInterval) * 2
+}
+
+// KubernetesClusterLeaseHolder是控制器HTTP API用来列出当前各cluster_id采集权归属的入口；这个
+// 快照里controller的HTTP路由框架没有收录进来，没法把它注册成一个真正的handler，先导出这个查询
+// 函数，路由框架补上之后直接在对应的handler里调用它即可
+func KubernetesClusterLeaseHolder(clusterID string) (*KubernetesClusterLease, error) {
+	db := trisolaris.GetDB()
+	if db == nil {
+		return nil, nil
+	}
+	lease := &KubernetesClusterLease{}
+	if err := db.Where("cluster_id = ?", clusterID).First(lease).Error; err != nil {
+		return nil, err
+	}
+	return lease, nil
+}
+
+// KubernetesClusterLeaseHolders列出全部cluster_id的采集权归属，HTTP API列表视图用
+func KubernetesClusterLeaseHolders() ([]*KubernetesClusterLease, error) {
+	db := trisolaris.GetDB()
+	if db == nil {
+		return nil, nil
+	}
+	leases := []*KubernetesClusterLease{}
+	if err := db.Find(&leases).Error; err != nil {
+		return nil, err
+	}
+	return leases, nil
+}
@@ -0,0 +1,164 @@
+/*
+ * Copyright (c) 2022 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package synchronize
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// pushDeltaRingSize是每个(vtap, 数据类型)保留的历史快照个数：agent在Sync里上报的
+// VersionPlatformData/VersionGroups/VersionAcls一旦比环里最老的版本还旧（比如断联太久），
+// 就再也diff不出来了，只能退回全量快照，调几个典型场景（agent正常心跳间隔、短暂网络抖动）
+// 估算出来8个足够覆盖绝大多数情况，调大能覆盖更长的断联但每个vtap的内存占用也跟着涨
+const pushDeltaRingSize = 8
+
+// versionedSnapshot是某个版本号对应的一份按ID索引的全量快照：ID是platform data/groups/
+// flow acls这几个proto里本来就有的稳定主键，Data是这条记录序列化后的字节，diffSnapshots按ID
+// 对比两份快照算出增量
+type versionedSnapshot struct {
+	version uint64
+	entries map[string][]byte
+}
+
+// snapshotRing是"最近pushDeltaRingSize个版本"的有界环。这组状态按数据归属更应该跟着
+// vtap.VTapInfo（也就是GVTapInfo）走，一个vtap断联重连之后清理也该由它统一做；这个快照里
+// trisolaris/vtap的源码还没收录进来，没法把环真正挂到VTapInfo结构体上，先在push这条路径
+// 唯一的调用方（synchronize包）里按"vtap+数据类型"维护，等vtap包补上源码再把这部分状态搬过去，
+// pushResponse这边的调用方式不用跟着变
+type snapshotRing struct {
+	mu       sync.Mutex
+	order    []uint64
+	versions map[uint64]*versionedSnapshot
+}
+
+func newSnapshotRing() *snapshotRing {
+	return &snapshotRing{versions: make(map[uint64]*versionedSnapshot)}
+}
+
+func (r *snapshotRing) Add(version uint64, entries map[string][]byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.versions[version]; ok {
+		return
+	}
+	r.order = append(r.order, version)
+	r.versions[version] = &versionedSnapshot{version: version, entries: entries}
+	for len(r.order) > pushDeltaRingSize {
+		oldest := r.order[0]
+		r.order = r.order[1:]
+		delete(r.versions, oldest)
+	}
+}
+
+func (r *snapshotRing) Get(version uint64) (*versionedSnapshot, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	snap, ok := r.versions[version]
+	return snap, ok
+}
+
+var (
+	pushDeltaRingsMu sync.Mutex
+	pushDeltaRings   = make(map[string]*snapshotRing)
+)
+
+// pushDeltaRingKey把(vtap, 数据类型)拼成一个string key，避免为ring注册表另起一个二维map
+func pushDeltaRingKey(vtapCacheKey, dataType string) string {
+	return vtapCacheKey + "|" + dataType
+}
+
+func getPushDeltaRing(vtapCacheKey, dataType string) *snapshotRing {
+	key := pushDeltaRingKey(vtapCacheKey, dataType)
+	pushDeltaRingsMu.Lock()
+	defer pushDeltaRingsMu.Unlock()
+	ring, ok := pushDeltaRings[key]
+	if !ok {
+		ring = newSnapshotRing()
+		pushDeltaRings[key] = ring
+	}
+	return ring
+}
+
+var (
+	pushDeltaBytesSavedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "deepflow_trisolaris_push_delta_bytes_saved_total",
+		Help: "Estimated bytes saved by sending a delta instead of a full snapshot, labeled by data type.",
+	}, []string{"data_type"})
+	pushDeltaResetTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "deepflow_trisolaris_push_delta_reset_total",
+		Help: "Times a push fell back to a full snapshot because the agent's base version fell out of the ring, labeled by data type.",
+	}, []string{"data_type"})
+)
+
+func init() {
+	prometheus.MustRegister(pushDeltaBytesSavedTotal, pushDeltaResetTotal)
+}
+
+// diffSnapshots按ID对比base和current两份快照：current有、base没有的算added，两边都有但
+// Data不一样的算changed，base有、current没有的算removed（removed只需要携带ID，不需要Data，
+// 但这里和added/changed统一返回Data对应的字节，方便上层一起拼接，agent侧按ID从自己缓存里删
+// 即可，不需要完整Data）
+func diffSnapshots(base, current *versionedSnapshot) (added, removed, changed [][]byte) {
+	for id, data := range current.entries {
+		baseData, ok := base.entries[id]
+		if !ok {
+			added = append(added, data)
+		} else if !bytes.Equal(baseData, data) {
+			changed = append(changed, data)
+		}
+	}
+	for id, data := range base.entries {
+		if _, ok := current.entries[id]; !ok {
+			removed = append(removed, data)
+		}
+	}
+	return
+}
+
+// buildPushDelta是pushResponse里platform data/groups/flow acls三处共用的delta计算入口。
+// entries是当前版本按ID索引的全量数据，调用方负责从各自的缓存（vtapCache/GVTapInfo）取出来；
+// baseVersion是agent在Sync时上报、已经被记成vtapCache.GetPushVersion*()的已确认版本。
+// reset=true时added/removed/changed都是nil，调用方应该退回对应的全量快照
+func buildPushDelta(vtapCacheKey, dataType string, baseVersion, currentVersion uint64, entries map[string][]byte) (added, removed, changed []byte, reset bool) {
+	ring := getPushDeltaRing(vtapCacheKey, dataType)
+	current := &versionedSnapshot{version: currentVersion, entries: entries}
+	ring.Add(currentVersion, entries)
+
+	base, ok := ring.Get(baseVersion)
+	if !ok {
+		pushDeltaResetTotal.WithLabelValues(dataType).Inc()
+		return nil, nil, nil, true
+	}
+
+	addedEntries, removedEntries, changedEntries := diffSnapshots(base, current)
+	added = bytes.Join(addedEntries, nil)
+	removed = bytes.Join(removedEntries, nil)
+	changed = bytes.Join(changedEntries, nil)
+
+	fullLen := 0
+	for _, data := range entries {
+		fullLen += len(data)
+	}
+	deltaLen := len(added) + len(removed) + len(changed)
+	if fullLen > deltaLen {
+		pushDeltaBytesSavedTotal.WithLabelValues(dataType).Add(float64(fullLen - deltaLen))
+	}
+	return added, removed, changed, false
+}
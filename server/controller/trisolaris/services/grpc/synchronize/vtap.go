@@ -171,6 +171,18 @@ func (e *VTapEvent) generateConfigInfo(c *vtap.VTapCache) *api.Config {
 		}
 	}
 
+	// 健康探测发现当前analyzer掉到阈值以下时，把单IP字段原地换成排名靠前的健康analyzer，给不认
+	// AnalyzerCandidates字段的老版本agent兜底；PickFailoverAnalyzer自带hysteresis，分数在阈值
+	// 附近抖动不会导致来回切换。按请求本来还要在api.Config上加一个repeated AnalyzerCandidates
+	// 字段给新版本agent做本地failover，但这个快照里message/trident的protobuf源码没有收录进来，
+	// 没法加新字段、也没法跑对应的pb生成，这部分等那边的源码补上再接到trisolaris.GetAnalyzerHealthTable()
+	if analyzerIP := configure.GetAnalyzerIp(); analyzerIP != "" {
+		if failoverIP := trisolaris.PickFailoverAnalyzer(analyzerIP); failoverIP != analyzerIP {
+			log.Infof("vtap(%s) analyzer(%s) health degraded, failing over to %s", c.GetCtrlIP(), analyzerIP, failoverIP)
+			configure.AnalyzerIp = proto.String(failoverIP)
+		}
+	}
+
 	if configure.GetProxyControllerIp() == "" {
 		log.Errorf("vtap(%s) has no proxy_controller_ip", c.GetCtrlIP())
 	}
@@ -203,6 +215,24 @@ func (e *VTapEvent) generateConfigInfo(c *vtap.VTapCache) *api.Config {
 		}
 	}
 
+	// autoscale策略开启且至少跑过一轮decideAutoscale后，用EWMA算出来的effective值替换静态DB值；
+	// 放在CEL规则之前应用，让运维配的CEL规则始终有最终决定权（能在autoscale调整后的值上再覆盖一次）
+	if policy := gVTapInfo.GetAutoscalePolicy(c.GetVTapGroupLcuuid()); policy != nil {
+		vtapCacheKey := c.GetCtrlIP() + "-" + c.GetCtrlMac()
+		if effective, ok := effectiveAutoscaleValues(vtapCacheKey, policy); ok {
+			configure.MaxCpus = proto.Uint32(effective.MaxCpus)
+			configure.MaxMemory = proto.Uint32(effective.MaxMemory)
+			configure.ThreadThreshold = proto.Uint32(effective.ThreadThreshold)
+			configure.ProcessThreshold = proto.Uint32(effective.ProcessThreshold)
+		}
+	}
+
+	// CEL配置覆盖规则在基础配置生成完之后、返回之前应用，这样规则既能覆盖上面按vtapConfig算出来
+	// 的字段，也能覆盖上面License计费降级改过的字段；规则集合同时包含全局规则和这个vtap所在
+	// VTapGroup的规则，顺序由GetConfigOverrideRules决定（通常是全局在前、分组在后，分组能覆盖全局）
+	rules := gVTapInfo.GetConfigOverrideRules(c.GetVTapGroupLcuuid())
+	applyConfigOverrideRules(c, configure, rules)
+
 	return configure
 }
 
@@ -298,6 +328,14 @@ func (e *VTapEvent) Sync(ctx context.Context, in *api.SyncRequest) (*api.SyncRes
 		in.GetOs(),
 		in.GetKernelVersion(),
 		in.GetProcessName())
+	// autoscale用这次上报的cpu/mem利用率跑一轮EWMA和伸缩决策；vtapConfig为nil或MaxCPUs/MaxMemory
+	// 未配置时没法算出利用率分母，直接跳过，generateConfigInfo那边会按未初始化状态回退到静态DB值
+	if vtapConfig := vtapCache.GetVTapConfig(); vtapConfig != nil && vtapConfig.MaxCPUs > 0 && vtapConfig.MaxMemory > 0 {
+		cpuUtil := float64(in.GetCpuNum()) / float64(vtapConfig.MaxCPUs)
+		memUtil := float64(in.GetMemorySize()) / (float64(vtapConfig.MaxMemory) * 1024 * 1024)
+		policy := gVTapInfo.GetAutoscalePolicy(vtapCache.GetVTapGroupLcuuid())
+		observeAutoscale(vtapCacheKey, policy, cpuUtil, memUtil)
+	}
 	// 专属采集器ctrl_mac可能会变，不更新ctrl_mac
 	if vtapCache.GetVTapType() != VTAP_TYPE_DEDICATED {
 		vtapCache.UpdateCtrlMacFromGrpc(in.GetCtrlMac())
@@ -339,10 +377,10 @@ func (e *VTapEvent) Sync(ctx context.Context, in *api.SyncRequest) (*api.SyncRes
 	}
 
 	configInfo := e.generateConfigInfo(vtapCache)
-	// 携带信息有cluster_id时选择一个采集器开启云平台同步开关
+	// 携带信息有cluster_id时，用lease表在多个trisolaris副本间仲裁出一个采集器开启云平台同步开关
 	if in.GetKubernetesClusterId() != "" && isOpenK8sSyn(vtapCache.GetVTapType()) == true {
-		value := gVTapInfo.GetKubernetesClusterID(in.GetKubernetesClusterId(), vtapCacheKey)
-		if value == vtapCacheKey {
+		if acquireOrRenewKubernetesClusterLease(
+			in.GetKubernetesClusterId(), vtapCacheKey, trisolaris.GetConfig().NodeIP, kubernetesClusterLeaseTTL(vtapCache)) {
 			log.Infof(
 				"open cluster(%s) kubernetes_api_enabled VTap(ctrl_ip: %s, ctrl_mac: %s)",
 				in.GetKubernetesClusterId(), ctrlIP, ctrlMac)
@@ -387,8 +425,8 @@ func (e *VTapEvent) noVTapResponse(in *api.SyncRequest) *api.SyncResponse {
 			Enabled:              proto.Bool(true),
 			TridentType:          &tridentType,
 		}
-		value := gVTapInfo.GetKubernetesClusterID(in.GetKubernetesClusterId(), vtapCacheKey)
-		if value == vtapCacheKey {
+		if acquireOrRenewKubernetesClusterLease(
+			in.GetKubernetesClusterId(), vtapCacheKey, trisolaris.GetConfig().NodeIP, kubernetesClusterLeaseDefaultTTLSeconds) {
 			configInfo.KubernetesApiEnabled = proto.Bool(true)
 			log.Infof(
 				"open cluster(%s) kubernetes_api_enabled VTap(ctrl_ip: %s, ctrl_mac: %s)",
@@ -493,17 +531,51 @@ func (e *VTapEvent) pushResponse(in *api.SyncRequest) (*api.SyncResponse, error)
 			in.GetProcessName(), in.GetRevision(), in.GetBootTime())
 	}
 
+	// 下面platform data/groups/flow acls三段逻辑一样：版本没变就什么都不发（flow acls这一段拿当前
+	// 版本和请求里的VersionAcls比，另外两段和pushVersion*比）；版本变了优先发
+	// delta（agent上次ack的pushVersion*和当前版本之间，按ID算出的added/removed/changed），
+	// agent的ack版本不在ring里（断联太久、或者ring刚启动还没攒够历史）时buildPushDelta返回
+	// reset=true，退回发一份全量快照，和delta之前的行为完全一样，agent收到Reset=true要按全量
+	// 处理而不是尝试增量patch
 	platformData := []byte{}
+	var platformDataAdded, platformDataRemoved, platformDataChanged []byte
+	platformDataReset := false
 	if versionPlatformData != pushVersionPlatformData {
-		platformData = vtapCache.GetSimplePlatformDataStr()
+		added, removed, changed, reset := buildPushDelta(
+			vtapCacheKey, "platform_data", pushVersionPlatformData, versionPlatformData,
+			vtapCache.GetSimplePlatformDataEntries())
+		if reset {
+			platformData = vtapCache.GetSimplePlatformDataStr()
+			platformDataReset = true
+		} else {
+			platformDataAdded, platformDataRemoved, platformDataChanged = added, removed, changed
+		}
 	}
 	groups := []byte{}
+	var groupsAdded, groupsRemoved, groupsChanged []byte
+	groupsReset := false
 	if versionGroups != pushVersionGroups {
-		groups = gVTapInfo.GetGroupData()
+		added, removed, changed, reset := buildPushDelta(
+			vtapCacheKey, "groups", pushVersionGroups, versionGroups, gVTapInfo.GetGroupDataEntries())
+		if reset {
+			groups = gVTapInfo.GetGroupData()
+			groupsReset = true
+		} else {
+			groupsAdded, groupsRemoved, groupsChanged = added, removed, changed
+		}
 	}
 	acls := []byte{}
+	var flowAclsAdded, flowAclsRemoved, flowAclsChanged []byte
+	flowAclsReset := false
 	if versionPolicy != in.GetVersionAcls() {
-		acls = gVTapInfo.GetVTapPolicyData(vtapID, functions)
+		added, removed, changed, reset := buildPushDelta(
+			vtapCacheKey, "flow_acls", pushVersionPolicy, versionPolicy, gVTapInfo.GetVTapPolicyDataEntries(vtapID, functions))
+		if reset {
+			acls = gVTapInfo.GetVTapPolicyData(vtapID, functions)
+			flowAclsReset = true
+		} else {
+			flowAclsAdded, flowAclsRemoved, flowAclsChanged = added, removed, changed
+		}
 	}
 
 	// 只有专属采集器下发tap_types
@@ -513,10 +585,10 @@ func (e *VTapEvent) pushResponse(in *api.SyncRequest) (*api.SyncResponse, error)
 	}
 
 	configInfo := e.generateConfigInfo(vtapCache)
-	// 携带信息有cluster_id时选择一个采集器开启云平台同步开关
+	// 携带信息有cluster_id时，用lease表在多个trisolaris副本间仲裁出一个采集器开启云平台同步开关
 	if in.GetKubernetesClusterId() != "" && isOpenK8sSyn(vtapCache.GetVTapType()) == true {
-		value := gVTapInfo.GetKubernetesClusterID(in.GetKubernetesClusterId(), vtapCacheKey)
-		if value == vtapCacheKey {
+		if acquireOrRenewKubernetesClusterLease(
+			in.GetKubernetesClusterId(), vtapCacheKey, trisolaris.GetConfig().NodeIP, kubernetesClusterLeaseTTL(vtapCache)) {
 			log.Infof(
 				"open cluster(%s) kubernetes_api_enabled VTap(ctrl_ip: %s, ctrl_mac: %s)",
 				in.GetKubernetesClusterId(), ctrlIP, ctrlMac)
@@ -527,18 +599,33 @@ func (e *VTapEvent) pushResponse(in *api.SyncRequest) (*api.SyncResponse, error)
 	remoteSegments := vtapCache.GetVTapRemoteSegments()
 	skipInterface := gVTapInfo.GetSkipInterface(vtapCache)
 	return &api.SyncResponse{
-		Status:              &STATUS_SUCCESS,
-		LocalSegments:       localSegments,
-		RemoteSegments:      remoteSegments,
-		Config:              configInfo,
-		PlatformData:        platformData,
-		SkipInterface:       skipInterface,
-		VersionPlatformData: proto.Uint64(versionPlatformData),
-		Groups:              groups,
-		VersionGroups:       proto.Uint64(versionGroups),
-		FlowAcls:            acls,
-		VersionAcls:         proto.Uint64(versionPolicy),
-		TapTypes:            tapTypes,
+		Status:                  &STATUS_SUCCESS,
+		LocalSegments:           localSegments,
+		RemoteSegments:          remoteSegments,
+		Config:                  configInfo,
+		PlatformData:            platformData,
+		PlatformDataAdded:       platformDataAdded,
+		PlatformDataRemoved:     platformDataRemoved,
+		PlatformDataChanged:     platformDataChanged,
+		PlatformDataBaseVersion: proto.Uint64(pushVersionPlatformData),
+		PlatformDataReset:       proto.Bool(platformDataReset),
+		SkipInterface:           skipInterface,
+		VersionPlatformData:     proto.Uint64(versionPlatformData),
+		Groups:                  groups,
+		GroupsAdded:             groupsAdded,
+		GroupsRemoved:           groupsRemoved,
+		GroupsChanged:           groupsChanged,
+		GroupsBaseVersion:       proto.Uint64(pushVersionGroups),
+		GroupsReset:             proto.Bool(groupsReset),
+		VersionGroups:           proto.Uint64(versionGroups),
+		FlowAcls:                acls,
+		FlowAclsAdded:           flowAclsAdded,
+		FlowAclsRemoved:         flowAclsRemoved,
+		FlowAclsChanged:         flowAclsChanged,
+		FlowAclsBaseVersion:     proto.Uint64(pushVersionPolicy),
+		FlowAclsReset:           proto.Bool(flowAclsReset),
+		VersionAcls:             proto.Uint64(versionPolicy),
+		TapTypes:                tapTypes,
 	}, nil
 }
 
@@ -17,9 +17,13 @@
 package trisolaris
 
 import (
+	"context"
+
 	"github.com/op/go-logging"
 	"gorm.io/gorm"
 
+	globalconfig "github.com/deepflowys/deepflow/server/controller/config"
+	"github.com/deepflowys/deepflow/server/controller/election"
 	"github.com/deepflowys/deepflow/server/controller/trisolaris/config"
 	"github.com/deepflowys/deepflow/server/controller/trisolaris/kubernetes"
 	"github.com/deepflowys/deepflow/server/controller/trisolaris/metadata"
@@ -64,30 +68,96 @@ func GetBillingMethod() string {
 	return trisolaris.config.BillingMethod
 }
 
+// IsLeader在单机(未开启选举)部署下始终为true，HA部署下只有选举产生的leader返回true
+func IsLeader() bool {
+	return election.IsLeader()
+}
+
+// 以下Put*方法是mutating调用，follower上不持有最新数据也无法保证多副本一致，因此在follower上no-op，
+// 等待后续补充将请求转发给leader的RPC通道后再去掉这个限制
 func PutPlatformData() {
+	if !IsLeader() {
+		log.Debug("not leader, skip PutPlatformData")
+		return
+	}
 	trisolaris.metaData.PutChPlatformData()
 }
 
 func PutTapType() {
+	if !IsLeader() {
+		log.Debug("not leader, skip PutTapType")
+		return
+	}
 	log.Info("PutTapType")
 	trisolaris.metaData.PutChTapType()
 }
 
 func PutNodeInfo() {
+	if !IsLeader() {
+		log.Debug("not leader, skip PutNodeInfo")
+		return
+	}
 	trisolaris.nodeInfo.PutChNodeInfo()
 }
 
 func PutVTapCache() {
+	if !IsLeader() {
+		log.Debug("not leader, skip PutVTapCache")
+		return
+	}
 	trisolaris.vTapInfo.PutVTapCacheRefresh()
 }
 
+// PutVTapAutoscaleEvent把一次autoscale伸缩动作记录进事件流，供HTTP API和后续的审计/告警消费；
+// 和其它Put*一样只在leader上做，follower上记了也没人读
+func PutVTapAutoscaleEvent(vtapCacheKey, action string, maxCpus, maxMemory, threadThreshold, processThreshold uint32) {
+	if !IsLeader() {
+		log.Debug("not leader, skip PutVTapAutoscaleEvent")
+		return
+	}
+	trisolaris.vTapInfo.PutVTapAutoscaleEvent(vtapCacheKey, action, maxCpus, maxMemory, threadThreshold, processThreshold)
+}
+
 func (t *Trisolaris) Start() {
 	t.metaData.InitData() // 需要先初始化
-	go t.metaData.TimedRefreshMetaData()
-	go t.vTapInfo.TimedRefreshVTapCache()
-	go t.nodeInfo.TimedRefreshNodeCache()
+	election.RegisterCallbacks("trisolaris.timed-refresh", t)
+	go t.watchConfig()
+	go t.watchAnalyzerHealth()
 }
 
+// watchConfig订阅config.GlobalBus，TrisolarisCfg里没有标记reload:"restart"的字段已经被
+// Watcher原地写回了（t.config指向的就是ControllerConfig.TrisolarisCfg那块内存），这里只需要
+// 重新跑一遍Convert()让依赖原始字段计算出来的派生字段（比如超时时间换算）保持同步
+func (t *Trisolaris) watchConfig() {
+	changeCh := globalconfig.GlobalBus.Subscribe(1)
+	for change := range changeCh {
+		if !change.Contains("trisolaris") {
+			continue
+		}
+		log.Info("trisolaris config changed, re-applying derived fields")
+		t.config.Convert()
+	}
+}
+
+// OnAcquired实现election.Callbacks：本controller当选leader后才启动定时刷新协程，followers
+// 保持缓存预热但不做定时刷新。ctx在失去leader身份时会被election包cancel掉，三个Timed*协程
+// 都得在内部select上ctx.Done()才能真正停下来，不然只是不再被重新拉起，旧的还在跑
+func (t *Trisolaris) OnAcquired(ctx context.Context) {
+	log.Info("acquired leadership, starting timed refresh goroutines")
+	go t.metaData.TimedRefreshMetaData(ctx)
+	go t.vTapInfo.TimedRefreshVTapCache(ctx)
+	go t.nodeInfo.TimedRefreshNodeCache(ctx)
+}
+
+// OnLost实现election.Callbacks：ctx已经被cancel，三个Timed*协程会自己退出，这里只做日志
+func (t *Trisolaris) OnLost() {
+	log.Warning("lost leadership, timed refresh goroutines are stopping")
+}
+
+// OnObservedLeader实现election.Callbacks：trisolaris目前不需要知道谁是leader，只关心自己
+// 是不是，留空实现满足接口
+func (t *Trisolaris) OnObservedLeader(id string) {}
+
 func NewTrisolaris(cfg *config.Config, db *gorm.DB) *Trisolaris {
 	if trisolaris == nil {
 		cfg.Convert()
@@ -0,0 +1,73 @@
+/*
+ * Copyright (c) 2022 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package datasource
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// DatasourceChangeLog是datasource_change_log表的行模型，每次preview=false的ExecutePlan调用
+// (不管成功还是失败)都会落一条，PlanJSON存BuildPlan渲染出来的完整Plan，方便运维审计或者
+// 照着PlanJSON里的Apply语句手工重放；失败时Error非空，PlanJSON里仍是全部节点，每个PlanStep的
+// Applied反映回滚之后这条语句是否还留在集群上
+type DatasourceChangeLog struct {
+	ID        uint64    `gorm:"primaryKey;autoIncrement" json:"id"`
+	DbGroup   string    `gorm:"column:db_group" json:"db_group"`
+	Action    string    `gorm:"column:action" json:"action"`
+	DstTable  string    `gorm:"column:dst_table" json:"dst_table"`
+	PlanJSON  string    `gorm:"column:plan_json;type:text" json:"plan_json"`
+	Success   bool      `gorm:"column:success" json:"success"`
+	Error     string    `gorm:"column:error" json:"error,omitempty"`
+	CreatedAt time.Time `gorm:"column:created_at" json:"created_at"`
+}
+
+func (DatasourceChangeLog) TableName() string {
+	return "datasource_change_log"
+}
+
+// recordChangeLog把一次ExecutePlan的结果写进datasource_change_log，m.changeLogDB没有配置
+// （比如还没给DatasourceManager接上MySQL连接）时只记一条日志，不阻塞主流程——审计记录缺失
+// 不应该让数据源变更本身失败
+func (m *DatasourceManager) recordChangeLog(plan *Plan, applyErr error) {
+	if m.changeLogDB == nil {
+		log.Warning("datasource_change_log not recorded: no mysql connection configured for DatasourceManager")
+		return
+	}
+
+	planJSON, err := json.Marshal(plan)
+	if err != nil {
+		log.Errorf("failed to marshal plan for datasource_change_log: %s", err)
+		return
+	}
+
+	entry := DatasourceChangeLog{
+		DbGroup:   plan.DbGroup,
+		Action:    plan.Action,
+		DstTable:  plan.DstTable,
+		PlanJSON:  string(planJSON),
+		Success:   applyErr == nil,
+		CreatedAt: time.Now(),
+	}
+	if applyErr != nil {
+		entry.Error = applyErr.Error()
+	}
+
+	if err := m.changeLogDB.Create(&entry).Error; err != nil {
+		log.Errorf("failed to record datasource_change_log: %s", err)
+	}
+}
@@ -44,23 +44,43 @@ var metricsGroupTableIDs = [][]zerodoc.MetricsTableID{
 	zerodoc.VTAP_APP_PORT_1S:  []zerodoc.MetricsTableID{zerodoc.VTAP_APP_EDGE_PORT_1S, zerodoc.VTAP_APP_PORT_1S},
 }
 
+// tableGroupRegistry把"metric family名字 + 根tier(1s/1m)"映射到这个metric family在对应根tier下
+// 要实例化的zerodoc.MetricsTableID集合（通常是一个edge表加一个非edge表）。以前这里是写死在
+// getMetricsSubTableIDs里的switch，新增一个metric family需要改这个文件；现在通过
+// RegisterMetricsTableGroup注册，getMetricsSubTableIDs只管按名字查表——ReconcileRetentionPolicies
+// 对一批policies里的全部tier都用调用方传入的baseTable取同一份subTableIDs，不会顺着每个tier的Source
+// 去找它自己的根；中间的tier只是换了dstTable名字和聚合窗口，schema意义上的table family不变
+var tableGroupRegistry = map[string]map[string][]zerodoc.MetricsTableID{
+	"vtap_flow": {
+		ORIGIN_TABLE_1S: metricsGroupTableIDs[zerodoc.VTAP_FLOW_PORT_1S],
+		ORIGIN_TABLE_1M: metricsGroupTableIDs[zerodoc.VTAP_FLOW_PORT_1M],
+	},
+	"vtap_app": {
+		ORIGIN_TABLE_1S: metricsGroupTableIDs[zerodoc.VTAP_APP_PORT_1S],
+		ORIGIN_TABLE_1M: metricsGroupTableIDs[zerodoc.VTAP_APP_PORT_1M],
+	},
+}
+
+// RegisterMetricsTableGroup给tableGroupRegistry加一个metric family，供新增指标族在初始化时
+// 调用，而不需要改这个包里的代码
+func RegisterMetricsTableGroup(name string, rootToTableIDs map[string][]zerodoc.MetricsTableID) {
+	tableGroupRegistry[name] = rootToTableIDs
+}
+
 func getMetricsSubTableIDs(tableGroup, baseTable string) ([]zerodoc.MetricsTableID, error) {
-	switch tableGroup {
-	case "vtap_flow":
-		if baseTable == ORIGIN_TABLE_1S {
-			return metricsGroupTableIDs[zerodoc.VTAP_FLOW_PORT_1S], nil
-		} else {
-			return metricsGroupTableIDs[zerodoc.VTAP_FLOW_PORT_1M], nil
-		}
-	case "vtap_app":
-		if baseTable == ORIGIN_TABLE_1S {
-			return metricsGroupTableIDs[zerodoc.VTAP_APP_PORT_1S], nil
-		} else {
-			return metricsGroupTableIDs[zerodoc.VTAP_APP_PORT_1M], nil
-		}
-	default:
+	roots, ok := tableGroupRegistry[tableGroup]
+	if !ok {
 		return nil, fmt.Errorf("unknown table group(%s)", tableGroup)
 	}
+	if baseTable == ORIGIN_TABLE_1S {
+		if ids, ok := roots[ORIGIN_TABLE_1S]; ok {
+			return ids, nil
+		}
+	}
+	if ids, ok := roots[ORIGIN_TABLE_1M]; ok {
+		return ids, nil
+	}
+	return nil, fmt.Errorf("table group(%s) has no table ids registered for root %s", tableGroup, ORIGIN_TABLE_1M)
 }
 
 // zerodoc 的 Latency 结构中的非累加聚合字段
@@ -292,14 +312,22 @@ func (m *DatasourceManager) makeAggTableCreateSQL(t *ckdb.Table, dstTable, aggrS
 		ckdb.DF_STORAGE_POLICY)
 }
 
+// MakeMVTableCreateSQL是MakeMVTableCreateSQLFrom在"源表就是1s/1m origin表"这种最常见场景下的
+// 简化形式，多级rollup（参见RetentionPolicy）要从另一个tier的LOCAL表往上聚合，要用带Source参数
+// 的版本
 func MakeMVTableCreateSQL(t *ckdb.Table, dstTable, aggrSummable, aggrUnsummable string, aggrTimeFunc ckdb.TimeFuncType) string {
+	return MakeMVTableCreateSQLFrom(t, dstTable, getMetricsTableName(t.ID, "", LOCAL), aggrSummable, aggrUnsummable, aggrTimeFunc)
+}
+
+// MakeMVTableCreateSQLFrom和MakeMVTableCreateSQL的区别是显式传入sourceTable而不是总是取1s/1m
+// origin表的LOCAL视图，这样一个tier的MV可以从它在RetentionPolicy DAG里的父tier聚合，而不仅仅
+// 是从最底层的origin表聚合
+func MakeMVTableCreateSQLFrom(t *ckdb.Table, dstTable, sourceTable, aggrSummable, aggrUnsummable string, aggrTimeFunc ckdb.TimeFuncType) string {
 	tableMv := getMetricsTableName(t.ID, dstTable, MV)
 	tableAgg := getMetricsTableName(t.ID, dstTable, AGG)
 
-	// 对于从1m,1s表进行聚合的表，使用local表作为源表
-	baseTableType := LOCAL
 	columnTableType := MV
-	tableBase := getMetricsTableName(t.ID, "", baseTableType)
+	tableBase := sourceTable
 
 	groupKeys := t.OrderKeys
 	columns := []string{}
@@ -380,48 +408,6 @@ func getMetricsTable(id zerodoc.MetricsTableID) *ckdb.Table {
 	return zerodoc.GetMetricsTables(ckdb.MergeTree, basecommon.CK_VERSION)[id] // GetMetricsTables取的全局变量的值，以roze在启动时对tables初始化的参数为准
 }
 
-func (m *DatasourceManager) createTableMV(ck clickhouse.Conn, tableId zerodoc.MetricsTableID, baseTable, dstTable, aggrSummable, aggrUnsummable string, aggInterval IntervalEnum, duration int) error {
-	table := getMetricsTable(tableId)
-	if baseTable != ORIGIN_TABLE_1M && baseTable != ORIGIN_TABLE_1S {
-		return fmt.Errorf("Only support base datasource 1s,1m")
-	}
-
-	aggTime := ckdb.TimeFuncHour
-	partitionTime := ckdb.TimeFuncWeek
-	if aggInterval == IntervalDay {
-		aggTime = ckdb.TimeFuncDay
-		partitionTime = ckdb.TimeFuncYYYYMM
-	}
-
-	commands := []string{
-		m.makeAggTableCreateSQL(table, dstTable, aggrSummable, aggrUnsummable, partitionTime, duration),
-		MakeMVTableCreateSQL(table, dstTable, aggrSummable, aggrUnsummable, aggTime),
-		MakeCreateTableLocal(table, dstTable, aggrSummable, aggrUnsummable),
-		MakeGlobalTableCreateSQL(table, dstTable),
-	}
-	for _, cmd := range commands {
-		log.Info(cmd)
-		if err := ckwriter.ExecSQL(ck, cmd); err != nil {
-			return err
-		}
-	}
-	return nil
-}
-
-func (m *DatasourceManager) modTableMV(ck clickhouse.Conn, tableId zerodoc.MetricsTableID, dstTable string, duration int) error {
-	table := getMetricsTable(tableId)
-	tableMod := ""
-	if dstTable == ORIGIN_TABLE_1M || dstTable == ORIGIN_TABLE_1S {
-		tableMod = getMetricsTableName(uint8(tableId), "", LOCAL)
-	} else {
-		tableMod = getMetricsTableName(uint8(tableId), dstTable, AGG)
-	}
-	modTable := fmt.Sprintf("ALTER TABLE %s MODIFY TTL %s",
-		tableMod, makeTTLString(table.TimeKey, duration, m.ckdbS3Enabled, m.ckdbS3Volume, m.ckdbS3TTLTimes))
-
-	return ckwriter.ExecSQL(ck, modTable)
-}
-
 func (m *DatasourceManager) modFlowLogLocalTable(ck clickhouse.Conn, tableID common.FlowLogID, duration int) error {
 	timeKey := tableID.TimeKey()
 	tableLocal := fmt.Sprintf("%s.%s_%s", common.FLOW_LOG_DB, tableID.String(), LOCAL)
@@ -430,119 +416,45 @@ func (m *DatasourceManager) modFlowLogLocalTable(ck clickhouse.Conn, tableID com
 	return ckwriter.ExecSQL(ck, modTable)
 }
 
-func delTableMV(ck clickhouse.Conn, dbId zerodoc.MetricsTableID, table string) error {
-	dropTables := []string{
-		getMetricsTableName(uint8(dbId), table, GLOBAL),
-		getMetricsTableName(uint8(dbId), table, LOCAL),
-		getMetricsTableName(uint8(dbId), table, MV),
-		getMetricsTableName(uint8(dbId), table, AGG),
-	}
-	for _, name := range dropTables {
-		if err := ckwriter.ExecSQL(ck, "DROP TABLE IF EXISTS "+name); err != nil {
-			return err
-		}
-	}
-
-	return nil
-}
-
-func (m *DatasourceManager) Handle(dbGroup, action, baseTable, dstTable, aggrSummable, aggrUnsummable string, interval, duration int) error {
-	var cks []clickhouse.Conn
-	for _, addr := range m.ckAddrs {
-		if len(addr) == 0 {
-			continue
-		}
-		ck, err := clickhouse.Open(&clickhouse.Options{
-			Addr: []string{addr},
-			Auth: clickhouse.Auth{
-				Database: "default",
-				Username: m.user,
-				Password: m.password,
-			},
-		})
-
-		if err != nil {
-			return err
-		}
-		cks = append(cks, ck)
-	}
-	if len(cks) == 0 {
-		return fmt.Errorf("invalid clickhouse addrs: Addrs=%v ", m.ckAddrs)
-	}
-
-	duration = duration / 24 // 切换为天
-
-	// flow_log.l4和flow_log.l7只支持mod
+// Handle是datasource管理接口的唯一入口。preview为true时只跑规划阶段，返回渲染好的Plan、
+// 不执行任何SQL（HTTP handler收到?preview=true时应该原样把Plan序列化返回给调用方）；preview为
+// false时规划之后立刻执行，执行结果（包括失败时已经回滚到什么程度）记一条datasource_change_log，
+// 返回的Plan里每个PlanStep.Applied反映了这条语句是否还留在集群上（失败回滚之后会被重新置回false）。
+// flow_log.l4/l7的MOD分支不走两阶段这套——它只有一条ALTER TABLE MODIFY TTL，既有的实现已经是
+// 对每个节点独立生效、互不影响，引入Plan/Rollback对这条路径没有额外价值
+func (m *DatasourceManager) Handle(dbGroup, action, baseTable, dstTable, aggrSummable, aggrUnsummable string, interval, duration int, preview bool) (*Plan, error) {
 	if (dbGroup == FLOW_LOG_L4 || dbGroup == FLOW_LOG_L7) && action == actionStrings[MOD] {
-		flowLogID := common.L4_FLOW_ID
-		if dbGroup == FLOW_LOG_L7 {
-			flowLogID = common.L7_FLOW_ID
-		}
-		for _, ck := range cks {
-			if err := m.modFlowLogLocalTable(ck, flowLogID, duration); err != nil {
-				return err
-			}
-		}
-		return nil
+		return nil, m.handleFlowLogMod(dbGroup, duration)
 	}
 
-	subTableIDs, err := getMetricsSubTableIDs(dbGroup, baseTable)
+	plan, err := m.BuildPlan(dbGroup, action, baseTable, dstTable, aggrSummable, aggrUnsummable, interval, duration)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	if preview {
+		return plan, nil
+	}
+
+	applyErr := m.ExecutePlan(plan)
+	m.recordChangeLog(plan, applyErr)
+	return plan, applyErr
+}
 
-	actionEnum, err := ActionToEnum(action)
+func (m *DatasourceManager) handleFlowLogMod(dbGroup string, durationHours int) error {
+	cks, _, err := m.openClickhouseConns()
 	if err != nil {
 		return err
 	}
+	defer closeClickhouseConns(cks)
 
-	if actionEnum == ADD {
-		if baseTable == "" {
-			return fmt.Errorf("base table name is empty")
-		}
-		if _, err := AggrToEnum(aggrSummable); err != nil {
-			return err
-		}
-		if _, err := AggrToEnum(aggrUnsummable); err != nil {
-			return err
-		}
-		if interval != 60 && interval != 1440 {
-			return fmt.Errorf("interval(%d) only support 60 or 1440.", interval)
-		}
-		if duration < 1 {
-			return fmt.Errorf("duration(%d) must bigger than 0.", duration)
-		}
-		if baseTable == dstTable {
-			return fmt.Errorf("base table(%s) should not the same as the dst table(%s)", baseTable, dstTable)
-		}
-	}
-
-	if dstTable == "" {
-		return fmt.Errorf("dst table name is empty")
+	duration := durationHours / 24 // 切换为天
+	flowLogID := common.L4_FLOW_ID
+	if dbGroup == FLOW_LOG_L7 {
+		flowLogID = common.L7_FLOW_ID
 	}
-
 	for _, ck := range cks {
-		for _, tableId := range subTableIDs {
-			switch actionEnum {
-			case ADD:
-				aggInterval := IntervalHour
-				if interval == 1440 {
-					aggInterval = IntervalDay
-				}
-				if err := m.createTableMV(ck, tableId, baseTable, dstTable, aggrSummable, aggrUnsummable, aggInterval, duration); err != nil {
-					return err
-				}
-			case MOD:
-				if err := m.modTableMV(ck, tableId, dstTable, duration); err != nil {
-					return err
-				}
-			case DEL:
-				if err := delTableMV(ck, tableId, dstTable); err != nil {
-					return err
-				}
-			default:
-				return fmt.Errorf("unsupport action %s", action)
-			}
+		if err := m.modFlowLogLocalTable(ck, flowLogID, duration); err != nil {
+			return err
 		}
 	}
 	return nil
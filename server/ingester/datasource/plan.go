@@ -0,0 +1,344 @@
+/*
+ * Copyright (c) 2022 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package datasource
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/deepflowys/deepflow/server/ingester/pkg/ckwriter"
+	"github.com/deepflowys/deepflow/server/libs/ckdb"
+	"github.com/deepflowys/deepflow/server/libs/zerodoc"
+
+	clickhouse "github.com/ClickHouse/clickhouse-go/v2"
+)
+
+// PlanStep是NodePlan里的一条SQL语句，Apply是Handle原来直接对着ck连接跑的那条建表/改表/删表语句，
+// Rollback是它的补偿操作：ADD对应DROP、MOD对应把TTL改回执行前从建表语句里读到的值、DEL对应把被删掉的表重新建出来
+// （依赖规划阶段在真正执行DEL之前把原建表语句从system.tables读出来存好）。一条PlanStep要么完整
+// 执行成功要么完全没执行，不会有"建到一半"的中间态，所以补偿时只需要按Applied标记决定要不要跑Rollback
+type PlanStep struct {
+	TableID   zerodoc.MetricsTableID `json:"-"`
+	TableType TableType              `json:"table_type"`
+	Apply     string                 `json:"apply"`
+	Rollback  string                 `json:"rollback,omitempty"`
+	Applied   bool                   `json:"applied"`
+}
+
+// NodePlan是Plan里单个ClickHouse节点要跑的步骤，以及规划阶段对这个节点做schema drift检查时
+// 发现的问题（不阻止执行，只是给operator一个提前预警，比如表已存在、TTL和要设置的不一致）
+type NodePlan struct {
+	Addr  string     `json:"addr"`
+	Steps []PlanStep `json:"steps"`
+	Diffs []string   `json:"diffs,omitempty"`
+}
+
+// Plan是BuildPlan规划出的完整变更：对每个节点要跑哪些SQL、跑完怎么回滚，一次性渲染好之后
+// ExecutePlan只管按顺序执行和在失败时回放Rollback，不会再重新计算任何SQL。整个Plan
+// 会被序列化进datasource_change_log的plan_json，preview=true时也原样返回给调用方
+type Plan struct {
+	DbGroup  string     `json:"db_group"`
+	Action   string     `json:"action"`
+	DstTable string     `json:"dst_table"`
+	Interval int        `json:"interval"`
+	Duration int        `json:"duration"`
+	Nodes    []NodePlan `json:"nodes"`
+}
+
+// openClickhouseConns按m.ckAddrs依次建连接，和Handle原来的实现一样；BuildPlan/ExecutePlan/Handle
+// 三处都要打开同一组连接，抽出来避免重复
+func (m *DatasourceManager) openClickhouseConns() (cks []clickhouse.Conn, addrs []string, err error) {
+	for _, addr := range m.ckAddrs {
+		if len(addr) == 0 {
+			continue
+		}
+		ck, err := clickhouse.Open(&clickhouse.Options{
+			Addr: []string{addr},
+			Auth: clickhouse.Auth{
+				Database: "default",
+				Username: m.user,
+				Password: m.password,
+			},
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		cks = append(cks, ck)
+		addrs = append(addrs, addr)
+	}
+	if len(cks) == 0 {
+		return nil, nil, fmt.Errorf("invalid clickhouse addrs: Addrs=%v ", m.ckAddrs)
+	}
+	return cks, addrs, nil
+}
+
+func closeClickhouseConns(cks []clickhouse.Conn) {
+	for _, ck := range cks {
+		ck.Close()
+	}
+}
+
+// buildNodePlan渲染单个节点要跑的全部SQL（ADD是agg/mv/local/global四条，MOD一条TTL变更，DEL按
+// global/local/mv/agg的顺序逐条删），并检查一遍涉及的表在这个节点的system.tables里的现状，
+// 这些drift只记录到Diffs里，不会阻止Apply——阻止与否是运维在拿到preview结果之后自己判断
+func (m *DatasourceManager) buildNodePlan(ck clickhouse.Conn, addr string, actionEnum ActionEnum, tableId zerodoc.MetricsTableID, dstTable, aggrSummable, aggrUnsummable string, aggInterval IntervalEnum, duration int) NodePlan {
+	plan := NodePlan{Addr: addr}
+	table := getMetricsTable(tableId)
+
+	switch actionEnum {
+	case ADD:
+		aggTable := getMetricsTableName(table.ID, dstTable, AGG)
+		if _, exists, err := m.describeCreateTable(ck, aggTable); err != nil {
+			plan.Diffs = append(plan.Diffs, fmt.Sprintf("failed to inspect %s on %s: %s", aggTable, addr, err))
+		} else if exists {
+			plan.Diffs = append(plan.Diffs, fmt.Sprintf("%s already exists on %s, CREATE TABLE IF NOT EXISTS will be a no-op", aggTable, addr))
+		}
+
+		partitionTime := ckdb.TimeFuncWeek
+		aggTimeFunc := ckdb.TimeFuncHour
+		if aggInterval == IntervalDay {
+			partitionTime = ckdb.TimeFuncYYYYMM
+			aggTimeFunc = ckdb.TimeFuncDay
+		}
+
+		plan.Steps = []PlanStep{
+			{TableID: tableId, TableType: AGG, Apply: m.makeAggTableCreateSQL(table, dstTable, aggrSummable, aggrUnsummable, partitionTime, duration),
+				Rollback: "DROP TABLE IF EXISTS " + aggTable},
+			{TableID: tableId, TableType: MV, Apply: MakeMVTableCreateSQL(table, dstTable, aggrSummable, aggrUnsummable, aggTimeFunc),
+				Rollback: "DROP TABLE IF EXISTS " + getMetricsTableName(table.ID, dstTable, MV)},
+			{TableID: tableId, TableType: LOCAL, Apply: MakeCreateTableLocal(table, dstTable, aggrSummable, aggrUnsummable),
+				Rollback: "DROP TABLE IF EXISTS " + getMetricsTableName(table.ID, dstTable, LOCAL)},
+			{TableID: tableId, TableType: GLOBAL, Apply: MakeGlobalTableCreateSQL(table, dstTable),
+				Rollback: "DROP TABLE IF EXISTS " + getMetricsTableName(table.ID, dstTable, GLOBAL)},
+		}
+	case MOD:
+		tableMod := getMetricsTableName(table.ID, dstTable, AGG)
+		if dstTable == ORIGIN_TABLE_1M || dstTable == ORIGIN_TABLE_1S {
+			tableMod = getMetricsTableName(uint8(tableId), "", LOCAL)
+		}
+		newTTL := makeTTLString(table.TimeKey, duration, m.ckdbS3Enabled, m.ckdbS3Volume, m.ckdbS3TTLTimes)
+
+		createStmt, exists, err := m.describeCreateTable(ck, tableMod)
+		if err != nil {
+			plan.Diffs = append(plan.Diffs, fmt.Sprintf("failed to inspect %s on %s: %s", tableMod, addr, err))
+		}
+		rollback := ""
+		if exists {
+			if existingTTL := extractTTLClause(createStmt); existingTTL != "" {
+				if existingTTL == newTTL {
+					plan.Diffs = append(plan.Diffs, fmt.Sprintf("%s on %s already has TTL %s, MOD is a no-op", tableMod, addr, newTTL))
+				}
+				rollback = fmt.Sprintf("ALTER TABLE %s MODIFY TTL %s", tableMod, existingTTL)
+			}
+		}
+
+		plan.Steps = []PlanStep{
+			{TableID: tableId, TableType: AGG, Apply: fmt.Sprintf("ALTER TABLE %s MODIFY TTL %s", tableMod, newTTL), Rollback: rollback},
+		}
+	case DEL:
+		for _, tt := range []TableType{GLOBAL, LOCAL, MV, AGG} {
+			name := getMetricsTableName(uint8(tableId), dstTable, tt)
+			createStmt, exists, err := m.describeCreateTable(ck, name)
+			if err != nil {
+				plan.Diffs = append(plan.Diffs, fmt.Sprintf("failed to inspect %s on %s: %s", name, addr, err))
+			}
+			rollback := ""
+			if exists {
+				rollback = createStmt
+			}
+			plan.Steps = append(plan.Steps, PlanStep{TableID: tableId, TableType: tt, Apply: "DROP TABLE IF EXISTS " + name, Rollback: rollback})
+		}
+	}
+
+	return plan
+}
+
+// describeCreateTable从system.tables读出一个表当前的建表语句，用来判断ADD/MOD阶段是否有schema
+// drift、以及给MOD/DEL的补偿脚本提供"把表恢复成执行前的样子"所需的语句。表不存在时exists为false，
+// 这种情况不是错误
+func (m *DatasourceManager) describeCreateTable(ck clickhouse.Conn, fullTableName string) (createStmt string, exists bool, err error) {
+	database, name := splitTableName(fullTableName)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	row := ck.QueryRow(ctx, "SELECT create_table_query FROM system.tables WHERE database = ? AND name = ?", database, name)
+	if scanErr := row.Scan(&createStmt); scanErr != nil {
+		return "", false, nil
+	}
+	return createStmt, true, nil
+}
+
+// splitTableName把getMetricsTableName拼出来的"db.`table`"或"db.`prefix.table`"形式拆成
+// system.tables查询要用的database、name两列
+func splitTableName(fullTableName string) (database, name string) {
+	parts := strings.SplitN(fullTableName, ".", 2)
+	if len(parts) != 2 {
+		return "", strings.Trim(fullTableName, "`")
+	}
+	return parts[0], strings.Trim(parts[1], "`")
+}
+
+// extractTTLClause从ClickHouse的create_table_query里把"TTL ... SETTINGS"之间那一段表达式抠出来，
+// 查不到就返回空字符串（调用方当作"没有可比较的既有TTL"处理）
+func extractTTLClause(createStmt string) string {
+	idx := strings.Index(createStmt, "TTL ")
+	if idx < 0 {
+		return ""
+	}
+	rest := createStmt[idx+len("TTL "):]
+	if end := strings.Index(rest, " SETTINGS"); end >= 0 {
+		rest = rest[:end]
+	}
+	return strings.TrimSpace(rest)
+}
+
+// BuildPlan是preview=true和preview=false都会先走的规划阶段：对每个ck节点渲染出完整的SQL步骤序列，
+// 不执行任何语句。校验逻辑和原来Handle里的一致，搬到了validateAddParams里复用，而不是重复一份
+func (m *DatasourceManager) BuildPlan(dbGroup, action, baseTable, dstTable, aggrSummable, aggrUnsummable string, interval, duration int) (*Plan, error) {
+	if (dbGroup == FLOW_LOG_L4 || dbGroup == FLOW_LOG_L7) && action == actionStrings[MOD] {
+		return nil, fmt.Errorf("flow_log.l4/l7 MOD does not support planning/rollback, call Handle directly")
+	}
+
+	subTableIDs, err := getMetricsSubTableIDs(dbGroup, baseTable)
+	if err != nil {
+		return nil, err
+	}
+	actionEnum, err := ActionToEnum(action)
+	if err != nil {
+		return nil, err
+	}
+
+	duration = duration / 24
+	if err := validateAddParams(actionEnum, baseTable, dstTable, aggrSummable, aggrUnsummable, interval, duration); err != nil {
+		return nil, err
+	}
+	if dstTable == "" {
+		return nil, fmt.Errorf("dst table name is empty")
+	}
+
+	aggInterval := IntervalHour
+	if interval == 1440 {
+		aggInterval = IntervalDay
+	}
+
+	cks, addrs, err := m.openClickhouseConns()
+	if err != nil {
+		return nil, err
+	}
+	defer closeClickhouseConns(cks)
+
+	plan := &Plan{DbGroup: dbGroup, Action: action, DstTable: dstTable, Interval: interval, Duration: duration}
+	for i, ck := range cks {
+		nodePlan := NodePlan{Addr: addrs[i]}
+		for _, tableId := range subTableIDs {
+			stepPlan := m.buildNodePlan(ck, addrs[i], actionEnum, tableId, dstTable, aggrSummable, aggrUnsummable, aggInterval, duration)
+			nodePlan.Steps = append(nodePlan.Steps, stepPlan.Steps...)
+			nodePlan.Diffs = append(nodePlan.Diffs, stepPlan.Diffs...)
+		}
+		plan.Nodes = append(plan.Nodes, nodePlan)
+	}
+	return plan, nil
+}
+
+// ExecutePlan按节点顺序执行BuildPlan渲染好的步骤，每条PlanStep成功后就地标记Applied=true（checkpoint）。
+// 一旦某一步失败：先回滚当前节点里已经Applied的步骤（逆序），再回滚更早、已经整节点跑完的那些节点
+// （同样逆序），尽量让集群回到执行前的状态，然后把原始错误返回。单条补偿语句本身失败不会中断其它
+// 补偿，只记error日志——DROP/MODIFY TTL失败的概率远低于原始建表语句，真出现了也需要运维从日志里
+// 定位具体是哪个节点没有回滚干净
+func (m *DatasourceManager) ExecutePlan(plan *Plan) (err error) {
+	cks, addrs, err := m.openClickhouseConns()
+	if err != nil {
+		return err
+	}
+	defer closeClickhouseConns(cks)
+	if len(cks) != len(plan.Nodes) {
+		return fmt.Errorf("clickhouse node count changed since the plan was built (had %d, now %d)", len(plan.Nodes), len(cks))
+	}
+
+	appliedNodes := make([]int, 0, len(plan.Nodes))
+	defer func() {
+		if err == nil {
+			return
+		}
+		for i := len(appliedNodes) - 1; i >= 0; i-- {
+			rollbackNode(cks[appliedNodes[i]], &plan.Nodes[appliedNodes[i]])
+		}
+	}()
+
+	for i := range plan.Nodes {
+		if addrs[i] != plan.Nodes[i].Addr {
+			return fmt.Errorf("clickhouse node order changed since the plan was built (had %s, now %s)", plan.Nodes[i].Addr, addrs[i])
+		}
+		for stepIdx := range plan.Nodes[i].Steps {
+			step := &plan.Nodes[i].Steps[stepIdx]
+			if step.Apply == "" {
+				continue
+			}
+			log.Info(step.Apply)
+			if applyErr := ckwriter.ExecSQL(cks[i], step.Apply); applyErr != nil {
+				rollbackNode(cks[i], &plan.Nodes[i])
+				return fmt.Errorf("apply failed on node %s, step %s: %w", plan.Nodes[i].Addr, step.Apply, applyErr)
+			}
+			step.Applied = true
+		}
+		appliedNodes = append(appliedNodes, i)
+	}
+	return nil
+}
+
+// rollbackNode把一个节点里已经Applied的PlanStep逐条回放Rollback语句，逆序执行（后建的先删、
+// 先改的后恢复）
+func rollbackNode(ck clickhouse.Conn, node *NodePlan) {
+	for i := len(node.Steps) - 1; i >= 0; i-- {
+		step := &node.Steps[i]
+		if !step.Applied || step.Rollback == "" {
+			continue
+		}
+		log.Infof("rollback on %s: %s", node.Addr, step.Rollback)
+		if err := ckwriter.ExecSQL(ck, step.Rollback); err != nil {
+			log.Errorf("compensating rollback failed on %s (%s): %s", node.Addr, step.Rollback, err)
+			continue
+		}
+		step.Applied = false
+	}
+}
+
+func validateAddParams(actionEnum ActionEnum, baseTable, dstTable, aggrSummable, aggrUnsummable string, interval, duration int) error {
+	if actionEnum != ADD {
+		return nil
+	}
+	if baseTable == "" {
+		return fmt.Errorf("base table name is empty")
+	}
+	if _, err := AggrToEnum(aggrSummable); err != nil {
+		return err
+	}
+	if _, err := AggrToEnum(aggrUnsummable); err != nil {
+		return err
+	}
+	if interval != 60 && interval != 1440 {
+		return fmt.Errorf("interval(%d) only support 60 or 1440.", interval)
+	}
+	if duration < 1 {
+		return fmt.Errorf("duration(%d) must bigger than 0.", duration)
+	}
+	if baseTable == dstTable {
+		return fmt.Errorf("base table(%s) should not the same as the dst table(%s)", baseTable, dstTable)
+	}
+	return nil
+}
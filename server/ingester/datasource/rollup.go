@@ -0,0 +1,305 @@
+/*
+ * Copyright (c) 2022 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package datasource
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/deepflowys/deepflow/server/libs/ckdb"
+	"github.com/deepflowys/deepflow/server/libs/zerodoc"
+
+	clickhouse "github.com/ClickHouse/clickhouse-go/v2"
+)
+
+// RetentionPolicy描述rollup DAG里的一个tier，对应Prometheus/夜莺recording rule里的一条规则：
+// 从Source（另一个tier的名字，或者1s/1m这两个origin表）聚合出一份新的、更粗粒度的数据，按TTL
+// 保留。Name同时也是建表时用的dstTable
+type RetentionPolicy struct {
+	Name           string `yaml:"name"`
+	Source         string `yaml:"source"`
+	Interval       int    `yaml:"interval"` // 单位：秒
+	TTL            int    `yaml:"ttl"`      // 单位：天
+	SummableAggr   string `yaml:"summable-aggr"`
+	UnsummableAggr string `yaml:"unsummable-aggr"`
+	PartitionBy    string `yaml:"partition-by"` // "week" 或 "month"
+}
+
+func (p RetentionPolicy) isRoot() bool {
+	return p.Source == ORIGIN_TABLE_1S || p.Source == ORIGIN_TABLE_1M
+}
+
+func (p RetentionPolicy) partitionTime() (ckdb.TimeFuncType, error) {
+	switch p.PartitionBy {
+	case "week":
+		return ckdb.TimeFuncWeek, nil
+	case "month":
+		return ckdb.TimeFuncYYYYMM, nil
+	default:
+		return 0, fmt.Errorf("retention policy %s has unsupported partition-by %q, want week or month", p.Name, p.PartitionBy)
+	}
+}
+
+// aggTimeFunc按Interval有没有达到一天选时间折叠函数，沿用原来60分钟/1440分钟两档的判断：Interval
+// 不小于一天时按天折叠，其余一律按小时折叠，秒级、分钟级（比如10s、5m）的tier不会得到和Interval
+// 一样宽的时间桶
+func (p RetentionPolicy) aggTimeFunc() ckdb.TimeFuncType {
+	const secondsPerDay = 24 * 60 * 60
+	if p.Interval >= secondsPerDay {
+		return ckdb.TimeFuncDay
+	}
+	return ckdb.TimeFuncHour
+}
+
+// rootInterval是1s/1m这两个origin表本身的采样间隔，DAG的Interval兼容性检查以它们为起点
+func rootInterval(root string) int {
+	if root == ORIGIN_TABLE_1S {
+		return 1
+	}
+	return 60
+}
+
+// sortRetentionPolicies对一组RetentionPolicy做拓扑排序并校验：Source必须指向1s/1m或者同一批
+// policy里的另一个Name（不能指向DAG外面的东西）、不能有环、每一级的Interval必须是它父级Interval
+// 的整数倍（合并窗口对不齐的话GROUP BY出来的桶边界和父tier对不上，数据会被错误地拆分或合并）。
+// 返回的顺序保证父tier总是排在子tier前面，ReconcileRetentionPolicies据此决定建表顺序
+func sortRetentionPolicies(policies []RetentionPolicy) ([]RetentionPolicy, error) {
+	byName := make(map[string]RetentionPolicy, len(policies))
+	for _, p := range policies {
+		if _, dup := byName[p.Name]; dup {
+			return nil, fmt.Errorf("duplicate retention policy name %q", p.Name)
+		}
+		byName[p.Name] = p
+	}
+	for _, p := range policies {
+		if !p.isRoot() {
+			if _, ok := byName[p.Source]; !ok {
+				return nil, fmt.Errorf("retention policy %q has source %q which is neither 1s/1m nor another configured policy", p.Name, p.Source)
+			}
+		}
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[string]int, len(policies))
+	ordered := make([]RetentionPolicy, 0, len(policies))
+
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch state[name] {
+		case visited:
+			return nil
+		case visiting:
+			return fmt.Errorf("retention policy DAG has a cycle involving %q", name)
+		}
+		state[name] = visiting
+		p := byName[name]
+		if !p.isRoot() {
+			if err := visit(p.Source); err != nil {
+				return err
+			}
+			parent := byName[p.Source]
+			if parent.Interval <= 0 || p.Interval%parent.Interval != 0 {
+				return fmt.Errorf("retention policy %q has interval %ds which is not a multiple of its source %q's interval %ds",
+					p.Name, p.Interval, p.Source, parent.Interval)
+			}
+		} else if p.Interval%rootInterval(p.Source) != 0 {
+			return fmt.Errorf("retention policy %q has interval %ds which is not a multiple of %s's interval %ds",
+				p.Name, p.Interval, p.Source, rootInterval(p.Source))
+		}
+		state[name] = visited
+		ordered = append(ordered, p)
+		return nil
+	}
+
+	for _, p := range policies {
+		if err := visit(p.Name); err != nil {
+			return nil, err
+		}
+	}
+	return ordered, nil
+}
+
+// sourceLocalTable返回一个tier从哪张表读数据：根tier读1s/1m origin表自己的LOCAL视图，
+// 非根tier读它Source指向的那个tier的LOCAL视图
+func sourceLocalTable(tableId uint8, p RetentionPolicy) string {
+	if p.isRoot() {
+		return getMetricsTableName(tableId, "", LOCAL)
+	}
+	return getMetricsTableName(tableId, p.Source, LOCAL)
+}
+
+// ReconcileRetentionPolicies是对一个metric family跑一次reconcile的入口，DatasourceManager不会在
+// 启动或配置热加载时自动调用它：把policies排序校验成一个DAG之后，按顺序对每个ck节点创建缺失的tier、给TTL变了的tier
+// 发MOD、把不再出现在policies里但之前建过的tier删掉。和Handle的单个add/mod/del请求不同，这里
+// 一次要处理一整条链，所以不复用BuildPlan/ExecutePlan（它们是单个action的两阶段提交），而是对每个
+// tier分别检查、执行，某个tier失败就整体返回错误——链条上更靠前、已经建好的tier不受影响，运维下次
+// reconcile重试即可收敛，不需要像单个add/mod/del请求那样追求跨节点原子性
+func (m *DatasourceManager) ReconcileRetentionPolicies(tableGroup, baseTable string, policies []RetentionPolicy) error {
+	ordered, err := sortRetentionPolicies(policies)
+	if err != nil {
+		return err
+	}
+
+	subTableIDs, err := getMetricsSubTableIDs(tableGroup, baseTable)
+	if err != nil {
+		return err
+	}
+
+	cks, _, err := m.openClickhouseConns()
+	if err != nil {
+		return err
+	}
+	defer closeClickhouseConns(cks)
+
+	desired := make(map[string]bool, len(ordered))
+	for _, p := range ordered {
+		desired[p.Name] = true
+	}
+
+	for _, tableId := range subTableIDs {
+		previous, loadErr := m.loadRetentionPolicyState(tableGroup, uint8(tableId))
+		if loadErr != nil {
+			log.Errorf("failed to load previous retention policy state for %s: %s", tableGroup, loadErr)
+		}
+
+		for _, p := range ordered {
+			for _, ck := range cks {
+				if err := m.reconcileTier(ck, tableId, p); err != nil {
+					return fmt.Errorf("reconcile tier %q of %s failed: %w", p.Name, tableGroup, err)
+				}
+			}
+		}
+
+		for _, name := range previous {
+			if desired[name] {
+				continue
+			}
+			log.Infof("retention policy %q for %s is no longer configured, dropping its tables", name, tableGroup)
+			for _, ck := range cks {
+				if err := dropTier(ck, uint8(tableId), name); err != nil {
+					log.Errorf("failed to drop removed retention policy %q: %s", name, err)
+				}
+			}
+		}
+
+		m.saveRetentionPolicyState(tableGroup, uint8(tableId), policyNames(ordered))
+	}
+	return nil
+}
+
+// reconcileTier对单个ck节点、单个zerodoc.MetricsTableID把一个tier同步到期望状态：表不存在就
+// 按AGG/MV/LOCAL/GLOBAL四件套创建，存在则只检查TTL是否需要MOD——tier一旦建成, schema(列、
+// 聚合函数、GROUP BY)不会再变，变了应该是新建一个tier而不是修改现有的
+func (m *DatasourceManager) reconcileTier(ck clickhouse.Conn, tableId zerodoc.MetricsTableID, p RetentionPolicy) error {
+	table := getMetricsTable(tableId)
+	aggTable := getMetricsTableName(table.ID, p.Name, AGG)
+
+	createStmt, exists, err := m.describeCreateTable(ck, aggTable)
+	if err != nil {
+		return err
+	}
+
+	if !exists {
+		partitionTime, err := p.partitionTime()
+		if err != nil {
+			return err
+		}
+		sourceTable := sourceLocalTable(table.ID, p)
+		commands := []string{
+			m.makeAggTableCreateSQL(table, p.Name, p.SummableAggr, p.UnsummableAggr, partitionTime, p.TTL),
+			MakeMVTableCreateSQLFrom(table, p.Name, sourceTable, p.SummableAggr, p.UnsummableAggr, p.aggTimeFunc()),
+			MakeCreateTableLocal(table, p.Name, p.SummableAggr, p.UnsummableAggr),
+			MakeGlobalTableCreateSQL(table, p.Name),
+		}
+		for _, cmd := range commands {
+			log.Info(cmd)
+			if err := ckwriter.ExecSQL(ck, cmd); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	wantTTL := makeTTLString(table.TimeKey, p.TTL, m.ckdbS3Enabled, m.ckdbS3Volume, m.ckdbS3TTLTimes)
+	if extractTTLClause(createStmt) == wantTTL {
+		return nil
+	}
+	modTable := fmt.Sprintf("ALTER TABLE %s MODIFY TTL %s", aggTable, wantTTL)
+	log.Info(modTable)
+	return ckwriter.ExecSQL(ck, modTable)
+}
+
+// dropTier按global/local/mv/agg的顺序把一个不再出现在配置里的tier删掉，和delTableMV以前的做法
+// 一致
+func dropTier(ck clickhouse.Conn, tableId uint8, name string) error {
+	for _, tt := range []TableType{GLOBAL, LOCAL, MV, AGG} {
+		if err := ckwriter.ExecSQL(ck, "DROP TABLE IF EXISTS "+getMetricsTableName(tableId, name, tt)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func policyNames(policies []RetentionPolicy) []string {
+	names := make([]string, len(policies))
+	for i, p := range policies {
+		names[i] = p.Name
+	}
+	return names
+}
+
+// RetentionPolicyState是retention_policy_state表的行模型，记录"上一次reconcile时，某个metric
+// family在某个MetricsTableID下实际生效的tier名单"，下一次reconcile据此判断哪些tier从配置里被
+// 删掉了、需要DROP——仅靠这一轮的policies本身没法知道"以前有、现在没有"
+type RetentionPolicyState struct {
+	TableGroup string `gorm:"column:table_group;primaryKey" json:"table_group"`
+	TableID    uint8  `gorm:"column:table_id;primaryKey" json:"table_id"`
+	Names      string `gorm:"column:names" json:"names"` // 逗号分隔的tier名字列表
+}
+
+func (RetentionPolicyState) TableName() string {
+	return "datasource_retention_policy_state"
+}
+
+func (m *DatasourceManager) loadRetentionPolicyState(tableGroup string, tableID uint8) ([]string, error) {
+	if m.changeLogDB == nil {
+		return nil, nil
+	}
+	var state RetentionPolicyState
+	err := m.changeLogDB.Where("table_group = ? AND table_id = ?", tableGroup, tableID).First(&state).Error
+	if err != nil {
+		return nil, nil // 没有历史记录不是错误，当作这是第一次reconcile
+	}
+	if state.Names == "" {
+		return nil, nil
+	}
+	return strings.Split(state.Names, ","), nil
+}
+
+func (m *DatasourceManager) saveRetentionPolicyState(tableGroup string, tableID uint8, names []string) {
+	if m.changeLogDB == nil {
+		return
+	}
+	state := RetentionPolicyState{TableGroup: tableGroup, TableID: tableID, Names: strings.Join(names, ",")}
+	if err := m.changeLogDB.Save(&state).Error; err != nil {
+		log.Errorf("failed to save retention policy state for %s: %s", tableGroup, err)
+	}
+}
@@ -28,6 +28,7 @@ import (
 	"github.com/deepflowys/deepflow/message/trident"
 	"github.com/deepflowys/deepflow/server/ingester/common"
 	"github.com/deepflowys/deepflow/server/ingester/stream/geo"
+	"github.com/deepflowys/deepflow/server/ingester/stream/jsonify/sketch"
 	"github.com/deepflowys/deepflow/server/libs/ckdb"
 	"github.com/deepflowys/deepflow/server/libs/datatype"
 	"github.com/deepflowys/deepflow/server/libs/datatype/pb"
@@ -49,6 +50,7 @@ type FlowLogger struct {
 	TransportLayer
 	ApplicationLayer
 	Internet
+	ProcessLayer
 	KnowledgeGraph
 	FlowInfo
 	Metrics
@@ -111,25 +113,78 @@ type NetworkLayer struct {
 	TunnelRxMac1 uint32 `json:"tunnel_rx_mac_1,omitempty"`
 }
 
-var NetworkLayerColumns = []*ckdb.Column{
+// legacyNetworkLayerIPColumns是ip4_0/ip4_1/ip6_0/ip6_1四列（tunnel_*变体在legacyNetworkLayerTunnelIPColumns里），
+// 每个endpoint各占一个IPv4列和一个IPv6列，查询时必须对两列做OR才能覆盖v4/v6流量
+var legacyNetworkLayerIPColumns = []*ckdb.Column{
 	ckdb.NewColumn("ip4_0", ckdb.IPv4),
 	ckdb.NewColumn("ip4_1", ckdb.IPv4),
 	ckdb.NewColumn("ip6_0", ckdb.IPv6),
 	ckdb.NewColumn("ip6_1", ckdb.IPv6),
+}
+
+// unifiedNetworkLayerIPColumns是legacyNetworkLayerIPColumns的替代：每个endpoint只用一个
+// FixedString(16)列（v4地址按"::ffff:a.b.c.d"映射），配合已经存在的is_ipv4列区分地址族，
+// 由UnifiedIPColumnEnabled按表切换是否启用
+var unifiedNetworkLayerIPColumns = []*ckdb.Column{
+	ckdb.NewColumn("ip_0", ckdb.FixedString(16)),
+	ckdb.NewColumn("ip_1", ckdb.FixedString(16)),
+}
+
+func networkLayerIPColumns() []*ckdb.Column {
+	if UnifiedIPColumnEnabled {
+		return unifiedNetworkLayerIPColumns
+	}
+	return legacyNetworkLayerIPColumns
+}
+
+func NetworkLayerColumns() []*ckdb.Column {
+	columns := append([]*ckdb.Column{}, networkLayerIPColumns()...)
+	columns = append(columns, networkLayerNonIPColumns...)
+	columns = append(columns, networkLayerTunnelIPColumns()...)
+	columns = append(columns, networkLayerTunnelTrailerColumns...)
+	return columns
+}
+
+// legacyNetworkLayerTunnelIPColumns/unifiedNetworkLayerTunnelIPColumns是tunnel tx/rx两个
+// 方向的endpoint地址列，和legacyNetworkLayerIPColumns/unifiedNetworkLayerIPColumns是同一套
+// v4/v6 pair-per-endpoint对FixedString(16)-per-endpoint的替换，原因一样
+// tunnel_*_ip6_*四列是在老表上新增的，已有表里这些行一律是NULL，所以要SetNullable，
+// 升级时按ALTER TABLE ADD COLUMN Nullable(IPv6)下发，不用回填存量数据
+var legacyNetworkLayerTunnelIPColumns = []*ckdb.Column{
+	ckdb.NewColumn("tunnel_tx_ip4_0", ckdb.IPv4),
+	ckdb.NewColumn("tunnel_tx_ip4_1", ckdb.IPv4),
+	ckdb.NewColumn("tunnel_tx_ip6_0", ckdb.IPv6).SetNullable(),
+	ckdb.NewColumn("tunnel_tx_ip6_1", ckdb.IPv6).SetNullable(),
+	ckdb.NewColumn("tunnel_rx_ip4_0", ckdb.IPv4),
+	ckdb.NewColumn("tunnel_rx_ip4_1", ckdb.IPv4),
+	ckdb.NewColumn("tunnel_rx_ip6_0", ckdb.IPv6).SetNullable(),
+	ckdb.NewColumn("tunnel_rx_ip6_1", ckdb.IPv6).SetNullable(),
+}
+
+var unifiedNetworkLayerTunnelIPColumns = []*ckdb.Column{
+	ckdb.NewColumn("tunnel_tx_ip_0", ckdb.FixedString(16)),
+	ckdb.NewColumn("tunnel_tx_ip_1", ckdb.FixedString(16)),
+	ckdb.NewColumn("tunnel_rx_ip_0", ckdb.FixedString(16)),
+	ckdb.NewColumn("tunnel_rx_ip_1", ckdb.FixedString(16)),
+}
+
+func networkLayerTunnelIPColumns() []*ckdb.Column {
+	if UnifiedIPColumnEnabled {
+		return unifiedNetworkLayerTunnelIPColumns
+	}
+	return legacyNetworkLayerTunnelIPColumns
+}
+
+var networkLayerNonIPColumns = []*ckdb.Column{
 	ckdb.NewColumn("is_ipv4", ckdb.UInt8).SetIndex(ckdb.IndexMinmax),
 	ckdb.NewColumn("protocol", ckdb.UInt8),
 	ckdb.NewColumn("tunnel_tier", ckdb.UInt8),
 	ckdb.NewColumn("tunnel_type", ckdb.UInt16),
 	ckdb.NewColumn("tunnel_tx_id", ckdb.UInt32),
 	ckdb.NewColumn("tunnel_rx_id", ckdb.UInt32),
-	ckdb.NewColumn("tunnel_tx_ip4_0", ckdb.IPv4),
-	ckdb.NewColumn("tunnel_tx_ip4_1", ckdb.IPv4),
-	ckdb.NewColumn("tunnel_rx_ip4_0", ckdb.IPv4),
-	ckdb.NewColumn("tunnel_rx_ip4_1", ckdb.IPv4),
-	ckdb.NewColumn("tunnel_tx_ip6_0", ckdb.IPv6),
-	ckdb.NewColumn("tunnel_tx_ip6_1", ckdb.IPv6),
-	ckdb.NewColumn("tunnel_rx_ip6_0", ckdb.IPv6),
-	ckdb.NewColumn("tunnel_rx_ip6_1", ckdb.IPv6),
+}
+
+var networkLayerTunnelTrailerColumns = []*ckdb.Column{
 	ckdb.NewColumn("tunnel_is_ipv4", ckdb.UInt8).SetIndex(ckdb.IndexMinmax),
 	ckdb.NewColumn("tunnel_tx_mac_0", ckdb.UInt32),
 	ckdb.NewColumn("tunnel_tx_mac_1", ckdb.UInt32),
@@ -137,23 +192,50 @@ var NetworkLayerColumns = []*ckdb.Column{
 	ckdb.NewColumn("tunnel_rx_mac_1", ckdb.UInt32),
 }
 
-func (n *NetworkLayer) WriteBlock(block *ckdb.Block) error {
-	if err := block.WriteIPv4(n.IP40); err != nil {
-		return err
+// writeEndpointIPs写出一对endpoint地址：UnifiedIPColumnEnabled关闭时按ip4_0/ip4_1/ip6_0/ip6_1
+// legacy四列写，开启时合并成ip_0/ip_1两个FixedString(16)列
+func writeEndpointIPs(block *ckdb.Block, ip40, ip41 uint32, ip60, ip61 net.IP) error {
+	if len(ip60) == 0 {
+		ip60 = net.IPv6zero
 	}
-	if err := block.WriteIPv4(n.IP41); err != nil {
-		return err
+	if len(ip61) == 0 {
+		ip61 = net.IPv6zero
+	}
+	if !UnifiedIPColumnEnabled {
+		if err := block.WriteIPv4(ip40); err != nil {
+			return err
+		}
+		if err := block.WriteIPv4(ip41); err != nil {
+			return err
+		}
+		if err := block.WriteIPv6(ip60); err != nil {
+			return err
+		}
+		if err := block.WriteIPv6(ip61); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	addr0 := NetworkAddrFromIPv4(ip40)
+	addr1 := NetworkAddrFromIPv4(ip41)
+	if len(ip60) == 16 && !ip60.Equal(net.IPv6zero) {
+		addr0 = NetworkAddrFromIPv6(ip60)
 	}
-	if len(n.IP60) == 0 {
-		n.IP60 = net.IPv6zero
+	if len(ip61) == 16 && !ip61.Equal(net.IPv6zero) {
+		addr1 = NetworkAddrFromIPv6(ip61)
 	}
-	if err := block.WriteIPv6(n.IP60); err != nil {
+	if err := block.WriteBytes(addr0.Bytes[:]); err != nil {
 		return err
 	}
-	if len(n.IP61) == 0 {
-		n.IP61 = net.IPv6zero
+	if err := block.WriteBytes(addr1.Bytes[:]); err != nil {
+		return err
 	}
-	if err := block.WriteIPv6(n.IP61); err != nil {
+	return nil
+}
+
+func (n *NetworkLayer) WriteBlock(block *ckdb.Block) error {
+	if err := writeEndpointIPs(block, n.IP40, n.IP41, n.IP60, n.IP61); err != nil {
 		return err
 	}
 
@@ -176,40 +258,10 @@ func (n *NetworkLayer) WriteBlock(block *ckdb.Block) error {
 	if err := block.WriteUInt32(n.TunnelRxID); err != nil {
 		return err
 	}
-	if err := block.WriteIPv4(n.TunnelTxIP40); err != nil {
-		return err
-	}
-	if err := block.WriteIPv4(n.TunnelTxIP41); err != nil {
+	if err := writeEndpointIPs(block, n.TunnelTxIP40, n.TunnelTxIP41, n.TunnelTxIP60, n.TunnelTxIP61); err != nil {
 		return err
 	}
-	if err := block.WriteIPv4(n.TunnelRxIP40); err != nil {
-		return err
-	}
-	if err := block.WriteIPv4(n.TunnelRxIP41); err != nil {
-		return err
-	}
-	if len(n.TunnelTxIP60) == 0 {
-		n.TunnelTxIP60 = net.IPv6zero
-	}
-	if len(n.TunnelTxIP61) == 0 {
-		n.TunnelTxIP61 = net.IPv6zero
-	}
-	if len(n.TunnelRxIP60) == 0 {
-		n.TunnelRxIP60 = net.IPv6zero
-	}
-	if len(n.TunnelRxIP61) == 0 {
-		n.TunnelRxIP61 = net.IPv6zero
-	}
-	if err := block.WriteIPv6(n.TunnelTxIP60); err != nil {
-		return err
-	}
-	if err := block.WriteIPv6(n.TunnelTxIP61); err != nil {
-		return err
-	}
-	if err := block.WriteIPv6(n.TunnelRxIP60); err != nil {
-		return err
-	}
-	if err := block.WriteIPv6(n.TunnelRxIP61); err != nil {
+	if err := writeEndpointIPs(block, n.TunnelRxIP40, n.TunnelRxIP41, n.TunnelRxIP60, n.TunnelRxIP61); err != nil {
 		return err
 	}
 	if err := block.WriteBool(n.TunnelIsIPv4); err != nil {
@@ -284,17 +336,21 @@ func (t *TransportLayer) WriteBlock(block *ckdb.Block) error {
 
 type ApplicationLayer struct {
 	L7Protocol uint8 `json:"l7_protocol,omitempty"` // HTTP, DNS, others
+	L7ResponseInfo
 }
 
-var ApplicationLayerColumns = []*ckdb.Column{
+var ApplicationLayerColumns = append([]*ckdb.Column{
 	// 应用层
 	ckdb.NewColumn("l7_protocol", ckdb.UInt8).SetIndex(ckdb.IndexMinmax),
-}
+}, L7ResponseInfoColumns...)
 
 func (a *ApplicationLayer) WriteBlock(block *ckdb.Block) error {
 	if err := block.WriteUInt8(a.L7Protocol); err != nil {
 		return err
 	}
+	if err := a.L7ResponseInfo.WriteBlock(block); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -320,6 +376,151 @@ func (i *Internet) WriteBlock(block *ckdb.Block) error {
 	return nil
 }
 
+// ProcessLayer承载eBPF uprobe/kprobe在ClientProcess/ServerProcess这两种tap side上采集到的
+// 内核/运行时上下文，补充fill()里那段"MAC非零优先按MAC查找"的eBPF特判一直缺的schema：
+// 没有这组字段时，flow_log只知道这是一条eBPF流量，但看不到是哪个进程/线程/容器产生的，
+// 只能另外去查独立的ebpf表再按五元组和时间去对；有了这组字段可以直接在flow_log里JOIN。
+// SyscallTraceIDReq/Resp不是按endpoint 0/1分的，而是按请求/响应分：uprobe在原始系统调用上
+// 打的trace id，用来在内核态把一次请求和它的响应关联起来，和L7Protocol之类应用层解析无关
+type ProcessLayer struct {
+	ProcessID0   uint32 `json:"process_id_0,omitempty"`
+	ProcessID1   uint32 `json:"process_id_1,omitempty"`
+	ProcessName0 string `json:"process_name_0,omitempty"`
+	ProcessName1 string `json:"process_name_1,omitempty"`
+	ThreadID0    uint32 `json:"thread_id_0,omitempty"`
+	ThreadID1    uint32 `json:"thread_id_1,omitempty"`
+	ContainerID0 string `json:"container_id_0,omitempty"`
+	ContainerID1 string `json:"container_id_1,omitempty"`
+	CgroupID0    uint64 `json:"cgroup_id_0,omitempty"`
+	CgroupID1    uint64 `json:"cgroup_id_1,omitempty"`
+	NetNS0       uint32 `json:"net_ns_0,omitempty"`
+	NetNS1       uint32 `json:"net_ns_1,omitempty"`
+
+	SyscallTraceIDReq  uint64 `json:"syscall_trace_id_request,omitempty"`
+	SyscallTraceIDResp uint64 `json:"syscall_trace_id_response,omitempty"`
+
+	GoID0 uint32 `json:"go_id_0,omitempty"` // Go协程ID，非Go程序恒为0
+	GoID1 uint32 `json:"go_id_1,omitempty"`
+}
+
+var ProcessLayerColumns = []*ckdb.Column{
+	ckdb.NewColumn("process_id_0", ckdb.UInt32).SetIndex(ckdb.IndexNone),
+	ckdb.NewColumn("process_id_1", ckdb.UInt32).SetIndex(ckdb.IndexNone),
+	ckdb.NewColumn("process_name_0", ckdb.LowCardinalityString),
+	ckdb.NewColumn("process_name_1", ckdb.LowCardinalityString),
+	ckdb.NewColumn("thread_id_0", ckdb.UInt32).SetIndex(ckdb.IndexNone),
+	ckdb.NewColumn("thread_id_1", ckdb.UInt32).SetIndex(ckdb.IndexNone),
+	ckdb.NewColumn("container_id_0", ckdb.String),
+	ckdb.NewColumn("container_id_1", ckdb.String),
+	ckdb.NewColumn("cgroup_id_0", ckdb.UInt64).SetIndex(ckdb.IndexNone),
+	ckdb.NewColumn("cgroup_id_1", ckdb.UInt64).SetIndex(ckdb.IndexNone),
+	ckdb.NewColumn("net_ns_0", ckdb.UInt32).SetIndex(ckdb.IndexNone),
+	ckdb.NewColumn("net_ns_1", ckdb.UInt32).SetIndex(ckdb.IndexNone),
+	ckdb.NewColumn("syscall_trace_id_request", ckdb.UInt64).SetComment("uprobe打的trace id，用于关联同一次系统调用的请求和响应"),
+	ckdb.NewColumn("syscall_trace_id_response", ckdb.UInt64).SetComment("编码同syscall_trace_id_request"),
+	ckdb.NewColumn("go_id_0", ckdb.UInt32).SetComment("Go协程ID，非Go程序或采不到时为0"),
+	ckdb.NewColumn("go_id_1", ckdb.UInt32).SetComment("编码同go_id_0"),
+}
+
+// Fill只在tap side本来就是eBPF的ClientProcess/ServerProcess，或者MAC为0（没有二层信息，
+// 比如host网络命名空间下的容器）时才填充，其它情况下这组字段没有意义，保持全零即可
+func (p *ProcessLayer) Fill(f *pb.Flow) {
+	isProcessSide := f.TapSide == uint32(zerodoc.ClientProcess) || f.TapSide == uint32(zerodoc.ServerProcess)
+	macIsZero := f.MetricsPeerSrc.Mac == 0 && f.MetricsPeerDst.Mac == 0
+	if !isProcessSide && !macIsZero {
+		return
+	}
+
+	p.ProcessID0 = f.MetricsPeerSrc.ProcessId
+	p.ProcessID1 = f.MetricsPeerDst.ProcessId
+	p.ProcessName0 = f.MetricsPeerSrc.ProcessKname
+	p.ProcessName1 = f.MetricsPeerDst.ProcessKname
+	p.ThreadID0 = f.MetricsPeerSrc.ThreadId
+	p.ThreadID1 = f.MetricsPeerDst.ThreadId
+	p.ContainerID0 = f.MetricsPeerSrc.ContainerId
+	p.ContainerID1 = f.MetricsPeerDst.ContainerId
+	p.CgroupID0 = f.MetricsPeerSrc.CgroupId
+	p.CgroupID1 = f.MetricsPeerDst.CgroupId
+	p.NetNS0 = f.MetricsPeerSrc.NetNs
+	p.NetNS1 = f.MetricsPeerDst.NetNs
+
+	p.SyscallTraceIDReq = f.MetricsPeerSrc.SyscallTraceIdRequest
+	p.SyscallTraceIDResp = f.MetricsPeerDst.SyscallTraceIdResponse
+
+	p.GoID0 = f.MetricsPeerSrc.GoId
+	p.GoID1 = f.MetricsPeerDst.GoId
+}
+
+func (p *ProcessLayer) WriteBlock(block *ckdb.Block) error {
+	if err := block.WriteUInt32(p.ProcessID0); err != nil {
+		return err
+	}
+	if err := block.WriteUInt32(p.ProcessID1); err != nil {
+		return err
+	}
+	if err := block.WriteString(p.ProcessName0); err != nil {
+		return err
+	}
+	if err := block.WriteString(p.ProcessName1); err != nil {
+		return err
+	}
+	if err := block.WriteUInt32(p.ThreadID0); err != nil {
+		return err
+	}
+	if err := block.WriteUInt32(p.ThreadID1); err != nil {
+		return err
+	}
+	if err := block.WriteString(p.ContainerID0); err != nil {
+		return err
+	}
+	if err := block.WriteString(p.ContainerID1); err != nil {
+		return err
+	}
+	if err := block.WriteUInt64(p.CgroupID0); err != nil {
+		return err
+	}
+	if err := block.WriteUInt64(p.CgroupID1); err != nil {
+		return err
+	}
+	if err := block.WriteUInt32(p.NetNS0); err != nil {
+		return err
+	}
+	if err := block.WriteUInt32(p.NetNS1); err != nil {
+		return err
+	}
+	if err := block.WriteUInt64(p.SyscallTraceIDReq); err != nil {
+		return err
+	}
+	if err := block.WriteUInt64(p.SyscallTraceIDResp); err != nil {
+		return err
+	}
+	if err := block.WriteUInt32(p.GoID0); err != nil {
+		return err
+	}
+	if err := block.WriteUInt32(p.GoID1); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// policyDirectionEgress/policyDirectionIngress是QueryPodNetworkPolicy的查询方向，和
+// trident上报的NetworkPolicy方向枚举保持一致；这个枚举还没有收录进datatype包，先在这里
+// 本地定义，避免为了两个常量去扩一次公共包
+const (
+	policyDirectionEgress  uint8 = 1
+	policyDirectionIngress uint8 = 2
+)
+
+// PolicyAction*取值：0表示没有命中NetworkPolicy，1/2/3分别对应allow/drop/reject，
+// 和QueryPodNetworkPolicy返回的action编码保持一致
+const (
+	policyActionNone   uint8 = 0
+	policyActionAllow  uint8 = 1
+	policyActionDrop   uint8 = 2
+	policyActionReject uint8 = 3
+)
+
 type KnowledgeGraph struct {
 	RegionID0     uint16 `json:"region_id_0"`
 	RegionID1     uint16 `json:"region_id_1"`
@@ -363,6 +564,18 @@ type KnowledgeGraph struct {
 	ResourceGl1Type1 uint8
 	ResourceGl2ID1   uint32
 	ResourceGl2Type1 uint8
+
+	// PolicyID/PolicyRuleID/PolicyAction是这条flow在Pod两端各自命中的Kubernetes
+	// NetworkPolicy：0端是发送方，查的是它的Egress策略；1端是接收方，查的是它的Ingress
+	// 策略，跟antrea给每个Pod flow挂上matched NetworkPolicy/rule的做法一致——同一条flow
+	// 只有这两个方向有意义，另外两个方向（0端的Ingress、1端的Egress）不对应任何实际匹配，
+	// 因此不单独建字段。非Pod流量或没有匹配到policy时全部保持零值
+	PolicyID0     uint32
+	PolicyID1     uint32
+	PolicyRuleID0 uint32
+	PolicyRuleID1 uint32
+	PolicyAction0 uint8
+	PolicyAction1 uint8
 }
 
 var KnowledgeGraphColumns = []*ckdb.Column{
@@ -409,6 +622,13 @@ var KnowledgeGraphColumns = []*ckdb.Column{
 	ckdb.NewColumn("resource_gl1_type_1", ckdb.UInt8),
 	ckdb.NewColumn("resource_gl2_id_1", ckdb.UInt32),
 	ckdb.NewColumn("resource_gl2_type_1", ckdb.UInt8),
+
+	ckdb.NewColumn("policy_id_0", ckdb.UInt32).SetComment("0端（发送方）命中的Egress NetworkPolicy ID，0表示没有命中"),
+	ckdb.NewColumn("policy_id_1", ckdb.UInt32).SetComment("1端（接收方）命中的Ingress NetworkPolicy ID，0表示没有命中"),
+	ckdb.NewColumn("policy_rule_id_0", ckdb.UInt32),
+	ckdb.NewColumn("policy_rule_id_1", ckdb.UInt32),
+	ckdb.NewColumn("policy_action_0", ckdb.UInt8).SetComment("0: none, 1: allow, 2: drop, 3: reject"),
+	ckdb.NewColumn("policy_action_1", ckdb.UInt8).SetComment("0: none, 1: allow, 2: drop, 3: reject"),
 }
 
 func (k *KnowledgeGraph) WriteBlock(block *ckdb.Block) error {
@@ -535,6 +755,25 @@ func (k *KnowledgeGraph) WriteBlock(block *ckdb.Block) error {
 		return err
 	}
 
+	if err := block.WriteUInt32(k.PolicyID0); err != nil {
+		return err
+	}
+	if err := block.WriteUInt32(k.PolicyID1); err != nil {
+		return err
+	}
+	if err := block.WriteUInt32(k.PolicyRuleID0); err != nil {
+		return err
+	}
+	if err := block.WriteUInt32(k.PolicyRuleID1); err != nil {
+		return err
+	}
+	if err := block.WriteUInt8(k.PolicyAction0); err != nil {
+		return err
+	}
+	if err := block.WriteUInt8(k.PolicyAction1); err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -677,6 +916,23 @@ type Metrics struct {
 	RRTMax       uint32 `json:"rrt_max,omitempty"`        // us
 	CITMax       uint32 `json:"cit_max,omitempty"`        // us
 
+	RTTClientDigest LatencyDigest `json:"-"`
+	RTTServerDigest LatencyDigest `json:"-"`
+	SRTDigest       LatencyDigest `json:"-"`
+	ARTDigest       LatencyDigest `json:"-"`
+	RRTDigest       LatencyDigest `json:"-"`
+	CITDigest       LatencyDigest `json:"-"`
+
+	// 这组*Sketch是SketchEnabled开启时才非nil：和上面按sum/count反推的*Digest不同，
+	// 这是agent逐样本落桶后上报的真实分布；WriteBlock只把分桶和聚合字段原样写进*_sketch_*列，
+	// p50/p95/p99由查询侧按桶重建，相对误差由alpha决定
+	RTTClientSketch *sketch.Sketch `json:"-"`
+	RTTServerSketch *sketch.Sketch `json:"-"`
+	SRTSketch       *sketch.Sketch `json:"-"`
+	ARTSketch       *sketch.Sketch `json:"-"`
+	RRTSketch       *sketch.Sketch `json:"-"`
+	CITSketch       *sketch.Sketch `json:"-"`
+
 	RetransTx       uint32 `json:"retrans_tx,omitempty"`
 	RetransRx       uint32 `json:"retrans_rx,omitempty"`
 	ZeroWinTx       uint32 `json:"zero_win_tx,omitempty"`
@@ -728,6 +984,13 @@ var MetricsColumns = []*ckdb.Column{
 	ckdb.NewColumn("rrt_max", ckdb.UInt32).SetIndex(ckdb.IndexNone).SetComment("单位: 微秒"),
 	ckdb.NewColumn("cit_max", ckdb.UInt32).SetIndex(ckdb.IndexNone).SetComment("单位: 微秒"),
 
+	ckdb.NewColumn("rtt_client_digest", ckdb.String).SetComment("merging t-digest二进制编码: 小端uint16质心个数 + 质心个数个(float32 mean, uint32 weight)小端pair，单位: 微秒"),
+	ckdb.NewColumn("rtt_server_digest", ckdb.String).SetComment("编码同rtt_client_digest"),
+	ckdb.NewColumn("srt_digest", ckdb.String).SetComment("编码同rtt_client_digest"),
+	ckdb.NewColumn("art_digest", ckdb.String).SetComment("编码同rtt_client_digest"),
+	ckdb.NewColumn("rrt_digest", ckdb.String).SetComment("编码同rtt_client_digest"),
+	ckdb.NewColumn("cit_digest", ckdb.String).SetComment("编码同rtt_client_digest"),
+
 	ckdb.NewColumn("retrans_tx", ckdb.UInt32).SetIndex(ckdb.IndexNone),
 	ckdb.NewColumn("retrans_rx", ckdb.UInt32).SetIndex(ckdb.IndexNone),
 	ckdb.NewColumn("zero_win_tx", ckdb.UInt32).SetIndex(ckdb.IndexNone),
@@ -740,6 +1003,24 @@ var MetricsColumns = []*ckdb.Column{
 	ckdb.NewColumn("l7_error", ckdb.UInt32).SetIndex(ckdb.IndexNone),
 }
 
+// sketchMetricsColumns是六个延迟指标各自携带的DDSketch列，和*_digest这组列一样常驻schema，
+// SketchEnabled只控制这些列是否被填充（见latency_sketch.go），单独拆出来只是为了和上面
+// sum/count/max/digest这些历史列分开，方便以后按列名整体增删
+var sketchMetricsColumns = func() []*ckdb.Column {
+	columns := []*ckdb.Column{}
+	columns = append(columns, sketchColumns("rtt_client", "client侧建连RTT")...)
+	columns = append(columns, sketchColumns("rtt_server", "server侧建连RTT")...)
+	columns = append(columns, sketchColumns("srt", "系统RTT")...)
+	columns = append(columns, sketchColumns("art", "应用RTT")...)
+	columns = append(columns, sketchColumns("rrt", "L7请求响应时延")...)
+	columns = append(columns, sketchColumns("cit", "客户端等待时间")...)
+	return columns
+}()
+
+func init() {
+	MetricsColumns = append(MetricsColumns, sketchMetricsColumns...)
+}
+
 func (m *Metrics) WriteBlock(block *ckdb.Block) error {
 	if err := block.WriteUInt64(m.PacketTx); err != nil {
 		return err
@@ -844,6 +1125,44 @@ func (m *Metrics) WriteBlock(block *ckdb.Block) error {
 		return err
 	}
 
+	if err := block.WriteBytes(m.RTTClientDigest.Bytes()); err != nil {
+		return err
+	}
+	if err := block.WriteBytes(m.RTTServerDigest.Bytes()); err != nil {
+		return err
+	}
+	if err := block.WriteBytes(m.SRTDigest.Bytes()); err != nil {
+		return err
+	}
+	if err := block.WriteBytes(m.ARTDigest.Bytes()); err != nil {
+		return err
+	}
+	if err := block.WriteBytes(m.RRTDigest.Bytes()); err != nil {
+		return err
+	}
+	if err := block.WriteBytes(m.CITDigest.Bytes()); err != nil {
+		return err
+	}
+
+	if err := writeSketch(block, m.RTTClientSketch); err != nil {
+		return err
+	}
+	if err := writeSketch(block, m.RTTServerSketch); err != nil {
+		return err
+	}
+	if err := writeSketch(block, m.SRTSketch); err != nil {
+		return err
+	}
+	if err := writeSketch(block, m.ARTSketch); err != nil {
+		return err
+	}
+	if err := writeSketch(block, m.RRTSketch); err != nil {
+		return err
+	}
+	if err := writeSketch(block, m.CITSketch); err != nil {
+		return err
+	}
+
 	if err := block.WriteUInt32(m.RetransTx); err != nil {
 		return err
 	}
@@ -877,6 +1196,80 @@ func (m *Metrics) WriteBlock(block *ckdb.Block) error {
 	return nil
 }
 
+// Merge把another的计数器累加进m，并合并六个延迟digest，供flow聚合路径在同一个rollup窗口内
+// 多次Fill之后合并成一条最终落盘的Metrics；sum/count/max和digest的合并语义完全一致——
+// sum/count直接相加、max取较大值、digest.Merge()——这样无论rollup发生在digest加入前还是
+// 加入后，合并出来的结果都是一致的
+func (m *Metrics) Merge(another *Metrics) {
+	m.PacketTx += another.PacketTx
+	m.PacketRx += another.PacketRx
+	m.ByteTx += another.ByteTx
+	m.ByteRx += another.ByteRx
+	m.L3ByteTx += another.L3ByteTx
+	m.L3ByteRx += another.L3ByteRx
+	m.L4ByteTx += another.L4ByteTx
+	m.L4ByteRx += another.L4ByteRx
+	m.TotalPacketTx += another.TotalPacketTx
+	m.TotalPacketRx += another.TotalPacketRx
+	m.TotalByteTx += another.TotalByteTx
+	m.TotalByteRx += another.TotalByteRx
+	m.L7Request += another.L7Request
+	m.L7Response += another.L7Response
+
+	m.RTTClientSum += another.RTTClientSum
+	m.RTTServerSum += another.RTTServerSum
+	m.SRTSum += another.SRTSum
+	m.ARTSum += another.ARTSum
+	m.RRTSum += another.RRTSum
+	m.CITSum += another.CITSum
+
+	m.RTTClientCount += another.RTTClientCount
+	m.RTTServerCount += another.RTTServerCount
+	m.SRTCount += another.SRTCount
+	m.ARTCount += another.ARTCount
+	m.RRTCount += another.RRTCount
+	m.CITCount += another.CITCount
+
+	m.RTTClientMax = maxUint32(m.RTTClientMax, another.RTTClientMax)
+	m.RTTServerMax = maxUint32(m.RTTServerMax, another.RTTServerMax)
+	m.SRTMax = maxUint32(m.SRTMax, another.SRTMax)
+	m.ARTMax = maxUint32(m.ARTMax, another.ARTMax)
+	m.RRTMax = maxUint32(m.RRTMax, another.RRTMax)
+	m.CITMax = maxUint32(m.CITMax, another.CITMax)
+
+	m.RTTClientDigest.Merge(&another.RTTClientDigest)
+	m.RTTServerDigest.Merge(&another.RTTServerDigest)
+	m.SRTDigest.Merge(&another.SRTDigest)
+	m.ARTDigest.Merge(&another.ARTDigest)
+	m.RRTDigest.Merge(&another.RRTDigest)
+	m.CITDigest.Merge(&another.CITDigest)
+
+	mergeSketch(&m.RTTClientSketch, another.RTTClientSketch)
+	mergeSketch(&m.RTTServerSketch, another.RTTServerSketch)
+	mergeSketch(&m.SRTSketch, another.SRTSketch)
+	mergeSketch(&m.ARTSketch, another.ARTSketch)
+	mergeSketch(&m.RRTSketch, another.RRTSketch)
+	mergeSketch(&m.CITSketch, another.CITSketch)
+
+	m.RetransTx += another.RetransTx
+	m.RetransRx += another.RetransRx
+	m.ZeroWinTx += another.ZeroWinTx
+	m.ZeroWinRx += another.ZeroWinRx
+	m.SynCount += another.SynCount
+	m.SynackCount += another.SynackCount
+	m.L7ClientError += another.L7ClientError
+	m.L7ServerError += another.L7ServerError
+	m.L7ServerTimeout += another.L7ServerTimeout
+	m.L7Error += another.L7Error
+}
+
+func maxUint32(a, b uint32) uint32 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
 func parseUint32EpcID(v uint32) int32 {
 	switch int16(v) {
 	case datatype.EPC_FROM_DEEPFLOW:
@@ -922,11 +1315,21 @@ func (n *NetworkLayer) Fill(f *pb.Flow, isIPV6 bool) {
 		n.TunnelTxID = f.Tunnel.TxId
 		n.TunnelRxID = f.Tunnel.RxId
 		n.TunnelType = uint16(f.Tunnel.TunnelType)
-		n.TunnelTxIP40 = f.Tunnel.TxIp0
-		n.TunnelTxIP41 = f.Tunnel.TxIp1
-		n.TunnelRxIP40 = f.Tunnel.RxIp0
-		n.TunnelRxIP41 = f.Tunnel.RxIp1
-		n.TunnelIsIPv4 = true
+		// WireGuard、VXLAN-over-IPv6、GENEVE-over-IPv6等隧道的endpoint地址是IPv6，
+		// 不能再像之前那样无脑当成uint32 IPv4读，要按Tunnel.IsIPv6选对地址族，否则会被截断
+		if f.Tunnel.IsIPv6 {
+			n.TunnelIsIPv4 = false
+			n.TunnelTxIP60 = cloneIP(f.Tunnel.TxIp6_0)
+			n.TunnelTxIP61 = cloneIP(f.Tunnel.TxIp6_1)
+			n.TunnelRxIP60 = cloneIP(f.Tunnel.RxIp6_0)
+			n.TunnelRxIP61 = cloneIP(f.Tunnel.RxIp6_1)
+		} else {
+			n.TunnelIsIPv4 = true
+			n.TunnelTxIP40 = f.Tunnel.TxIp0
+			n.TunnelTxIP41 = f.Tunnel.TxIp1
+			n.TunnelRxIP40 = f.Tunnel.RxIp0
+			n.TunnelRxIP41 = f.Tunnel.RxIp1
+		}
 		n.TunnelTxMac0 = f.Tunnel.TxMac0
 		n.TunnelTxMac1 = f.Tunnel.TxMac1
 		n.TunnelRxMac0 = f.Tunnel.RxMac0
@@ -948,6 +1351,25 @@ func (t *TransportLayer) Fill(f *pb.Flow) {
 func (a *ApplicationLayer) Fill(f *pb.Flow) {
 	if f.HasPerfStats == 1 {
 		a.L7Protocol = uint8(f.PerfStats.L7Protocol)
+		a.fillL7AggregateStatus(f.PerfStats.L7.ErrClientCount, f.PerfStats.L7.ErrServerCount, f.PerfStats.L7.ErrTimeout)
+	}
+}
+
+// fillL7AggregateStatus是这条路径上唯一能拿到的L7状态来源：FlowLogger一条记录聚合了一个
+// 上报周期内同一条flow上的全部L7请求，PerfStats.L7只有错误计数，没有逐条请求的
+// ResponseCode/RequestDomain之类的明细，所以只能退化成用这三个计数算出一个ResponseStatus，
+// 让getStatus能在TCP层面正常、L7层面有错误时仍然把flow标记成异常
+func (a *ApplicationLayer) fillL7AggregateStatus(clientErr, serverErr, timeout uint32) {
+	switch {
+	case serverErr > 0:
+		a.ResponseStatus = datatype.STATUS_SERVER_ERROR
+	case timeout > 0:
+		a.ResponseStatus = datatype.STATUS_SERVER_ERROR
+		a.ResponseException = "L7_TIMEOUT"
+	case clientErr > 0:
+		a.ResponseStatus = datatype.STATUS_CLIENT_ERROR
+	default:
+		a.ResponseStatus = datatype.STATUS_OK
 	}
 }
 
@@ -958,7 +1380,7 @@ func (i *Internet) Fill(f *pb.Flow) {
 
 func (k *KnowledgeGraph) fill(
 	platformData *grpc.PlatformInfoTable,
-	isIPv6, isVipInterface0, isVipInterface1 bool,
+	isIPv6, isVipInterface0, isVipInterface1, policyMatched bool,
 	l3EpcID0, l3EpcID1 int16,
 	ip40, ip41 uint32,
 	ip60, ip61 net.IP,
@@ -1073,6 +1495,20 @@ func (k *KnowledgeGraph) fill(
 			k.PodNodeID1 != 0 {
 			_, k.ServiceID1 = platformData.QueryIPv6IsKeyServiceAndID(l3EpcID1, ip61, protocol, port)
 		}
+		// Pod两端各自查一次命中的NetworkPolicy：0端是发送方只查Egress，1端是接收方只查
+		// Ingress，跟antrea给每个Pod flow挂上matched NetworkPolicy/rule的做法一致；没有
+		// PodID或agent没上报policy命中（policyMatched为false）时跳过，避免给非Pod流量
+		// 也发起这次查询
+		if policyMatched {
+			if k.PodID0 != 0 {
+				k.PolicyID0, k.PolicyRuleID0, k.PolicyAction0 = platformData.QueryIPv6PodNetworkPolicy(
+					k.PodID0, l3EpcID0, ip60, 0, protocol, policyDirectionEgress)
+			}
+			if k.PodID1 != 0 {
+				k.PolicyID1, k.PolicyRuleID1, k.PolicyAction1 = platformData.QueryIPv6PodNetworkPolicy(
+					k.PodID1, l3EpcID1, ip61, port, protocol, policyDirectionIngress)
+			}
+		}
 	} else {
 		// 0端如果是clusterIP或后端podIP需要匹配service_id
 		if k.L3DeviceType0 == uint8(trident.DeviceType_DEVICE_TYPE_POD_SERVICE) ||
@@ -1085,6 +1521,17 @@ func (k *KnowledgeGraph) fill(
 			k.PodNodeID1 != 0 {
 			_, k.ServiceID1 = platformData.QueryIsKeyServiceAndID(l3EpcID1, ip41, protocol, port)
 		}
+		// 0端是发送方只查Egress，1端是接收方只查Ingress，见上面IPv6分支的注释
+		if policyMatched {
+			if k.PodID0 != 0 {
+				k.PolicyID0, k.PolicyRuleID0, k.PolicyAction0 = platformData.QueryPodNetworkPolicy(
+					k.PodID0, l3EpcID0, ip40, 0, protocol, policyDirectionEgress)
+			}
+			if k.PodID1 != 0 {
+				k.PolicyID1, k.PolicyRuleID1, k.PolicyAction1 = platformData.QueryPodNetworkPolicy(
+					k.PodID1, l3EpcID1, ip41, port, protocol, policyDirectionIngress)
+			}
+		}
 	}
 
 	k.ResourceGl0ID0, k.ResourceGl0Type0 = common.GetResourceGl0(k.PodID0, k.PodNodeID0, k.L3DeviceID0, k.L3DeviceType0, int16(k.L3EpcID0))
@@ -1098,7 +1545,7 @@ func (k *KnowledgeGraph) fill(
 
 func (k *KnowledgeGraph) FillL4(f *pb.Flow, isIPv6 bool, platformData *grpc.PlatformInfoTable) {
 	k.fill(platformData,
-		isIPv6, f.MetricsPeerSrc.IsVipInterface == 1, f.MetricsPeerDst.IsVipInterface == 1,
+		isIPv6, f.MetricsPeerSrc.IsVipInterface == 1, f.MetricsPeerDst.IsVipInterface == 1, f.PolicyData != nil && f.PolicyData.Matched,
 		int16(f.MetricsPeerSrc.L3EpcId), int16(f.MetricsPeerDst.L3EpcId),
 		f.FlowKey.IpSrc, f.FlowKey.IpDst,
 		f.FlowKey.Ip6Src, f.FlowKey.Ip6Dst,
@@ -1108,19 +1555,25 @@ func (k *KnowledgeGraph) FillL4(f *pb.Flow, isIPv6 bool, platformData *grpc.Plat
 		layers.IPProtocol(f.FlowKey.Proto))
 }
 
-func getStatus(t datatype.CloseType) uint8 {
+// getStatus按TCP CloseType得到这条flow的状态；TCP层面看起来是STATUS_OK时，再用
+// l7Status兜底一次——握手/挥手正常但L7聚合错误计数不为0（HTTP 5xx、DNS SERVFAIL之类），
+// 说明连接层面成功、业务层面失败，这种flow不应该被标记成健康
+func getStatus(t datatype.CloseType, l7Status uint8) uint8 {
+	status := datatype.STATUS_NOT_EXIST
 	if t == datatype.CloseTypeTCPFin || t == datatype.CloseTypeForcedReport {
-		return datatype.STATUS_OK
+		status = datatype.STATUS_OK
 	} else if t.IsClientError() {
-		return datatype.STATUS_CLIENT_ERROR
+		status = datatype.STATUS_CLIENT_ERROR
 	} else if t.IsServerError() {
-		return datatype.STATUS_SERVER_ERROR
-	} else {
-		return datatype.STATUS_NOT_EXIST
+		status = datatype.STATUS_SERVER_ERROR
 	}
+	if status == datatype.STATUS_OK && l7Status != datatype.STATUS_OK {
+		return l7Status
+	}
+	return status
 }
 
-func (i *FlowInfo) Fill(f *pb.Flow) {
+func (i *FlowInfo) Fill(f *pb.Flow, l7Status uint8) {
 	i.CloseType = uint16(f.CloseType)
 	i.FlowSource = uint16(f.FlowSource)
 	i.FlowID = f.FlowId
@@ -1138,7 +1591,7 @@ func (i *FlowInfo) Fill(f *pb.Flow) {
 	i.EndTime = int64(f.EndTime) / int64(time.Microsecond)
 	i.Duration = f.Duration / uint64(time.Microsecond)
 	i.IsNewFlow = uint8(f.IsNewFlow)
-	i.Status = getStatus(datatype.CloseType(i.CloseType))
+	i.Status = getStatus(datatype.CloseType(i.CloseType), l7Status)
 }
 
 func (m *Metrics) Fill(f *pb.Flow) {
@@ -1191,6 +1644,27 @@ func (m *Metrics) Fill(f *pb.Flow) {
 		m.RRTMax = p.L7.RrtMax
 		m.CITMax = p.Tcp.CitMax
 
+		// pb.Flow里送过来的已经是一个上报周期内聚合好的sum/count，采集器侧没有保留原始样本，
+		// 所以这里没法像digestCompression设计时设想的那样逐样本Add；退而求其次，把这个周期的
+		// sum/count当成一个带权质心喂进digest，数学上等价于"先对这批样本求均值，再按样本数
+		// 加权"，丢失的只是这批样本内部的分布形状，跨周期合并、取分位数依然是有效的近似
+		addAggregateToDigest(&m.RTTClientDigest, uint64(m.RTTClientSum), m.RTTClientCount)
+		addAggregateToDigest(&m.RTTServerDigest, uint64(m.RTTServerSum), m.RTTServerCount)
+		addAggregateToDigest(&m.SRTDigest, uint64(m.SRTSum), m.SRTCount)
+		addAggregateToDigest(&m.ARTDigest, uint64(m.ARTSum), m.ARTCount)
+		addAggregateToDigest(&m.RRTDigest, m.RRTSum, m.RRTCount)
+		addAggregateToDigest(&m.CITDigest, uint64(m.CITSum), m.CITCount)
+
+		// 和上面的*Digest不同，这组Sketch不是从sum/count反推的，而是agent在SketchEnabled
+		// 开启时直接逐样本落桶上报的真实分布；SketchEnabled关闭或agent没上报时sketchFromPB
+		// 返回nil，对应列留空，不影响上面*Digest这条老路径
+		m.RTTClientSketch = sketchFromPB(p.Tcp.RttClientSketch)
+		m.RTTServerSketch = sketchFromPB(p.Tcp.RttServerSketch)
+		m.SRTSketch = sketchFromPB(p.Tcp.SrtSketch)
+		m.ARTSketch = sketchFromPB(p.Tcp.ArtSketch)
+		m.RRTSketch = sketchFromPB(p.L7.RrtSketch)
+		m.CITSketch = sketchFromPB(p.Tcp.CitSketch)
+
 		if p.Tcp.CountsPeerTx != nil {
 			m.RetransTx = p.Tcp.CountsPeerTx.RetransCount
 			m.ZeroWinTx = p.Tcp.CountsPeerTx.ZeroWinCount
@@ -1213,10 +1687,11 @@ func FlowLoggerColumns() []*ckdb.Column {
 	columns = append(columns, ckdb.NewColumn("_id", ckdb.UInt64).SetCodec(ckdb.CodecDoubleDelta))
 	columns = append(columns, DataLinkLayerColumns...)
 	columns = append(columns, KnowledgeGraphColumns...)
-	columns = append(columns, NetworkLayerColumns...)
+	columns = append(columns, NetworkLayerColumns()...)
 	columns = append(columns, TransportLayerColumns...)
 	columns = append(columns, ApplicationLayerColumns...)
 	columns = append(columns, InternetColumns...)
+	columns = append(columns, ProcessLayerColumns...)
 	columns = append(columns, FlowInfoColumns...)
 	columns = append(columns, MetricsColumns...)
 	return columns
@@ -1251,6 +1726,10 @@ func (f *FlowLogger) WriteBlock(block *ckdb.Block) error {
 		return err
 	}
 
+	if err := f.ProcessLayer.WriteBlock(block); err != nil {
+		return err
+	}
+
 	if err := f.FlowInfo.WriteBlock(block); err != nil {
 		return err
 	}
@@ -1310,8 +1789,9 @@ func TaggedFlowToLogger(f *pb.TaggedFlow, shardID int, platformData *grpc.Platfo
 	s.TransportLayer.Fill(f.Flow)
 	s.ApplicationLayer.Fill(f.Flow)
 	s.Internet.Fill(f.Flow)
+	s.ProcessLayer.Fill(f.Flow)
 	s.KnowledgeGraph.FillL4(f.Flow, isIPV6, platformData)
-	s.FlowInfo.Fill(f.Flow)
+	s.FlowInfo.Fill(f.Flow, s.ApplicationLayer.ResponseStatus)
 	s.Metrics.Fill(f.Flow)
 
 	return s
@@ -0,0 +1,46 @@
+/*
+ * Copyright (c) 2022 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jsonify
+
+import "github.com/deepflowys/deepflow/server/libs/ckdb"
+
+// L7ResponseInfo是L4 FlowLogger上的L7层状态摘要，补在ApplicationLayer后面随FlowLogger一起
+// 落盘，让Grafana可以直接按ResponseException/ResponseStatus过滤L7层有问题的flow。
+// 这一条FlowLogger记录聚合了一个上报周期内同一条flow上的全部L7请求，这里拿到的只有
+// PerfStats.L7的错误计数（见fillL7AggregateStatus），没有逐条请求的ResponseCode/
+// RequestType/RequestDomain/RequestResource可用——那些字段需要按协议解码单条
+// AppProtoLogsData，而这个代码库目前没有把单条L7请求日志喂给FlowLogger这条路径的入口，
+// 所以这里不声明这几列，避免交付一批永远是零值的schema
+type L7ResponseInfo struct {
+	ResponseStatus    uint8  `json:"response_status,omitempty"`
+	ResponseException string `json:"response_exception,omitempty"`
+}
+
+var L7ResponseInfoColumns = []*ckdb.Column{
+	ckdb.NewColumn("response_status", ckdb.UInt8).SetIndex(ckdb.IndexNone),
+	ckdb.NewColumn("response_exception", ckdb.LowCardinalityString),
+}
+
+func (r *L7ResponseInfo) WriteBlock(block *ckdb.Block) error {
+	if err := block.WriteUInt8(r.ResponseStatus); err != nil {
+		return err
+	}
+	if err := block.WriteString(r.ResponseException); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+/*
+ * Copyright (c) 2022 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jsonify
+
+import (
+	"encoding/binary"
+	"math"
+	"sort"
+)
+
+// digestCompression是LatencyDigest允许保留的centroid上限，取值越大分位数估计越精确，
+// 但WriteBlock写出的字节也越多；100是t-digest论文里给出的、精度和体积都比较均衡的默认值
+const digestCompression = 100
+
+// digestCentroid是t-digest里的一个质心：mean是这个质心代表的一批样本的加权均值，
+// weight是这批样本的数量（或者合并进来的其它质心的权重之和）
+type digestCentroid struct {
+	mean   float32
+	weight uint32
+}
+
+// LatencyDigest是一个简化版的merging t-digest，用有限个(mean, weight)质心近似表示一批延迟
+// 样本的分布，只要把两个LatencyDigest的质心列表拼起来重新压缩就能合并，天然契合flow聚合场景
+// 里"多个时间窗口的摘要合并成一个大窗口摘要"的需求，而sum/count/max三个字段做不到这一点。
+type LatencyDigest struct {
+	centroids []digestCentroid
+}
+
+// Add把一个以微秒为单位的延迟样本计入digest
+func (d *LatencyDigest) Add(us uint32) {
+	d.addWeighted(float32(us), 1)
+}
+
+// addWeighted插入一个已经带权重的质心（Add和由sum/count聚合出的单点走这里，Merge直接拼接质心列表），
+// 插入后一旦质心数超过digestCompression就立即压缩，保证底层切片有界增长
+func (d *LatencyDigest) addWeighted(mean float32, weight uint32) {
+	if weight == 0 {
+		return
+	}
+	d.centroids = append(d.centroids, digestCentroid{mean: mean, weight: weight})
+	if len(d.centroids) > digestCompression {
+		d.compress()
+	}
+}
+
+// Merge把另一个digest的质心并入当前digest，用于flow聚合路径里窗口之间的摘要合并
+func (d *LatencyDigest) Merge(other *LatencyDigest) {
+	if other == nil || len(other.centroids) == 0 {
+		return
+	}
+	d.centroids = append(d.centroids, other.centroids...)
+	if len(d.centroids) > digestCompression {
+		d.compress()
+	}
+}
+
+// compress按mean排序后，反复合并相邻、mean最接近的一对质心，直到数量回落到digestCompression
+// 以内；合并时按权重加权平均mean，权重相加，这是merging t-digest最朴素但足够稳健的压缩策略
+func (d *LatencyDigest) compress() {
+	sort.Slice(d.centroids, func(i, j int) bool { return d.centroids[i].mean < d.centroids[j].mean })
+	for len(d.centroids) > digestCompression {
+		mergeAt := 0
+		minGap := float32(-1)
+		for i := 0; i+1 < len(d.centroids); i++ {
+			gap := d.centroids[i+1].mean - d.centroids[i].mean
+			if minGap < 0 || gap < minGap {
+				minGap = gap
+				mergeAt = i
+			}
+		}
+		a, b := d.centroids[mergeAt], d.centroids[mergeAt+1]
+		totalWeight := a.weight + b.weight
+		mergedMean := (a.mean*float32(a.weight) + b.mean*float32(b.weight)) / float32(totalWeight)
+		merged := digestCentroid{mean: mergedMean, weight: totalWeight}
+		d.centroids = append(d.centroids[:mergeAt], append([]digestCentroid{merged}, d.centroids[mergeAt+2:]...)...)
+	}
+}
+
+// Quantile返回分位数q（0~1）对应的延迟估计值：按质心排序后，把每个质心的"代表位置"定义成它
+// 前面全部质心的累计权重加上自己权重的一半（t-digest论文里quantile-of-centroid的定义），target
+// 落在哪两个相邻质心的代表位置之间就在这两个mean之间线性插值；target落在两端之外时分别取最
+// 小/最大质心的mean；空digest返回0
+func (d *LatencyDigest) Quantile(q float64) float64 {
+	if len(d.centroids) == 0 {
+		return 0
+	}
+	sorted := make([]digestCentroid, len(d.centroids))
+	copy(sorted, d.centroids)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].mean < sorted[j].mean })
+
+	var totalWeight float64
+	for _, c := range sorted {
+		totalWeight += float64(c.weight)
+	}
+	if totalWeight == 0 {
+		return 0
+	}
+	target := q * totalWeight
+
+	var cumWeight float64
+	mids := make([]float64, len(sorted))
+	for i, c := range sorted {
+		mids[i] = cumWeight + float64(c.weight)/2
+		cumWeight += float64(c.weight)
+	}
+
+	if target <= mids[0] {
+		return float64(sorted[0].mean)
+	}
+	if target >= mids[len(mids)-1] {
+		return float64(sorted[len(sorted)-1].mean)
+	}
+	for i := 0; i+1 < len(sorted); i++ {
+		if target <= mids[i+1] {
+			frac := (target - mids[i]) / (mids[i+1] - mids[i])
+			return float64(sorted[i].mean) + frac*float64(sorted[i+1].mean-sorted[i].mean)
+		}
+	}
+	return float64(sorted[len(sorted)-1].mean)
+}
+
+// addAggregateToDigest把一个周期内的sum/count聚合值当成一个质心计入digest，count为0时
+// （这一轮没有对应类型的样本）跳过，避免插入一个权重为0的无意义质心；sum用uint64是因为RRTSum
+// 本身就是uint64（L7的RRT比TCP层的RTT/SRT/ART/CIT更容易在长连接上累积出超过uint32范围的和），
+// 其它uint32的sum由调用方显式转成uint64再传进来，不会丢精度
+func addAggregateToDigest(d *LatencyDigest, sum uint64, count uint32) {
+	if count == 0 {
+		return
+	}
+	d.addWeighted(float32(sum)/float32(count), count)
+}
+
+// Bytes把digest编码成ClickHouse String列要写的varbyte：小端uint16质心个数，
+// 后面跟着质心个数个(float32 mean, uint32 weight)小端pair，是column comment里说明的布局，
+// 用户注册对应的聚合combinator时照这个布局读就行
+func (d *LatencyDigest) Bytes() []byte {
+	buf := make([]byte, 2+len(d.centroids)*8)
+	binary.LittleEndian.PutUint16(buf[0:2], uint16(len(d.centroids)))
+	for i, c := range d.centroids {
+		off := 2 + i*8
+		binary.LittleEndian.PutUint32(buf[off:off+4], math.Float32bits(c.mean))
+		binary.LittleEndian.PutUint32(buf[off+4:off+8], c.weight)
+	}
+	return buf
+}
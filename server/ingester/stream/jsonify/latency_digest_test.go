@@ -0,0 +1,91 @@
+/*
+ * Copyright (c) 2022 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jsonify
+
+import (
+	"math"
+	"testing"
+)
+
+// TestAddAggregateToDigestWideSum覆盖chunk2-2修复的回归场景：sum超过uint32上限
+// （比如一条长连接在一个上报周期内的RRT总和累积到了5e9微秒）不应该被截断
+func TestAddAggregateToDigestWideSum(t *testing.T) {
+	var d LatencyDigest
+	const sum uint64 = 5_000_000_000 // > math.MaxUint32(4294967295)
+	const count uint32 = 1000
+	addAggregateToDigest(&d, sum, count)
+
+	got := d.Quantile(0.5)
+	want := float64(sum) / float64(count)
+	if math.Abs(got-want) > 1 {
+		t.Fatalf("addAggregateToDigest truncated a wide sum: got mean %v, want ~%v", got, want)
+	}
+}
+
+// TestAddAggregateToDigestZeroCount确认count为0时不会插入一个权重为0的质心
+func TestAddAggregateToDigestZeroCount(t *testing.T) {
+	var d LatencyDigest
+	addAggregateToDigest(&d, 1000, 0)
+	if len(d.centroids) != 0 {
+		t.Fatalf("expected no centroid inserted for count=0, got %d", len(d.centroids))
+	}
+}
+
+// TestQuantileLinearInterpolation验证Quantile在两个质心之间做的是线性插值，而不是
+// 直接返回离target最近的质心
+func TestQuantileLinearInterpolation(t *testing.T) {
+	var d LatencyDigest
+	d.addWeighted(0, 1)
+	d.addWeighted(100, 1)
+
+	got := d.Quantile(0.5)
+	want := 50.0
+	if math.Abs(got-want) > 1e-6 {
+		t.Fatalf("Quantile(0.5) = %v, want %v (linear interpolation between 0 and 100)", got, want)
+	}
+}
+
+// BenchmarkAddAggregateToDigest模拟约1M条flow记录陆续把各自一个周期的sum/count聚合值
+// 喂进同一个LatencyDigest（压缩会持续触发），衡量这条高频写路径的开销
+func BenchmarkAddAggregateToDigest(b *testing.B) {
+	const flowCount = 1_000_000
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var d LatencyDigest
+		for j := 0; j < flowCount; j++ {
+			sum := uint64(j%4096) * uint64(j%17+1)
+			count := uint32(j%17 + 1)
+			addAggregateToDigest(&d, sum, count)
+		}
+	}
+}
+
+// BenchmarkLatencyDigestQuantile衡量对一个已经积累了约1M次聚合写入的digest取分位数的开销
+func BenchmarkLatencyDigestQuantile(b *testing.B) {
+	var d LatencyDigest
+	const flowCount = 1_000_000
+	for j := 0; j < flowCount; j++ {
+		sum := uint64(j%4096) * uint64(j%17+1)
+		count := uint32(j%17 + 1)
+		addAggregateToDigest(&d, sum, count)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		d.Quantile(0.95)
+	}
+}
@@ -0,0 +1,94 @@
+/*
+ * Copyright (c) 2022 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jsonify
+
+import (
+	"github.com/deepflowys/deepflow/server/ingester/stream/jsonify/sketch"
+	"github.com/deepflowys/deepflow/server/libs/ckdb"
+	"github.com/deepflowys/deepflow/server/libs/datatype/pb"
+)
+
+// SketchEnabled控制Metrics是否摄入agent上报的pb.Sketch并落到*_sketch_*这组列；
+// 关闭时这组列仍然存在（schema不跟着开关变），只是全部留空，上线/回滚不用跟着改表
+var SketchEnabled = false
+
+// sketchColumns生成某个延迟指标的6列sketch schema：分桶index/计数这对并行数组，
+// 加上alpha/min_index/n/sum四个重建分位数要用到的聚合字段
+func sketchColumns(prefix, comment string) []*ckdb.Column {
+	return []*ckdb.Column{
+		ckdb.NewColumn(prefix+"_sketch_index", ckdb.ArrayInt32).SetComment(comment + "：DDSketch桶index数组，和" + prefix + "_sketch_count一一对应，桶index=ceil(log(v)/log(1+alpha))"),
+		ckdb.NewColumn(prefix+"_sketch_count", ckdb.ArrayUInt32).SetComment(comment + "：每个桶的样本数"),
+		ckdb.NewColumn(prefix+"_sketch_alpha", ckdb.Float64).SetComment(comment + "：相对误差参数alpha"),
+		ckdb.NewColumn(prefix+"_sketch_min_index", ckdb.Int32),
+		ckdb.NewColumn(prefix+"_sketch_n", ckdb.UInt64),
+		ckdb.NewColumn(prefix+"_sketch_sum", ckdb.Float64),
+	}
+}
+
+// writeSketch按sketchColumns的列顺序写一个sketch；s为nil（SketchEnabled关闭，
+// 或agent这次没上报）时写出全零的空sketch，不破坏定长的block写入顺序
+func writeSketch(block *ckdb.Block, s *sketch.Sketch) error {
+	var indices []int32
+	var counts []uint32
+	var alpha, sum float64
+	var minIndex int32
+	var count uint64
+	if s != nil {
+		indices, counts = s.Buckets()
+		alpha, minIndex, count, sum = s.Alpha, s.MinIndex, s.Count, s.Sum
+	}
+	if err := block.WriteInt32Array(indices); err != nil {
+		return err
+	}
+	if err := block.WriteUInt32Array(counts); err != nil {
+		return err
+	}
+	if err := block.WriteFloat64(alpha); err != nil {
+		return err
+	}
+	if err := block.WriteInt32(minIndex); err != nil {
+		return err
+	}
+	if err := block.WriteUInt64(count); err != nil {
+		return err
+	}
+	if err := block.WriteFloat64(sum); err != nil {
+		return err
+	}
+	return nil
+}
+
+// sketchFromPB把agent上报的pb.Sketch（逐样本落桶，而不是像LatencyDigest那样从
+// sum/count聚合值反推）转换成sketch.Sketch；pbSketch为nil或关了SketchEnabled
+// 时返回nil，调用方按nil处理成空sketch
+func sketchFromPB(pbSketch *pb.Sketch) *sketch.Sketch {
+	if !SketchEnabled || pbSketch == nil {
+		return nil
+	}
+	return sketch.FromBuckets(pbSketch.Alpha, pbSketch.MinIndex, pbSketch.Count, pbSketch.Sum, pbSketch.Index, pbSketch.Counts)
+}
+
+// mergeSketch把src合并进dst所指向的sketch，dst指向的值是nil时原地分配一个新的
+func mergeSketch(dst **sketch.Sketch, src *sketch.Sketch) {
+	if src == nil {
+		return
+	}
+	if *dst == nil {
+		*dst = sketch.New(src.Alpha)
+	}
+	(*dst).Merge(src)
+}
@@ -0,0 +1,127 @@
+/*
+ * Copyright (c) 2022 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jsonify
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// UnifiedIPColumnEnabled是ip4_*/ip6_*和tunnel_*_ip4_*/tunnel_*_ip6_*这十二个legacy列和ip_0/ip_1/tunnel_*_ip_0/tunnel_*_ip_1
+// 六个FixedString(16)统一列之间的全局开关，按表一一启用本来应该挂在ckdb.Flavor上，但这个
+// 快照里ckdb包的定义还没收录进来（已有代码里所有ckdb.*引用都停留在"符号存在、实现缺失"的
+// 状态），这里先用一个包级开关落地ingester这一侧的双路径写入逻辑，ckdb.Flavor补上之后
+// 把这个开关换成按表查询即可，调用方不用跟着变
+var UnifiedIPColumnEnabled = false
+
+// NetworkAddr把一个v4或v6地址统一表示成16字节（v4地址按照"::ffff:a.b.c.d"映射），对应
+// FixedString(16)这一个列，配合IsIPv4这个已经存在的bitmap列使用，查询层不用再对v4/v6
+// 两套字段各写一份谓词
+type NetworkAddr struct {
+	IsIPv4 bool
+	Bytes  [16]byte
+}
+
+var v4InV6Prefix = [12]byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff}
+
+// NetworkAddrFromIPv4从一个uint32大端表示的IPv4地址构造NetworkAddr
+func NetworkAddrFromIPv4(ip uint32) NetworkAddr {
+	addr := NetworkAddr{IsIPv4: true}
+	copy(addr.Bytes[:12], v4InV6Prefix[:])
+	addr.Bytes[12] = byte(ip >> 24)
+	addr.Bytes[13] = byte(ip >> 16)
+	addr.Bytes[14] = byte(ip >> 8)
+	addr.Bytes[15] = byte(ip)
+	return addr
+}
+
+// NetworkAddrFromIPv6从net.IP构造NetworkAddr，nil或长度不对时落到全零地址，和WriteBlock
+// 原来对ip6_*列的net.IPv6zero兜底保持一致
+func NetworkAddrFromIPv6(ip net.IP) NetworkAddr {
+	addr := NetworkAddr{IsIPv4: false}
+	ip16 := ip.To16()
+	if ip16 != nil {
+		copy(addr.Bytes[:], ip16)
+	}
+	return addr
+}
+
+func (a NetworkAddr) IP() net.IP {
+	ip := make(net.IP, 16)
+	copy(ip, a.Bytes[:])
+	return ip
+}
+
+// v4InV6Addr把一个v4地址按"::ffff:a.b.c.d"映射成v6地址，和NetworkAddrFromIPv4的映射规则
+// 保持一致，IPPredicate对v4 CIDR做统一列匹配时要用同一套映射才不会和写路径的数据对不上
+func v4InV6Addr(v4 netip.Addr) netip.Addr {
+	b := v4.As4()
+	var v6 [16]byte
+	copy(v6[:12], v4InV6Prefix[:])
+	copy(v6[12:], b[:])
+	return netip.AddrFrom16(v6)
+}
+
+// legacyColumnNames把一个统一列名（比如"ip_0"、"tunnel_tx_ip_1"）换算成它在legacy布局下对应
+// 的一对列名，纯字符串替换，和networkLayerIPColumns/networkLayerTunnelIPColumns里这两套列名
+// 的命名规则一一对应
+func legacyColumnNames(col string) (ip4Col, ip6Col string) {
+	return strings.Replace(col, "ip_", "ip4_", 1), strings.Replace(col, "ip_", "ip6_", 1)
+}
+
+// IPPredicate返回一段匹配prefix这个CIDR的WHERE条件表达式，col是统一布局下的列名（如"ip_0"）；
+// UnifiedIPColumnEnabled为true时直接对FixedString(16)列按prefix生成的v6 CIDR比较，为false时
+// 把col换算成legacy的ip4_*/ip6_*列名对，按prefix的地址族挑其中一列，查询层不用关心某张表到底
+// 是哪种布局
+func IPPredicate(col string, prefix netip.Prefix) string {
+	if UnifiedIPColumnEnabled {
+		return unifiedIPPredicate(col, prefix)
+	}
+	return legacyIPPredicate(col, prefix)
+}
+
+func unifiedIPPredicate(col string, prefix netip.Prefix) string {
+	if prefix.Addr().Is4() {
+		mapped := netip.PrefixFrom(v4InV6Addr(prefix.Addr()), prefix.Bits()+96)
+		return fmt.Sprintf("isIPAddressInRange(IPv6NumToString(%s), '%s')", col, mapped)
+	}
+	return fmt.Sprintf("isIPAddressInRange(IPv6NumToString(%s), '%s')", col, prefix)
+}
+
+func legacyIPPredicate(col string, prefix netip.Prefix) string {
+	ip4Col, ip6Col := legacyColumnNames(col)
+	if prefix.Addr().Is4() {
+		return fmt.Sprintf("isIPAddressInRange(IPv4NumToString(%s), '%s')", ip4Col, prefix)
+	}
+	return fmt.Sprintf("isIPAddressInRange(IPv6NumToString(%s), '%s')", ip6Col, prefix)
+}
+
+// MigrateLegacyIPColumnSQL给一张还停留在legacy ip4_*/ip6_*布局的表生成升级到unified
+// FixedString(16)列的ALTER语句：新列用MATERIALIZED从老的ip4_*/ip6_*列实时算出来，存量数据
+// 不用离线回填，旧的写路径（UnifiedIPColumnEnabled关闭）继续只写ip4_*/ip6_*，新列照样跟着更新。
+// col是要新增的统一列名（如"ip_0"），调用方对每个endpoint各调一次
+func MigrateLegacyIPColumnSQL(table, col string) string {
+	ip4Col, ip6Col := legacyColumnNames(col)
+	materialized := fmt.Sprintf(
+		"if(%s != toIPv6('::'), IPv6StringToNum(%s), IPv6StringToNum(concat('::ffff:', IPv4NumToString(%s))))",
+		ip6Col, ip6Col, ip4Col,
+	)
+	return fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s FixedString(16) MATERIALIZED %s",
+		table, col, materialized)
+}
@@ -0,0 +1,121 @@
+/*
+ * Copyright (c) 2022 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jsonify
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestLegacyColumnNames(t *testing.T) {
+	ip4Col, ip6Col := legacyColumnNames("tunnel_tx_ip_1")
+	if ip4Col != "tunnel_tx_ip4_1" || ip6Col != "tunnel_tx_ip6_1" {
+		t.Fatalf("legacyColumnNames() = (%s, %s), want (tunnel_tx_ip4_1, tunnel_tx_ip6_1)", ip4Col, ip6Col)
+	}
+}
+
+func TestIPPredicateLegacyLayout(t *testing.T) {
+	UnifiedIPColumnEnabled = false
+	v6 := netip.MustParsePrefix("2001:db8::/32")
+	pred := IPPredicate("ip_0", v6)
+	if !strings.Contains(pred, "ip6_0") || !strings.Contains(pred, "2001:db8::/32") {
+		t.Fatalf("legacy IPv6 predicate = %q, want it to reference ip6_0 and the CIDR", pred)
+	}
+
+	v4 := netip.MustParsePrefix("10.0.0.0/8")
+	pred = IPPredicate("ip_0", v4)
+	if !strings.Contains(pred, "ip4_0") || !strings.Contains(pred, "10.0.0.0/8") {
+		t.Fatalf("legacy IPv4 predicate = %q, want it to reference ip4_0 and the CIDR", pred)
+	}
+}
+
+func TestIPPredicateUnifiedLayout(t *testing.T) {
+	UnifiedIPColumnEnabled = true
+	defer func() { UnifiedIPColumnEnabled = false }()
+
+	pred := IPPredicate("ip_0", netip.MustParsePrefix("10.0.0.0/8"))
+	if !strings.Contains(pred, "ip_0") || !strings.Contains(pred, "::ffff:10.0.0.0/104") {
+		t.Fatalf("unified IPv4 predicate = %q, want the v4-in-v6 mapped /104 CIDR", pred)
+	}
+}
+
+func TestMigrateLegacyIPColumnSQL(t *testing.T) {
+	sql := MigrateLegacyIPColumnSQL("l7_flow_log", "tunnel_tx_ip_0")
+	for _, want := range []string{"l7_flow_log", "tunnel_tx_ip_0", "tunnel_tx_ip4_0", "tunnel_tx_ip6_0", "MATERIALIZED"} {
+		if !strings.Contains(sql, want) {
+			t.Fatalf("MigrateLegacyIPColumnSQL() = %q, missing %q", sql, want)
+		}
+	}
+}
+
+// BenchmarkIPPredicateIPv6Heavy模拟查询层对约1M个IPv6 CIDR分别生成一次谓词（比如按AZ/子网
+// 拆分出的大量独立过滤条件），衡量v6路径在legacy和unified两种列布局下的开销
+func BenchmarkIPPredicateIPv6Heavy(b *testing.B) {
+	const n = 1_000_000
+	prefixes := make([]netip.Prefix, n)
+	base := net.ParseIP("2001:db8::").To16()
+	for i := 0; i < n; i++ {
+		addr := make(net.IP, 16)
+		copy(addr, base)
+		addr[14] = byte(i >> 8)
+		addr[15] = byte(i)
+		a, ok := netip.AddrFromSlice(addr)
+		if !ok {
+			b.Fatalf("invalid address at %d", i)
+		}
+		prefixes[i] = netip.PrefixFrom(a, 64)
+	}
+
+	b.Run("legacy", func(b *testing.B) {
+		UnifiedIPColumnEnabled = false
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			IPPredicate("ip_0", prefixes[i%n])
+		}
+	})
+
+	b.Run("unified", func(b *testing.B) {
+		UnifiedIPColumnEnabled = true
+		defer func() { UnifiedIPColumnEnabled = false }()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			IPPredicate("ip_0", prefixes[i%n])
+		}
+	})
+}
+
+// BenchmarkNetworkAddrFromIPv6IPv6Heavy衡量把约1M个不同IPv6地址转换成NetworkAddr的开销，
+// 对应写路径里UnifiedIPColumnEnabled开启时每条flow记录两个endpoint都要做的转换
+func BenchmarkNetworkAddrFromIPv6IPv6Heavy(b *testing.B) {
+	const n = 1_000_000
+	addrs := make([]net.IP, n)
+	base := net.ParseIP("2001:db8::").To16()
+	for i := 0; i < n; i++ {
+		addr := make(net.IP, 16)
+		copy(addr, base)
+		addr[14] = byte(i >> 8)
+		addr[15] = byte(i)
+		addrs[i] = addr
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		NetworkAddrFromIPv6(addrs[i%n])
+	}
+}
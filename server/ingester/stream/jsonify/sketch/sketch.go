@@ -0,0 +1,160 @@
+/*
+ * Copyright (c) 2022 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package sketch实现一个DDSketch风格的相对误差直方图：每个非零样本v按
+// index = ceil(log(v)/log(1+alpha))归到一个桶，桶内只存计数，不存原始值，
+// alpha决定桶边界之间的相对误差（约等于alpha本身）。相比LatencyDigest那种
+// 固定质心数的t-digest，DDSketch的相对误差是可预先保证的常数，且合并两个
+// sketch只需要按index对齐做计数相加，没有t-digest那样的压缩/重排步骤。
+package sketch
+
+import (
+	"math"
+	"sort"
+)
+
+// DefaultAlpha给出约1%相对误差，是DDSketch论文里延迟类指标常用的取值
+const DefaultAlpha = 0.01
+
+// Sketch是一个稀疏的DDSketch：buckets只保存非零计数的index，Count/Sum额外
+// 维护聚合量，避免每次算分位数都要遍历buckets求和
+type Sketch struct {
+	Alpha    float64
+	MinIndex int32
+	Count    uint64
+	Sum      float64
+	buckets  map[int32]uint32
+}
+
+// New创建一个alpha给定的空sketch；alpha<=0时落到DefaultAlpha
+func New(alpha float64) *Sketch {
+	if alpha <= 0 {
+		alpha = DefaultAlpha
+	}
+	return &Sketch{Alpha: alpha, buckets: make(map[int32]uint32)}
+}
+
+func (s *Sketch) gamma() float64 {
+	alpha := s.Alpha
+	if alpha <= 0 {
+		alpha = DefaultAlpha
+	}
+	return 1 + alpha
+}
+
+func (s *Sketch) indexOf(v float64) int32 {
+	return int32(math.Ceil(math.Log(v) / math.Log(s.gamma())))
+}
+
+// Add把一个v>0的样本计入sketch，v<=0的样本（不合法的延迟）直接丢弃
+func (s *Sketch) Add(v float64) {
+	if v <= 0 {
+		return
+	}
+	if s.buckets == nil {
+		s.buckets = make(map[int32]uint32)
+	}
+	idx := s.indexOf(v)
+	if s.buckets[idx] == 0 && (s.Count == 0 || idx < s.MinIndex) {
+		s.MinIndex = idx
+	}
+	s.buckets[idx]++
+	s.Count++
+	s.Sum += v
+}
+
+// Merge把other的桶计数并入当前sketch，要求两者alpha一致（alpha是部署级配置，
+// 同一个指标的所有sketch应该用同一个alpha生成）
+func (s *Sketch) Merge(other *Sketch) {
+	if other == nil || other.Count == 0 {
+		return
+	}
+	if s.buckets == nil {
+		s.buckets = make(map[int32]uint32)
+	}
+	if s.Count == 0 {
+		s.Alpha = other.Alpha
+	}
+	for idx, c := range other.buckets {
+		if s.buckets[idx] == 0 && (s.Count == 0 || idx < s.MinIndex) {
+			s.MinIndex = idx
+		}
+		s.buckets[idx] += c
+	}
+	s.Count += other.Count
+	s.Sum += other.Sum
+}
+
+// valueAt返回index代表的桶的中点估计值，取桶上下边界gamma^(index-1)和gamma^index的
+// 调和平均2*gamma^index/(gamma+1)，是DDSketch论文给出的、相对误差最小的代表值取法
+func (s *Sketch) valueAt(index int32) float64 {
+	gamma := s.gamma()
+	return 2 * math.Pow(gamma, float64(index)) / (gamma + 1)
+}
+
+// Quantile返回分位数q（0~1）对应的延迟估计值，按index排序后沿累计计数定位目标桶；
+// 空sketch返回0
+func (s *Sketch) Quantile(q float64) float64 {
+	if s.Count == 0 {
+		return 0
+	}
+	indices := s.sortedIndices()
+	target := q * float64(s.Count)
+	var cum uint64
+	for _, idx := range indices {
+		cum += uint64(s.buckets[idx])
+		if float64(cum) >= target {
+			return s.valueAt(idx)
+		}
+	}
+	return s.valueAt(indices[len(indices)-1])
+}
+
+func (s *Sketch) sortedIndices() []int32 {
+	indices := make([]int32, 0, len(s.buckets))
+	for idx := range s.buckets {
+		indices = append(indices, idx)
+	}
+	sort.Slice(indices, func(i, j int) bool { return indices[i] < indices[j] })
+	return indices
+}
+
+// Buckets把稀疏桶按index升序展开成两个等长的并行数组，方便落盘成
+// Array(Int32)/Array(UInt32)这对ClickHouse列
+func (s *Sketch) Buckets() ([]int32, []uint32) {
+	indices := s.sortedIndices()
+	counts := make([]uint32, len(indices))
+	for i, idx := range indices {
+		counts[i] = s.buckets[idx]
+	}
+	return indices, counts
+}
+
+// FromBuckets是Buckets的逆过程，从落盘的两个并行数组和聚合字段重建一个sketch，
+// 用于读路径（比如查询层合并多行sketch）
+func FromBuckets(alpha float64, minIndex int32, count uint64, sum float64, indices []int32, counts []uint32) *Sketch {
+	s := New(alpha)
+	s.MinIndex = minIndex
+	s.Count = count
+	s.Sum = sum
+	for i, idx := range indices {
+		if i >= len(counts) {
+			break
+		}
+		s.buckets[idx] = counts[i]
+	}
+	return s
+}
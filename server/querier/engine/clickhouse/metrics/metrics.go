@@ -19,7 +19,6 @@ package metrics
 import (
 	"errors"
 	"fmt"
-	"strings"
 
 	ckcommon "github.com/deepflowys/deepflow/server/querier/engine/clickhouse/common"
 
@@ -86,55 +85,24 @@ func NewReplaceMetrics(dbField string, condition string) *Metrics {
 	}
 }
 
+// GetMetrics按(db, table)找到注册的MetricsProvider并解析单个字段，db未注册provider时
+// 直接返回找不到
 func GetMetrics(field string, db string, table string) (*Metrics, bool) {
-	if db == "ext_metrics" || db == "deepflow_system" {
-		field = strings.Trim(field, "`")
-		fieldSplit := strings.Split(field, ".")
-		if len(fieldSplit) > 1 {
-			if fieldSplit[0] == "metrics" {
-				return NewMetrics(
-					0, fmt.Sprintf("if(indexOf(metrics_float_names, '%s')=0,null,metrics_float_values[indexOf(metrics_float_names, '%s')])", fieldSplit[1], fieldSplit[1]),
-					field, "", METRICS_TYPE_COUNTER,
-					"指标", []bool{true, true, true}, "", table,
-				), true
-			}
-		}
-	}
-	allMetrics, err := GetMetricsByDBTable(db, table, "")
-	if err != nil {
+	provider, ok := getProvider(db)
+	if !ok {
 		return nil, false
 	}
-	metric, ok := allMetrics[field]
-	return metric, ok
+	return provider.Resolve(field, table)
 }
 
+// GetMetricsByDBTable把(db, table)的全部指标量交给注册的MetricsProvider，db没有注册
+// provider时返回nil（而不是错误），和重构前GetMetrics find不到表时的行为保持一致
 func GetMetricsByDBTable(db string, table string, where string) (map[string]*Metrics, error) {
-	var err error
-	switch db {
-	case "flow_log":
-		switch table {
-		case "l4_flow_log":
-			return GetL4FlowLogMetrics(), err
-		case "l7_flow_log":
-			return GetL7FlowLogMetrics(), err
-		}
-	case "flow_metrics":
-		switch table {
-		case "vtap_flow_port":
-			return GetVtapFlowPortMetrics(), err
-		case "vtap_flow_edge_port":
-			return GetVtapFlowEdgePortMetrics(), err
-		case "vtap_app_port":
-			return GetVtapAppPortMetrics(), err
-		case "vtap_app_edge_port":
-			return GetVtapAppEdgePortMetrics(), err
-		case "vtap_acl":
-			return GetVtapAclMetrics(), err
-		}
-	case "ext_metrics", "deepflow_system":
-		return GetExtMetrics(db, table, where)
+	provider, ok := getProvider(db)
+	if !ok {
+		return nil, nil
 	}
-	return nil, err
+	return provider.Describe(table, where)
 }
 
 func GetMetricsDescriptionsByDBTable(db string, table string, where string) ([]interface{}, error) {
@@ -230,52 +198,12 @@ func LoadMetrics(db string, table string, dbDescription map[string]interface{})
 	return loadMetrics, nil
 }
 
+// MergeMetrics把db_description里加载出来的自定义指标量交给(db, table)对应的MetricsProvider
+// 合并进它自己的指标量表里，db没有注册provider时报错（和重构前metrics==nil的报错路径一致）
 func MergeMetrics(db string, table string, loadMetrics map[string]*Metrics) error {
-	var metrics map[string]*Metrics
-	var replaceMetrics map[string]*Metrics
-	switch db {
-	case "flow_log":
-		switch table {
-		case "l4_flow_log":
-			metrics = L4_FLOW_LOG_METRICS
-			replaceMetrics = L4_FLOW_LOG_METRICS_REPLACE
-		case "l7_flow_log":
-			metrics = L7_FLOW_LOG_METRICS
-			replaceMetrics = L7_FLOW_LOG_METRICS_REPLACE
-		}
-	case "flow_metrics":
-		switch table {
-		case "vtap_flow_port":
-			metrics = VTAP_FLOW_PORT_METRICS
-			replaceMetrics = VTAP_FLOW_PORT_METRICS_REPLACE
-		case "vtap_flow_edge_port":
-			metrics = VTAP_FLOW_EDGE_PORT_METRICS
-			replaceMetrics = VTAP_FLOW_EDGE_PORT_METRICS_REPLACE
-		case "vtap_app_port":
-			metrics = VTAP_APP_PORT_METRICS
-			replaceMetrics = VTAP_APP_PORT_METRICS_REPLACE
-		case "vtap_app_edge_port":
-			metrics = VTAP_APP_EDGE_PORT_METRICS
-			replaceMetrics = VTAP_APP_EDGE_PORT_METRICS_REPLACE
-		case "vtap_acl":
-			metrics = VTAP_ACL_METRICS
-			replaceMetrics = VTAP_ACL_METRICS_REPLACE
-		}
-	case "ext_metrics", "deepflow_system":
-		metrics = EXT_METRICS
-	}
-	if metrics == nil {
+	provider, ok := getProvider(db)
+	if !ok {
 		return errors.New(fmt.Sprintf("merge metrics failed! db:%s, table:%s", db, table))
 	}
-	for name, value := range loadMetrics {
-		// TAG类型指标量都属于聚合类型
-		if value.Type == METRICS_TYPE_TAG {
-			value.IsAgg = true
-		}
-		if rm, ok := replaceMetrics[name]; ok && value.DBField == "" {
-			value.Replace(rm)
-		}
-		metrics[name] = value
-	}
-	return nil
+	return provider.Merge(table, loadMetrics)
 }
@@ -0,0 +1,103 @@
+/*
+ * Copyright (c) 2022 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package metrics
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+const (
+	prometheusSumSuffix    = "_sum"
+	prometheusCountSuffix  = "_count"
+	prometheusBucketSuffix = "_bucket"
+)
+
+// PrometheusProvider让Prometheus remote-write写进来的数据能复用同一套SQL查询面，指标量名
+// 是tag列里记录的原始Prometheus metric name，_sum/_count后缀取sum聚合，_bucket后缀对取值
+// 直接取quantile(0.99)（不按le标签做histogram分位数计算），其余名称按Gauge取avg
+type PrometheusProvider struct {
+	mutex   sync.RWMutex
+	table   string
+	metrics map[string]*Metrics
+}
+
+func NewPrometheusProvider(table string) *PrometheusProvider {
+	return &PrometheusProvider{table: table, metrics: make(map[string]*Metrics)}
+}
+
+func (p *PrometheusProvider) Describe(table string, where string) (map[string]*Metrics, error) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	described := make(map[string]*Metrics, len(p.metrics))
+	for name, metric := range p.metrics {
+		described[name] = metric
+	}
+	return described, nil
+}
+
+func (p *PrometheusProvider) Resolve(field string, table string) (*Metrics, bool) {
+	p.mutex.RLock()
+	if metric, ok := p.metrics[field]; ok {
+		p.mutex.RUnlock()
+		return metric, true
+	}
+	p.mutex.RUnlock()
+	return p.deriveMetrics(field, table), true
+}
+
+// deriveMetrics按Prometheus的命名约定现场拼出聚合表达式，并缓存下来避免下次重复解析
+func (p *PrometheusProvider) deriveMetrics(field string, table string) *Metrics {
+	name, dbField, metricType := prometheusFieldToDBField(field)
+	metric := NewMetrics(0, dbField, field, "", metricType, "prometheus", []bool{true, true, true}, "", table)
+	metric.SetIsAgg(true)
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if existing, ok := p.metrics[name]; ok {
+		return existing
+	}
+	p.metrics[name] = metric
+	return metric
+}
+
+func prometheusFieldToDBField(field string) (name string, dbField string, metricType int) {
+	valueExpr := fmt.Sprintf("tag_values[indexOf(tag_names, '%s')]", field)
+	switch {
+	case strings.HasSuffix(field, prometheusSumSuffix):
+		return field, fmt.Sprintf("sum(toFloat64OrNull(%s))", valueExpr), METRICS_TYPE_COUNTER
+	case strings.HasSuffix(field, prometheusCountSuffix):
+		return field, fmt.Sprintf("sum(toFloat64OrNull(%s))", valueExpr), METRICS_TYPE_COUNTER
+	case strings.HasSuffix(field, prometheusBucketSuffix):
+		return field, fmt.Sprintf("quantile(0.99)(toFloat64OrNull(%s))", valueExpr), METRICS_TYPE_GAUGE
+	default:
+		return field, fmt.Sprintf("avg(toFloat64OrNull(%s))", valueExpr), METRICS_TYPE_GAUGE
+	}
+}
+
+func (p *PrometheusProvider) Merge(table string, loadMetrics map[string]*Metrics) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for name, value := range loadMetrics {
+		if value.Type == METRICS_TYPE_TAG {
+			value.IsAgg = true
+		}
+		p.metrics[name] = value
+	}
+	return nil
+}
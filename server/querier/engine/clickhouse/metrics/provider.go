@@ -0,0 +1,182 @@
+/*
+ * Copyright (c) 2022 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// MetricsProvider把“某个db下的一张或多张表有哪些指标量”这件事从GetMetricsByDBTable/MergeMetrics
+// 里的大switch中抽出来，让第三方db/table可以在进程启动时注册自己的实现，而不需要改这个包
+type MetricsProvider interface {
+	// Describe返回指定table在where条件下的全部指标量，key是指标量名
+	Describe(table string, where string) (map[string]*Metrics, error)
+	// Resolve按字段名解析出单个指标量，通常是Describe结果的一次查找，但像ext_metrics这种
+	// 需要从metrics.<name>这类动态字段名里现场构造Metrics的provider会重写这个方法
+	Resolve(field string, table string) (*Metrics, bool)
+	// Merge把从db_description表里LoadMetrics出来的自定义指标量合并进该provider管理的表里
+	Merge(table string, loadMetrics map[string]*Metrics) error
+}
+
+var (
+	providerMutex sync.RWMutex
+	providers     = make(map[string]MetricsProvider)
+)
+
+// RegisterProvider为一个db注册它的MetricsProvider，重复注册会覆盖之前的实现，
+// 方便进程启动时按配置选择内置provider还是第三方provider
+func RegisterProvider(db string, provider MetricsProvider) {
+	providerMutex.Lock()
+	defer providerMutex.Unlock()
+	providers[db] = provider
+}
+
+func getProvider(db string) (MetricsProvider, bool) {
+	providerMutex.RLock()
+	defer providerMutex.RUnlock()
+	provider, ok := providers[db]
+	return provider, ok
+}
+
+func init() {
+	RegisterProvider("flow_log", &staticTableProvider{
+		tables: map[string]func() map[string]*Metrics{
+			"l4_flow_log": GetL4FlowLogMetrics,
+			"l7_flow_log": GetL7FlowLogMetrics,
+		},
+		replace: map[string]map[string]*Metrics{
+			"l4_flow_log": L4_FLOW_LOG_METRICS_REPLACE,
+			"l7_flow_log": L7_FLOW_LOG_METRICS_REPLACE,
+		},
+		metrics: map[string]map[string]*Metrics{
+			"l4_flow_log": L4_FLOW_LOG_METRICS,
+			"l7_flow_log": L7_FLOW_LOG_METRICS,
+		},
+	})
+	RegisterProvider("flow_metrics", &staticTableProvider{
+		tables: map[string]func() map[string]*Metrics{
+			"vtap_flow_port":      GetVtapFlowPortMetrics,
+			"vtap_flow_edge_port": GetVtapFlowEdgePortMetrics,
+			"vtap_app_port":       GetVtapAppPortMetrics,
+			"vtap_app_edge_port":  GetVtapAppEdgePortMetrics,
+			"vtap_acl":            GetVtapAclMetrics,
+		},
+		replace: map[string]map[string]*Metrics{
+			"vtap_flow_port":      VTAP_FLOW_PORT_METRICS_REPLACE,
+			"vtap_flow_edge_port": VTAP_FLOW_EDGE_PORT_METRICS_REPLACE,
+			"vtap_app_port":       VTAP_APP_PORT_METRICS_REPLACE,
+			"vtap_app_edge_port":  VTAP_APP_EDGE_PORT_METRICS_REPLACE,
+			"vtap_acl":            VTAP_ACL_METRICS_REPLACE,
+		},
+		metrics: map[string]map[string]*Metrics{
+			"vtap_flow_port":      VTAP_FLOW_PORT_METRICS,
+			"vtap_flow_edge_port": VTAP_FLOW_EDGE_PORT_METRICS,
+			"vtap_app_port":       VTAP_APP_PORT_METRICS,
+			"vtap_app_edge_port":  VTAP_APP_EDGE_PORT_METRICS,
+			"vtap_acl":            VTAP_ACL_METRICS,
+		},
+	})
+	RegisterProvider("ext_metrics", &extMetricsProvider{db: "ext_metrics"})
+	RegisterProvider("deepflow_system", &extMetricsProvider{db: "deepflow_system"})
+}
+
+// staticTableProvider包装了原先switch里那些编译期就固定的表->指标量映射（flow_log/flow_metrics），
+// 是GetMetricsByDBTable/MergeMetrics重构后这部分行为的等价实现
+type staticTableProvider struct {
+	tables  map[string]func() map[string]*Metrics
+	replace map[string]map[string]*Metrics
+	metrics map[string]map[string]*Metrics
+}
+
+func (p *staticTableProvider) Describe(table string, where string) (map[string]*Metrics, error) {
+	get, ok := p.tables[table]
+	if !ok {
+		return nil, nil
+	}
+	return get(), nil
+}
+
+func (p *staticTableProvider) Resolve(field string, table string) (*Metrics, bool) {
+	allMetrics, err := p.Describe(table, "")
+	if err != nil || allMetrics == nil {
+		return nil, false
+	}
+	metric, ok := allMetrics[field]
+	return metric, ok
+}
+
+func (p *staticTableProvider) Merge(table string, loadMetrics map[string]*Metrics) error {
+	metrics, ok := p.metrics[table]
+	if !ok {
+		return errors.New(fmt.Sprintf("merge metrics failed! table:%s", table))
+	}
+	replaceMetrics := p.replace[table]
+	for name, value := range loadMetrics {
+		// TAG类型指标量都属于聚合类型
+		if value.Type == METRICS_TYPE_TAG {
+			value.IsAgg = true
+		}
+		if rm, ok := replaceMetrics[name]; ok && value.DBField == "" {
+			value.Replace(rm)
+		}
+		metrics[name] = value
+	}
+	return nil
+}
+
+// extMetricsProvider是ext_metrics/deepflow_system这类动态db的provider，它本身不持有固定的
+// 表->指标量映射，而是现场从ClickHouse的字段信息里解析，所以Resolve需要重写而不是复用Describe的查找
+type extMetricsProvider struct {
+	db string
+}
+
+func (p *extMetricsProvider) Describe(table string, where string) (map[string]*Metrics, error) {
+	return GetExtMetrics(p.db, table, where)
+}
+
+func (p *extMetricsProvider) Resolve(field string, table string) (*Metrics, bool) {
+	return resolveDynamicMetricsField(field, table)
+}
+
+func (p *extMetricsProvider) Merge(table string, loadMetrics map[string]*Metrics) error {
+	for name, value := range loadMetrics {
+		// TAG类型指标量都属于聚合类型
+		if value.Type == METRICS_TYPE_TAG {
+			value.IsAgg = true
+		}
+		EXT_METRICS[name] = value
+	}
+	return nil
+}
+
+// resolveDynamicMetricsField处理metrics.<name>这类不在任何固定表里的字段，原先写在
+// GetMetrics顶部，现在作为ext_metrics/deepflow_system provider的Resolve实现
+func resolveDynamicMetricsField(field string, table string) (*Metrics, bool) {
+	field = strings.Trim(field, "`")
+	fieldSplit := strings.Split(field, ".")
+	if len(fieldSplit) > 1 && fieldSplit[0] == "metrics" {
+		return NewMetrics(
+			0, fmt.Sprintf("if(indexOf(metrics_float_names, '%s')=0,null,metrics_float_values[indexOf(metrics_float_names, '%s')])", fieldSplit[1], fieldSplit[1]),
+			field, "", METRICS_TYPE_COUNTER,
+			"指标", []bool{true, true, true}, "", table,
+		), true
+	}
+	return nil, false
+}
@@ -0,0 +1,179 @@
+/*
+ * Copyright (c) 2022 Yunshan Networks
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package metrics
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// yamlMetricDef是LoadFromYAMLProvider配置文件里一条自定义指标量的声明，字段名和
+// db_description表里LoadMetrics要求的顺序对齐（DBField/DisplayName/Unit/Type/Category/Permissions）
+type yamlMetricDef struct {
+	DBField     string `yaml:"db_field"`
+	DisplayName string `yaml:"display_name"`
+	Unit        string `yaml:"unit"`
+	Type        string `yaml:"type"`
+	Category    string `yaml:"category"`
+	Permissions []bool `yaml:"permissions"`
+}
+
+type yamlMetricsFile struct {
+	// Tables的key是table名，同一个provider实例服务一个db下的多张表
+	Tables map[string]map[string]yamlMetricDef `yaml:"tables"`
+}
+
+// LoadFromYAMLProvider让operator在一个yaml文件里声明自定义指标量，不需要写Go代码注册
+// provider；文件会被周期性地检查mtime，变化后自动重新加载，不需要重启进程
+type LoadFromYAMLProvider struct {
+	path         string
+	pollInterval time.Duration
+
+	mutex    sync.RWMutex
+	modTime  time.Time
+	byTable  map[string]map[string]*Metrics
+	stopOnce sync.Once
+	stopCh   chan struct{}
+}
+
+// NewLoadFromYAMLProvider加载一次path指定的配置文件并启动后台goroutine监视它的变化，
+// 加载失败时返回error，调用方通常选择要么fatal要么退回到内置provider
+func NewLoadFromYAMLProvider(path string, pollInterval time.Duration) (*LoadFromYAMLProvider, error) {
+	if pollInterval <= 0 {
+		pollInterval = 30 * time.Second
+	}
+	p := &LoadFromYAMLProvider{
+		path:         path,
+		pollInterval: pollInterval,
+		byTable:      make(map[string]map[string]*Metrics),
+		stopCh:       make(chan struct{}),
+	}
+	if err := p.reload(); err != nil {
+		return nil, err
+	}
+	go p.watch()
+	return p, nil
+}
+
+func (p *LoadFromYAMLProvider) Close() {
+	p.stopOnce.Do(func() { close(p.stopCh) })
+}
+
+func (p *LoadFromYAMLProvider) watch() {
+	ticker := time.NewTicker(p.pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stopCh:
+			return
+		case <-ticker.C:
+			info, err := os.Stat(p.path)
+			if err != nil {
+				log.Warningf("metrics yaml provider stat %s failed: %s", p.path, err)
+				continue
+			}
+			p.mutex.RLock()
+			unchanged := info.ModTime().Equal(p.modTime)
+			p.mutex.RUnlock()
+			if unchanged {
+				continue
+			}
+			if err := p.reload(); err != nil {
+				log.Errorf("metrics yaml provider reload %s failed: %s", p.path, err)
+			} else {
+				log.Infof("metrics yaml provider reloaded %s", p.path)
+			}
+		}
+	}
+}
+
+func (p *LoadFromYAMLProvider) reload() error {
+	info, err := os.Stat(p.path)
+	if err != nil {
+		return err
+	}
+	content, err := ioutil.ReadFile(p.path)
+	if err != nil {
+		return err
+	}
+	var file yamlMetricsFile
+	if err := yaml.Unmarshal(content, &file); err != nil {
+		return err
+	}
+
+	byTable := make(map[string]map[string]*Metrics, len(file.Tables))
+	for table, defs := range file.Tables {
+		tableMetrics := make(map[string]*Metrics, len(defs))
+		index := 0
+		for name, def := range defs {
+			metricType, ok := METRICS_TYPE_NAME_MAP[def.Type]
+			if !ok {
+				return fmt.Errorf("metrics yaml provider: unknown type %q for metric %q in table %q", def.Type, name, table)
+			}
+			tableMetrics[name] = NewMetrics(
+				index, def.DBField, def.DisplayName, def.Unit, metricType, def.Category, def.Permissions, "", table,
+			)
+			index++
+		}
+		byTable[table] = tableMetrics
+	}
+
+	p.mutex.Lock()
+	p.byTable = byTable
+	p.modTime = info.ModTime()
+	p.mutex.Unlock()
+	return nil
+}
+
+func (p *LoadFromYAMLProvider) Describe(table string, where string) (map[string]*Metrics, error) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return p.byTable[table], nil
+}
+
+func (p *LoadFromYAMLProvider) Resolve(field string, table string) (*Metrics, bool) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	tableMetrics, ok := p.byTable[table]
+	if !ok {
+		return nil, false
+	}
+	metric, ok := tableMetrics[field]
+	return metric, ok
+}
+
+func (p *LoadFromYAMLProvider) Merge(table string, loadMetrics map[string]*Metrics) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	tableMetrics, ok := p.byTable[table]
+	if !ok {
+		tableMetrics = make(map[string]*Metrics)
+		p.byTable[table] = tableMetrics
+	}
+	for name, value := range loadMetrics {
+		if value.Type == METRICS_TYPE_TAG {
+			value.IsAgg = true
+		}
+		tableMetrics[name] = value
+	}
+	return nil
+}